@@ -22,6 +22,8 @@ func main() {
 				return "test-sub_" + topic
 			},
 			ProjectID: "test-project",
+			// the topic is created by the publisher, but the subscription has to exist before publishing
+			CreateTopicIfMissing: true,
 		},
 		watermill.NewStdLogger(false, false),
 	)
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 )
 
 type LogFields map[string]interface{}
@@ -157,30 +158,47 @@ type CapturedMessage struct {
 	Err    error
 }
 
+// CaptureLoggerAdapter captures all logged messages. It is safe for concurrent use.
 type CaptureLoggerAdapter struct {
 	captured map[LogLevel][]CapturedMessage
 	fields   LogFields
+	lock     *sync.Mutex
 }
 
 func NewCaptureLogger() *CaptureLoggerAdapter {
 	return &CaptureLoggerAdapter{
 		captured: map[LogLevel][]CapturedMessage{},
+		lock:     &sync.Mutex{},
 	}
 }
 
 func (c *CaptureLoggerAdapter) With(fields LogFields) LoggerAdapter {
-	return &CaptureLoggerAdapter{c.captured, c.fields.Add(fields)}
+	return &CaptureLoggerAdapter{c.captured, c.fields.Add(fields), c.lock}
 }
 
 func (c *CaptureLoggerAdapter) capture(msg CapturedMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	c.captured[msg.Level] = append(c.captured[msg.Level], msg)
 }
 
 func (c CaptureLoggerAdapter) Captured() map[LogLevel][]CapturedMessage {
-	return c.captured
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	captured := make(map[LogLevel][]CapturedMessage, len(c.captured))
+	for level, messages := range c.captured {
+		captured[level] = append([]CapturedMessage(nil), messages...)
+	}
+
+	return captured
 }
 
 func (c CaptureLoggerAdapter) Has(msg CapturedMessage) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	for _, capturedMsg := range c.captured[msg.Level] {
 		if reflect.DeepEqual(msg, capturedMsg) {
 			return true
@@ -190,6 +208,9 @@ func (c CaptureLoggerAdapter) Has(msg CapturedMessage) bool {
 }
 
 func (c CaptureLoggerAdapter) HasError(err error) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	for _, capturedMsg := range c.captured[ErrorLogLevel] {
 		if capturedMsg.Err == err {
 			return true
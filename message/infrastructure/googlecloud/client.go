@@ -0,0 +1,40 @@
+package googlecloud
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// subscriberClient is the part of the Pub/Sub client used by `Subscriber`, so how subscriptions are obtained
+// can be unit tested with a fake instead of a Pub/Sub server.
+//
+// Existence checks are part of it, as the topic and subscription handles of the client library
+// can check it only with a server.
+type subscriberClient interface {
+	Subscription(id string) *pubsub.Subscription
+	Topic(id string) *pubsub.Topic
+	Topics(ctx context.Context) *pubsub.TopicIterator
+	Snapshot(id string) *pubsub.Snapshot
+
+	SubscriptionExists(ctx context.Context, id string) (bool, error)
+	TopicExists(ctx context.Context, id string) (bool, error)
+
+	CreateTopicWithConfig(ctx context.Context, topicID string, tc *pubsub.TopicConfig) (*pubsub.Topic, error)
+	CreateSubscription(ctx context.Context, id string, cfg pubsub.SubscriptionConfig) (*pubsub.Subscription, error)
+
+	Close() error
+}
+
+// pubsubClient implements subscriberClient with the client library.
+type pubsubClient struct {
+	*pubsub.Client
+}
+
+func (c pubsubClient) SubscriptionExists(ctx context.Context, id string) (bool, error) {
+	return c.Subscription(id).Exists(ctx)
+}
+
+func (c pubsubClient) TopicExists(ctx context.Context, id string) (bool, error) {
+	return c.Topic(id).Exists(ctx)
+}
@@ -0,0 +1,49 @@
+package googlecloud
+
+import (
+	"time"
+)
+
+// clock is the source of time of `Subscriber`, so timeouts can be driven deterministically in tests.
+//
+// MessageProcessingTimeout is the exception, as it's the deadline of the message context,
+// which handlers can read with Deadline and check with context.DeadlineExceeded.
+type clock interface {
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time on the returned channel, like time.After.
+	After(d time.Duration) <-chan time.Time
+	// NewTimer creates a timer sending the current time on its channel after the duration, like time.NewTimer.
+	NewTimer(d time.Duration) clockTimer
+}
+
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the clock used outside of tests.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{timer: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
@@ -0,0 +1,203 @@
+package googlecloud
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// deadLetterAttributePrefix is the prefix of the attributes added by Pub/Sub to messages forwarded
+// to a dead letter topic, like CloudPubSubDeadLetterSourceDeliveryCount.
+const deadLetterAttributePrefix = "CloudPubSubDeadLetter"
+
+// RedriveSelectFn decides if a message from the dead letter topic is republished.
+type RedriveSelectFn func(msg *message.Message) bool
+
+type DeadLetterForwarderConfig struct {
+	// IdleTimeout is how long Redrive waits for the next message from the dead letter topic before it returns.
+	// Defaults to 5 seconds.
+	IdleTimeout time.Duration
+}
+
+func (c *DeadLetterForwarderConfig) setDefaults() {
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = time.Second * 5
+	}
+}
+
+func (c DeadLetterForwarderConfig) Validate() error {
+	if c.IdleTimeout < 0 {
+		return errors.Errorf("IdleTimeout must not be negative, got %s", c.IdleTimeout)
+	}
+
+	return nil
+}
+
+// DeadLetterForwarder republishes messages from a dead letter topic back to the topic they were originally
+// published to, for example after the handler failing on them was fixed.
+//
+// Pub/Sub delivers only the messages forwarded to the dead letter topic after the subscription was created,
+// so subscribe to the dead letter topic (for example with SubscribeInitialize) when setting up the dead letter policy.
+type DeadLetterForwarder struct {
+	subscriber message.Subscriber
+	publisher  message.Publisher
+	config     DeadLetterForwarderConfig
+	logger     watermill.LoggerAdapter
+	// clock is the clock of subscriber when it's a `Subscriber`, realClock otherwise.
+	clock clock
+}
+
+// NewDeadLetterForwarder creates a DeadLetterForwarder receiving from dead letter topics with subscriber
+// and republishing with publisher.
+func NewDeadLetterForwarder(
+	subscriber message.Subscriber,
+	publisher message.Publisher,
+	config DeadLetterForwarderConfig,
+	logger watermill.LoggerAdapter,
+) (*DeadLetterForwarder, error) {
+	if subscriber == nil {
+		return nil, errors.New("missing subscriber")
+	}
+	if publisher == nil {
+		return nil, errors.New("missing publisher")
+	}
+
+	config.setDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	var clock clock = realClock{}
+	if s, ok := subscriber.(*Subscriber); ok {
+		clock = s.config.clock
+	}
+
+	return &DeadLetterForwarder{
+		subscriber: subscriber,
+		publisher:  publisher,
+		config:     config,
+		logger:     logger,
+		clock:      clock,
+	}, nil
+}
+
+// Redrive republishes the messages from deadLetterTopic selected by selectFn to topic, and acks them.
+// If selectFn is nil, all the messages are republished. Messages which are not selected are nacked
+// once Redrive returns, so they stay in the dead letter topic and are not redelivered to Redrive meanwhile.
+// Until then, they count against the outstanding messages of the subscriber (for `Subscriber`,
+// ReceiveSettings.MaxOutstandingMessages), which limits how many messages can be skipped in one run.
+// Redelivered copies of messages which were already republished are acked without republishing them again.
+//
+// The metadata of the messages is preserved, except for the attributes added by Pub/Sub
+// when forwarding them to the dead letter topic; the delivery attempt and the publish time are assigned again.
+//
+// Redrive returns the number of republished messages once no new message arrives within IdleTimeout.
+// When ctx is canceled, it returns the number of messages republished until then with the ctx error.
+func (f *DeadLetterForwarder) Redrive(
+	ctx context.Context,
+	deadLetterTopic string,
+	topic string,
+	selectFn RedriveSelectFn,
+) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	messages, err := f.subscriber.Subscribe(ctx, deadLetterTopic)
+	if err != nil {
+		cancel()
+		return 0, errors.Wrapf(err, "cannot subscribe to dead letter topic %s", deadLetterTopic)
+	}
+	// skipped messages are not selected or redelivered copies of them, they are nacked once receiving stopped
+	var skipped []*message.Message
+	defer func() {
+		cancel()
+		for _, msg := range skipped {
+			msg.Nack()
+		}
+		// the subscription is finished once its messages are nacked
+		for msg := range messages {
+			msg.Nack()
+		}
+	}()
+
+	logFields := watermill.LogFields{
+		"dead_letter_topic": deadLetterTopic,
+		"topic":             topic,
+	}
+
+	redriven := 0
+	// messages may be redelivered, for example when their ack deadline passes, so they don't count as new;
+	// the value tells if the message was republished
+	seen := map[string]bool{}
+
+	idleTimer := f.clock.NewTimer(f.config.IdleTimeout)
+	defer func() { idleTimer.Stop() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return redriven, ctx.Err()
+		case <-idleTimer.C():
+			f.logger.Info("Redrive finished", logFields.Add(watermill.LogFields{"redriven": redriven}))
+			return redriven, nil
+		case msg, ok := <-messages:
+			if !ok {
+				// the subscription may be finished because ctx was canceled
+				return redriven, ctx.Err()
+			}
+
+			if republished, ok := seen[msg.UUID]; ok {
+				if republished {
+					msg.Ack()
+				} else {
+					skipped = append(skipped, msg)
+				}
+				continue
+			}
+
+			idleTimer.Stop()
+			idleTimer = f.clock.NewTimer(f.config.IdleTimeout)
+
+			if selectFn != nil && !selectFn(msg) {
+				seen[msg.UUID] = false
+				skipped = append(skipped, msg)
+				continue
+			}
+
+			if err := f.publisher.Publish(topic, redriveMessage(msg)); err != nil {
+				msg.Nack()
+				return redriven, errors.Wrapf(err, "cannot republish message %s", msg.UUID)
+			}
+			msg.Ack()
+			seen[msg.UUID] = true
+			redriven++
+
+			f.logger.Debug("Message redriven", logFields.Add(watermill.LogFields{"message_uuid": msg.UUID}))
+		}
+	}
+}
+
+// redriveMessage copies msg without the metadata assigned by Pub/Sub.
+func redriveMessage(msg *message.Message) *message.Message {
+	redriven := message.NewMessage(msg.UUID, msg.Payload)
+	for k, v := range msg.Metadata {
+		if strings.HasPrefix(k, deadLetterAttributePrefix) {
+			continue
+		}
+		switch k {
+		case DeliveryAttemptMetadataKey, PublishTimeMetadataKey, legacyPublishTimeMetadataKey:
+			continue
+		}
+
+		redriven.Metadata.Set(k, v)
+	}
+
+	return redriven
+}
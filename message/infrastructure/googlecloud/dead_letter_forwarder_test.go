@@ -0,0 +1,113 @@
+package googlecloud_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/googlecloud"
+)
+
+// deadLetterSubscriberMock delivers messages to the subscription and closes it once its ctx is canceled.
+type deadLetterSubscriberMock struct {
+	messages []*message.Message
+}
+
+func (s deadLetterSubscriberMock) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	output := make(chan *message.Message)
+
+	go func() {
+		defer close(output)
+
+		for _, msg := range s.messages {
+			select {
+			case output <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+
+	return output, nil
+}
+
+func (deadLetterSubscriberMock) Close() error {
+	return nil
+}
+
+type redrivePublisherMock struct {
+	published message.Messages
+}
+
+func (p *redrivePublisherMock) Publish(topic string, messages ...*message.Message) error {
+	p.published = append(p.published, messages...)
+	return nil
+}
+
+func (redrivePublisherMock) Close() error {
+	return nil
+}
+
+func TestDeadLetterForwarder_Redrive_redelivered_messages(t *testing.T) {
+	redriven := message.NewMessage(watermill.NewUUID(), []byte("redriven"))
+	redrivenCopy := message.NewMessage(redriven.UUID, []byte("redriven"))
+	skipped := message.NewMessage(watermill.NewUUID(), []byte("skipped"))
+	skippedCopy := message.NewMessage(skipped.UUID, []byte("skipped"))
+
+	pub := &redrivePublisherMock{}
+	forwarder, err := googlecloud.NewDeadLetterForwarder(
+		deadLetterSubscriberMock{messages: []*message.Message{redriven, skipped, redrivenCopy, skippedCopy}},
+		pub,
+		googlecloud.DeadLetterForwarderConfig{IdleTimeout: time.Millisecond * 100},
+		nil,
+	)
+	require.NoError(t, err)
+
+	count, err := forwarder.Redrive(context.Background(), "dead_letter", "topic", func(msg *message.Message) bool {
+		return msg.UUID == redriven.UUID
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	require.Len(t, pub.published, 1, "redelivered copy should not be republished")
+	assert.Equal(t, redriven.UUID, pub.published[0].UUID)
+
+	for _, msg := range []*message.Message{redriven, redrivenCopy} {
+		select {
+		case <-msg.Acked():
+		default:
+			t.Error("redriven message and its redelivered copy should be acked")
+		}
+	}
+	for _, msg := range []*message.Message{skipped, skippedCopy} {
+		select {
+		case <-msg.Nacked():
+		default:
+			t.Error("skipped message and its redelivered copy should be nacked")
+		}
+	}
+}
+
+func TestDeadLetterForwarder_Redrive_ctx_canceled(t *testing.T) {
+	forwarder, err := googlecloud.NewDeadLetterForwarder(
+		deadLetterSubscriberMock{},
+		&redrivePublisherMock{},
+		googlecloud.DeadLetterForwarderConfig{IdleTimeout: time.Hour},
+		nil,
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	count, err := forwarder.Redrive(ctx, "dead_letter", "topic", nil)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, 0, count)
+}
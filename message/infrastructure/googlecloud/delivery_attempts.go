@@ -0,0 +1,82 @@
+package googlecloud
+
+import (
+	"container/list"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// MaxDeliveryAttemptsAction decides what happens with messages delivered more than MaxDeliveryAttempts times.
+type MaxDeliveryAttemptsAction int
+
+const (
+	// MaxDeliveryAttemptsDrop acks and logs the message, so it is discarded instead of being redelivered forever.
+	MaxDeliveryAttemptsDrop MaxDeliveryAttemptsAction = iota
+	// MaxDeliveryAttemptsLog logs the message and delivers it as usual, for example to find out
+	// which messages would be dropped before enabling MaxDeliveryAttemptsDrop.
+	MaxDeliveryAttemptsLog
+)
+
+// deliveryAttemptsCacheSize is how many message IDs are remembered to count delivery attempts
+// of messages without the delivery attempt provided by Pub/Sub.
+const deliveryAttemptsCacheSize = 10000
+
+// deliveryAttempts counts deliveries of messages by their ID, remembering the most recently delivered ones.
+type deliveryAttempts struct {
+	lock    sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type deliveryAttemptsEntry struct {
+	id       string
+	attempts int
+}
+
+func newDeliveryAttempts(size int) *deliveryAttempts {
+	return &deliveryAttempts{
+		size:    size,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// add counts the delivery of the message and returns how many times it was delivered.
+// The delivery attempt provided by Pub/Sub is used when available.
+func (a *deliveryAttempts) add(pubsubMsg *pubsub.Message) int {
+	if pubsubMsg.DeliveryAttempt != nil {
+		return *pubsubMsg.DeliveryAttempt
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if element, ok := a.entries[pubsubMsg.ID]; ok {
+		a.lru.MoveToFront(element)
+		entry := element.Value.(*deliveryAttemptsEntry)
+		entry.attempts++
+		return entry.attempts
+	}
+
+	a.entries[pubsubMsg.ID] = a.lru.PushFront(&deliveryAttemptsEntry{id: pubsubMsg.ID, attempts: 1})
+	if a.lru.Len() > a.size {
+		oldest := a.lru.Back()
+		a.lru.Remove(oldest)
+		delete(a.entries, oldest.Value.(*deliveryAttemptsEntry).id)
+	}
+
+	return 1
+}
+
+// forget stops counting the deliveries of the message, once it's acked.
+func (a *deliveryAttempts) forget(pubsubMsg *pubsub.Message) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if element, ok := a.entries[pubsubMsg.ID]; ok {
+		a.lru.Remove(element)
+		delete(a.entries, pubsubMsg.ID)
+	}
+}
@@ -0,0 +1,73 @@
+package googlecloud
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// drainGroup are the subscriptions stopped together by Drain.
+type drainGroup struct {
+	// draining is closed by Drain to stop receiving new messages
+	draining chan struct{}
+	// timeoutExceeded is closed when ctx of Drain is done before the in-flight messages are acked or nacked
+	timeoutExceeded chan struct{}
+
+	wg sync.WaitGroup
+}
+
+func newDrainGroup() *drainGroup {
+	return &drainGroup{
+		draining:        make(chan struct{}),
+		timeoutExceeded: make(chan struct{}),
+	}
+}
+
+func isDraining(draining <-chan struct{}) bool {
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain stops receiving new messages on all the subscriptions started with Subscribe, waits until the in-flight
+// messages are acked or nacked and closes the output channels. Consumers should keep reading from
+// the output channels until they are closed, as messages buffered in them are in flight too.
+//
+// Unlike Close, Drain leaves the Subscriber and its connection open, so Subscribe can be called again,
+// also while draining. Subscriptions started after Drain is called are not drained.
+//
+// If ctx is done before the in-flight messages are acked or nacked, their contexts are canceled,
+// so they are nacked, and the error of ctx is returned.
+func (s *Subscriber) Drain(ctx context.Context) error {
+	s.closedLock.Lock()
+	if s.closed {
+		s.closedLock.Unlock()
+		return ErrSubscriberClosed
+	}
+	drain := s.drain
+	s.drain = newDrainGroup()
+	s.closedLock.Unlock()
+
+	s.logger.Info("Draining Google Cloud PubSub subscriber", nil)
+	close(drain.draining)
+
+	drained := make(chan struct{})
+	go func() {
+		drain.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.logger.Debug("Google Cloud PubSub subscriber drained", nil)
+		return nil
+	case <-ctx.Done():
+		close(drain.timeoutExceeded)
+		<-drained
+		return errors.Wrap(ctx.Err(), "in-flight messages were not processed before draining timed out")
+	}
+}
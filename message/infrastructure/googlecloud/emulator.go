@@ -0,0 +1,91 @@
+package googlecloud
+
+import (
+	"context"
+	"os"
+	"reflect"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	gtransport "google.golang.org/api/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// emulatorHostEnv is the environment variable with the address of the Pub/Sub emulator.
+const emulatorHostEnv = "PUBSUB_EMULATOR_HOST"
+
+const defaultEndpoint = "pubsub.googleapis.com:443"
+
+// emulatorProjectID is used when no project ID is configured, but the emulator is, as it accepts any project ID.
+const emulatorProjectID = "emulator"
+
+var (
+	endpointOptionType       = reflect.TypeOf(option.WithEndpoint(""))
+	grpcConnOptionType       = reflect.TypeOf(option.WithGRPCConn(nil))
+	grpcDialOptionOptionType = reflect.TypeOf(option.WithGRPCDialOption(nil))
+)
+
+// clientOptions returns the options for the cloud.google.com/go/pubsub client.
+//
+// When emulatorHostEnv is set, the client connects to the emulator without authentication,
+// unless emulator autodetection is disabled or endpoint options were supplied.
+// The client library itself connects to the emulator whenever emulatorHostEnv is set, ignoring the endpoint
+// and gRPC dial options, so in these cases the connection is established here, with the supplied options.
+func clientOptions(
+	ctx context.Context,
+	opts []option.ClientOption,
+	disableEmulatorAutodetect bool,
+) ([]option.ClientOption, error) {
+	emulatorHost := os.Getenv(emulatorHostEnv)
+	if emulatorHost == "" || hasOption(opts, grpcConnOptionType) {
+		return opts, nil
+	}
+
+	if !disableEmulatorAutodetect && !hasOption(opts, endpointOptionType) {
+		emulatorOpts := append(
+			opts[:len(opts):len(opts)],
+			option.WithEndpoint(emulatorHost),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		)
+		if !hasOption(opts, grpcDialOptionOptionType) {
+			return emulatorOpts, nil
+		}
+
+		conn, err := gtransport.Dial(ctx, emulatorOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot connect to the emulator")
+		}
+
+		return append(emulatorOpts, option.WithGRPCConn(conn)), nil
+	}
+
+	dialOpts := append([]option.ClientOption{
+		option.WithEndpoint(defaultEndpoint),
+		option.WithScopes(pubsub.ScopePubSub, pubsub.ScopeCloudPlatform),
+	}, opts...)
+
+	conn, err := gtransport.Dial(ctx, dialOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to Pub/Sub")
+	}
+
+	return append(opts[:len(opts):len(opts)], option.WithGRPCConn(conn)), nil
+}
+
+// emulatorConfigured is true if the client connects to the emulator unless endpoint options are supplied.
+func emulatorConfigured(disableEmulatorAutodetect bool) bool {
+	return !disableEmulatorAutodetect && os.Getenv(emulatorHostEnv) != ""
+}
+
+func hasOption(opts []option.ClientOption, optionType reflect.Type) bool {
+	for _, opt := range opts {
+		if reflect.TypeOf(opt) == optionType {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,85 @@
+package googlecloud
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func setEmulatorHost(t *testing.T, emulatorHost string) (restore func()) {
+	previousEmulatorHost, emulatorHostSet := os.LookupEnv(emulatorHostEnv)
+	require.NoError(t, os.Setenv(emulatorHostEnv, emulatorHost))
+
+	return func() {
+		if emulatorHostSet {
+			os.Setenv(emulatorHostEnv, previousEmulatorHost)
+		} else {
+			os.Unsetenv(emulatorHostEnv)
+		}
+	}
+}
+
+func TestClientOptions_emulator_autodetect(t *testing.T) {
+	defer setEmulatorHost(t, "localhost:8085")()
+
+	opts, err := clientOptions(context.Background(), nil, false)
+	require.NoError(t, err)
+
+	assert.True(t, hasOption(opts, endpointOptionType))
+	assert.Contains(t, opts, option.WithEndpoint("localhost:8085"))
+	assert.Contains(t, opts, option.WithoutAuthentication())
+}
+
+func TestClientOptions_emulator_not_set(t *testing.T) {
+	defer setEmulatorHost(t, "")()
+
+	userOpts := []option.ClientOption{option.WithUserAgent("test")}
+
+	opts, err := clientOptions(context.Background(), userOpts, false)
+	require.NoError(t, err)
+	assert.Equal(t, userOpts, opts)
+}
+
+func TestClientOptions_user_endpoint(t *testing.T) {
+	defer setEmulatorHost(t, "localhost:8085")()
+
+	userOpts := []option.ClientOption{
+		option.WithEndpoint("localhost:8086"),
+		option.WithoutAuthentication(),
+	}
+
+	opts, err := clientOptions(context.Background(), userOpts, false)
+	require.NoError(t, err)
+
+	assert.NotContains(t, opts, option.WithEndpoint("localhost:8085"))
+	assert.True(t, hasOption(opts, grpcConnOptionType), "connection to the user endpoint should be established")
+}
+
+func TestClientOptions_disable_emulator_autodetect(t *testing.T) {
+	defer setEmulatorHost(t, "localhost:8085")()
+
+	userOpts := []option.ClientOption{option.WithoutAuthentication()}
+
+	opts, err := clientOptions(context.Background(), userOpts, true)
+	require.NoError(t, err)
+
+	assert.False(t, hasOption(opts, endpointOptionType))
+	assert.True(t, hasOption(opts, grpcConnOptionType), "connection to the default endpoint should be established")
+	assert.Len(t, userOpts, 1)
+}
+
+func TestClientOptions_emulator_dial_options(t *testing.T) {
+	defer setEmulatorHost(t, "localhost:8085")()
+
+	userOpts := []option.ClientOption{option.WithGRPCDialOption(grpc.WithUserAgent("test"))}
+
+	opts, err := clientOptions(context.Background(), userOpts, false)
+	require.NoError(t, err)
+
+	assert.True(t, hasOption(opts, grpcConnOptionType), "connection to the emulator should be established")
+}
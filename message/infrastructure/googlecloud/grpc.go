@@ -0,0 +1,31 @@
+package googlecloud
+
+import (
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// withKeepaliveParams creates the keepalive dial option, it's replaced in tests to inspect the parameters.
+var withKeepaliveParams = grpc.WithKeepaliveParams
+
+// grpcClientOptions returns the client options for the configured gRPC connection pool size, keepalive
+// and dial options.
+func grpcClientOptions(
+	connectionPoolSize int,
+	keepaliveParams *keepalive.ClientParameters,
+	dialOptions []grpc.DialOption,
+) []option.ClientOption {
+	var opts []option.ClientOption
+	if connectionPoolSize > 0 {
+		opts = append(opts, option.WithGRPCConnectionPool(connectionPoolSize))
+	}
+	if keepaliveParams != nil {
+		opts = append(opts, option.WithGRPCDialOption(withKeepaliveParams(*keepaliveParams)))
+	}
+	for _, dialOption := range dialOptions {
+		opts = append(opts, option.WithGRPCDialOption(dialOption))
+	}
+
+	return opts
+}
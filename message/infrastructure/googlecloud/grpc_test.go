@@ -0,0 +1,42 @@
+package googlecloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+func TestGRPCClientOptions(t *testing.T) {
+	assert.Empty(t, grpcClientOptions(0, nil, nil))
+
+	opts := grpcClientOptions(8, nil, []grpc.DialOption{grpc.WithUserAgent("test")})
+
+	assert.Len(t, opts, 2)
+	assert.Contains(t, opts, option.WithGRPCConnectionPool(8))
+	assert.True(t, hasOption(opts, grpcDialOptionOptionType))
+}
+
+func TestGRPCClientOptions_keepalive(t *testing.T) {
+	var appliedParams []keepalive.ClientParameters
+	defer func(original func(keepalive.ClientParameters) grpc.DialOption) {
+		withKeepaliveParams = original
+	}(withKeepaliveParams)
+	withKeepaliveParams = func(params keepalive.ClientParameters) grpc.DialOption {
+		appliedParams = append(appliedParams, params)
+		return grpc.WithKeepaliveParams(params)
+	}
+
+	params := keepalive.ClientParameters{
+		Time:    time.Minute,
+		Timeout: time.Second * 20,
+	}
+	opts := grpcClientOptions(0, &params, nil)
+
+	assert.Len(t, opts, 1)
+	assert.True(t, hasOption(opts, grpcDialOptionOptionType))
+	assert.Equal(t, []keepalive.ClientParameters{params}, appliedParams)
+}
@@ -0,0 +1,81 @@
+package googlecloud
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// LogFieldFn transforms the value of a log field, for example to reduce the cardinality of logs.
+// If it returns nil, the field is omitted.
+type LogFieldFn func(value interface{}) interface{}
+
+// HashLogField replaces the value of the log field with a stable short hash of it,
+// so log lines about the same subscription can still be correlated.
+func HashLogField(value interface{}) interface{} {
+	h := fnv.New32a()
+	_, _ = fmt.Fprint(h, value)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// OmitLogField removes the log field.
+func OmitLogField(interface{}) interface{} {
+	return nil
+}
+
+// logFieldsTransformingLogger applies the transforms to the fields of all the log calls.
+type logFieldsTransformingLogger struct {
+	logger     watermill.LoggerAdapter
+	transforms map[string]LogFieldFn
+}
+
+func newLogFieldsTransformingLogger(
+	logger watermill.LoggerAdapter,
+	transforms map[string]LogFieldFn,
+) watermill.LoggerAdapter {
+	if logger == nil || len(transforms) == 0 {
+		return logger
+	}
+
+	return logFieldsTransformingLogger{logger: logger, transforms: transforms}
+}
+
+func (l logFieldsTransformingLogger) Error(msg string, err error, fields watermill.LogFields) {
+	l.logger.Error(msg, err, l.transform(fields))
+}
+
+func (l logFieldsTransformingLogger) Info(msg string, fields watermill.LogFields) {
+	l.logger.Info(msg, l.transform(fields))
+}
+
+func (l logFieldsTransformingLogger) Debug(msg string, fields watermill.LogFields) {
+	l.logger.Debug(msg, l.transform(fields))
+}
+
+func (l logFieldsTransformingLogger) Trace(msg string, fields watermill.LogFields) {
+	l.logger.Trace(msg, l.transform(fields))
+}
+
+func (l logFieldsTransformingLogger) With(fields watermill.LogFields) watermill.LoggerAdapter {
+	return logFieldsTransformingLogger{logger: l.logger.With(l.transform(fields)), transforms: l.transforms}
+}
+
+func (l logFieldsTransformingLogger) transform(fields watermill.LogFields) watermill.LogFields {
+	if len(fields) == 0 {
+		return fields
+	}
+
+	transformed := make(watermill.LogFields, len(fields))
+	for k, v := range fields {
+		if transform, ok := l.transforms[k]; ok {
+			v = transform(v)
+			if v == nil {
+				continue
+			}
+		}
+		transformed[k] = v
+	}
+
+	return transformed
+}
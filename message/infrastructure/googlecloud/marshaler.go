@@ -1,6 +1,9 @@
 package googlecloud
 
 import (
+	"strconv"
+	"time"
+
 	"cloud.google.com/go/pubsub"
 	"github.com/pkg/errors"
 
@@ -20,10 +23,67 @@ type Unmarshaler interface {
 // UUIDHeaderKey is the key of the Pub/Sub attribute that carries Waterfall UUID.
 const UUIDHeaderKey = "_watermill_message_uuid"
 
+// OrderingKeyMetadataKey is the key of the Watermill message metadata that carries the Pub/Sub ordering key.
+const OrderingKeyMetadataKey = "gcp_ordering_key"
+
+// PublishTimeMetadataKey is the key of the Watermill message metadata that carries the time when Pub/Sub
+// received the message, formatted as time.RFC3339Nano.
+// It is set by the Unmarshaler and ignored by the Marshaler, as the publish time is assigned by the server.
+const PublishTimeMetadataKey = "gcp_publish_time"
+
+// DeliveryAttemptMetadataKey is the key of the Watermill message metadata that carries how many times Pub/Sub
+// attempted to deliver the message, starting with 1, so handlers can detect redelivered messages.
+// It is set by the Unmarshaler when Pub/Sub provides the delivery attempt, which it does for subscriptions
+// with a dead letter policy, and ignored by the Marshaler.
+const DeliveryAttemptMetadataKey = "gcp_delivery_attempt"
+
+// legacyPublishTimeMetadataKey carries the publish time formatted with time.Time.String.
+// It is still set by the Unmarshaler for backwards compatibility, but deprecated in favour of PublishTimeMetadataKey.
+const legacyPublishTimeMetadataKey = "publishTime"
+
 // DefaultMarshalerUnmarshaler implements Marshaler and Unmarshaler in the following way:
 // All Google Cloud Pub/Sub attributes are equivalent to Waterfall Message metadata.
 // Waterfall Message UUID is equivalent to an attribute with `UUIDHeaderKey` as key.
-type DefaultMarshalerUnmarshaler struct{}
+// Pub/Sub ordering key is equivalent to metadata with `OrderingKeyMetadataKey` as key.
+//
+// To interoperate with producers and consumers using other conventions, the attribute carrying the UUID
+// and the mapping between metadata and attributes can be configured.
+type DefaultMarshalerUnmarshaler struct {
+	// TracePropagator, when set, propagates the trace context of messages in Pub/Sub attributes.
+	TracePropagator TracePropagator
+
+	// UUIDAttributeKey is the key of the Pub/Sub attribute that carries Watermill UUID.
+	// Defaults to `UUIDHeaderKey`.
+	UUIDAttributeKey string
+
+	// MetadataToAttribute, when set, returns the Pub/Sub attribute key for the metadata key.
+	// Metadata for which it returns an empty string is not published.
+	MetadataToAttribute func(metadataKey string) string
+
+	// AttributeToMetadata, when set, returns the metadata key for the Pub/Sub attribute key,
+	// usually the inverse of MetadataToAttribute. Attributes for which it returns an empty string are dropped.
+	AttributeToMetadata func(attributeKey string) string
+
+	// OrderingKeyFromUUID, when true, sets the Pub/Sub ordering key of marshaled messages to their UUID,
+	// for downstream consumers deduplicating messages by the ordering key.
+	// OrderingKeyFromMetadata, when set, sets it to the metadata of marshaled messages under this key instead.
+	// Only one of them can be set. When none is set, the ordering key is taken from `OrderingKeyMetadataKey`.
+	//
+	// They are mutually exclusive with PublisherConfig.OrderingKeyFn, and like it, they have effect
+	// only with PublisherConfig.EnableMessageOrdering.
+	OrderingKeyFromUUID     bool
+	OrderingKeyFromMetadata string
+
+	// DeduplicationKeyAttribute, when set, is the Pub/Sub attribute carrying the deduplication key of marshaled
+	// messages, so consumers or subscription filters expecting a particular attribute can drop messages
+	// published again on retries. It overrides metadata under the same key.
+	// The UUID attribute is always published regardless, so consumers can deduplicate messages by it too.
+	DeduplicationKeyAttribute string
+
+	// DeduplicationKey returns the deduplication key of the message, it has to be the same
+	// each time the message is marshaled. Defaults to the message UUID.
+	DeduplicationKey func(msg *message.Message) string
+}
 
 type MarshalerUnmarshaler interface {
 	Marshaler
@@ -31,21 +91,54 @@ type MarshalerUnmarshaler interface {
 }
 
 func (m DefaultMarshalerUnmarshaler) Marshal(topic string, msg *message.Message) (*pubsub.Message, error) {
-	if value := msg.Metadata.Get(UUIDHeaderKey); value != "" {
-		return nil, errors.Errorf("metadata %s is reserved by watermill for message UUID", UUIDHeaderKey)
+	uuidAttributeKey := m.uuidAttributeKey()
+
+	// sized for all attributes up front, so the map doesn't grow while they are set;
+	// it's allocated even without metadata, as marshalers wrapping this one add attributes to it
+	attributes := make(map[string]string, len(msg.Metadata)+1)
+	attributes[uuidAttributeKey] = msg.UUID
+
+	for k, v := range msg.Metadata {
+		switch k {
+		case OrderingKeyMetadataKey, PublishTimeMetadataKey, legacyPublishTimeMetadataKey, DeliveryAttemptMetadataKey,
+			SubscriptionMetadataKey, TopicMetadataKey, RoutingKeyMetadataKey:
+			continue
+		}
+
+		attributeKey := k
+		if m.MetadataToAttribute != nil {
+			attributeKey = m.MetadataToAttribute(k)
+		}
+		if attributeKey == "" {
+			continue
+		}
+		if attributeKey == uuidAttributeKey && v != "" {
+			return nil, errors.Errorf("metadata %s is reserved by watermill for message UUID", k)
+		}
+
+		attributes[attributeKey] = v
 	}
 
-	attributes := map[string]string{
-		UUIDHeaderKey: msg.UUID,
+	if m.DeduplicationKeyAttribute != "" {
+		if m.DeduplicationKeyAttribute == uuidAttributeKey {
+			return nil, errors.Errorf("attribute %s is reserved by watermill for message UUID", uuidAttributeKey)
+		}
+		attributes[m.DeduplicationKeyAttribute] = m.deduplicationKey(msg)
 	}
 
-	for k, v := range msg.Metadata {
-		attributes[k] = v
+	if m.TracePropagator != nil {
+		m.TracePropagator.Inject(msg, attributes)
+	}
+
+	orderingKey, err := m.orderingKey(msg)
+	if err != nil {
+		return nil, err
 	}
 
 	marshaledMsg := &pubsub.Message{
-		Data:       msg.Payload,
-		Attributes: attributes,
+		Data:        msg.Payload,
+		Attributes:  attributes,
+		OrderingKey: orderingKey,
 	}
 
 	return marshaledMsg, nil
@@ -54,19 +147,76 @@ func (m DefaultMarshalerUnmarshaler) Marshal(topic string, msg *message.Message)
 func (u DefaultMarshalerUnmarshaler) Unmarshal(pubsubMsg *pubsub.Message) (*message.Message, error) {
 	metadata := make(message.Metadata, len(pubsubMsg.Attributes))
 
+	uuidAttributeKey := u.uuidAttributeKey()
+
 	var id string
 	for k, attr := range pubsubMsg.Attributes {
-		if k == UUIDHeaderKey {
+		if k == uuidAttributeKey {
 			id = attr
 			continue
 		}
-		metadata.Set(k, attr)
+
+		metadataKey := k
+		if u.AttributeToMetadata != nil {
+			metadataKey = u.AttributeToMetadata(k)
+		}
+		if metadataKey == "" {
+			continue
+		}
+
+		metadata.Set(metadataKey, attr)
 	}
 
-	metadata.Set("publishTime", pubsubMsg.PublishTime.String())
+	metadata.Set(legacyPublishTimeMetadataKey, pubsubMsg.PublishTime.String())
+	metadata.Set(PublishTimeMetadataKey, pubsubMsg.PublishTime.Format(time.RFC3339Nano))
+
+	if pubsubMsg.OrderingKey != "" {
+		metadata.Set(OrderingKeyMetadataKey, pubsubMsg.OrderingKey)
+	}
+	if pubsubMsg.DeliveryAttempt != nil {
+		metadata.Set(DeliveryAttemptMetadataKey, strconv.Itoa(*pubsubMsg.DeliveryAttempt))
+	}
 
 	msg := message.NewMessage(id, pubsubMsg.Data)
 	msg.Metadata = metadata
 
+	if u.TracePropagator != nil {
+		u.TracePropagator.Extract(pubsubMsg.Attributes, msg)
+	}
+
 	return msg, nil
 }
+
+func (m DefaultMarshalerUnmarshaler) orderingKey(msg *message.Message) (string, error) {
+	switch {
+	case m.OrderingKeyFromUUID && m.OrderingKeyFromMetadata != "":
+		return "", errors.New("OrderingKeyFromUUID and OrderingKeyFromMetadata can't be set together")
+	case m.OrderingKeyFromUUID:
+		return msg.UUID, nil
+	case m.OrderingKeyFromMetadata != "":
+		return msg.Metadata.Get(m.OrderingKeyFromMetadata), nil
+	default:
+		return msg.Metadata.Get(OrderingKeyMetadataKey), nil
+	}
+}
+
+// setsOrderingKey tells if the ordering key is configured to be set in a way conflicting with OrderingKeyFn.
+func (m DefaultMarshalerUnmarshaler) setsOrderingKey() bool {
+	return m.OrderingKeyFromUUID || m.OrderingKeyFromMetadata != ""
+}
+
+func (m DefaultMarshalerUnmarshaler) deduplicationKey(msg *message.Message) string {
+	if m.DeduplicationKey != nil {
+		return m.DeduplicationKey(msg)
+	}
+
+	return msg.UUID
+}
+
+func (m DefaultMarshalerUnmarshaler) uuidAttributeKey() string {
+	if m.UUIDAttributeKey != "" {
+		return m.UUIDAttributeKey
+	}
+
+	return UUIDHeaderKey
+}
@@ -0,0 +1,141 @@
+package googlecloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ContentEncodingAttribute is the key of the Pub/Sub attribute that carries the encoding of the payload.
+const ContentEncodingAttribute = "content-encoding"
+
+// GzipContentEncoding is the content encoding of payloads compressed by `CompressingMarshaler`.
+const GzipContentEncoding = "gzip"
+
+// DefaultMaxDecompressedSize is the size in bytes up to which `DecompressingUnmarshaler` decompresses payloads
+// by default, so a small compressed payload can't expand to exhaust the memory of the subscriber.
+const DefaultMaxDecompressedSize = 10 * MaxMessageSize
+
+// ErrDecompressedPayloadTooLarge happens when the payload decompressed by `DecompressingUnmarshaler`
+// is larger than its MaxDecompressedSize.
+var ErrDecompressedPayloadTooLarge = errors.New("decompressed payload too large")
+
+// CompressingMarshaler compresses payloads of messages marshaled by the wrapped Marshaler with gzip
+// and sets the `ContentEncodingAttribute` attribute to `GzipContentEncoding`.
+// Use `DecompressingUnmarshaler` on the subscriber side to decompress them.
+type CompressingMarshaler struct {
+	// Marshaler marshals the messages before their payloads are compressed.
+	// Defaults to `DefaultMarshalerUnmarshaler`.
+	Marshaler Marshaler
+
+	// Level is the gzip compression level, see compress/gzip. 0 means gzip.DefaultCompression.
+	Level int
+}
+
+func (m CompressingMarshaler) Marshal(topic string, msg *message.Message) (*pubsub.Message, error) {
+	marshaler := m.Marshaler
+	if marshaler == nil {
+		marshaler = DefaultMarshalerUnmarshaler{}
+	}
+
+	marshaledMsg, err := marshaler.Marshal(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	level := m.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create gzip writer")
+	}
+	if _, err := w.Write(marshaledMsg.Data); err != nil {
+		return nil, errors.Wrapf(err, "cannot compress payload of message %s", msg.UUID)
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrapf(err, "cannot compress payload of message %s", msg.UUID)
+	}
+
+	if marshaledMsg.Attributes == nil {
+		marshaledMsg.Attributes = map[string]string{}
+	}
+	marshaledMsg.Data = buf.Bytes()
+	marshaledMsg.Attributes[ContentEncodingAttribute] = GzipContentEncoding
+
+	return marshaledMsg, nil
+}
+
+// DecompressingUnmarshaler decompresses payloads of messages compressed by `CompressingMarshaler`
+// before passing them to the wrapped Unmarshaler.
+// Messages without the `ContentEncodingAttribute` attribute are passed through unchanged,
+// so compressed and uncompressed messages can be received from the same subscription.
+type DecompressingUnmarshaler struct {
+	// Unmarshaler unmarshals the messages after their payloads are decompressed.
+	// Defaults to `DefaultMarshalerUnmarshaler`.
+	Unmarshaler Unmarshaler
+
+	// MaxDecompressedSize is the maximum size of a decompressed payload in bytes.
+	// Larger payloads are not decompressed further, and unmarshaling them fails with `ErrDecompressedPayloadTooLarge`.
+	// Defaults to `DefaultMaxDecompressedSize`.
+	MaxDecompressedSize int
+}
+
+func (u DecompressingUnmarshaler) Unmarshal(pubsubMsg *pubsub.Message) (*message.Message, error) {
+	unmarshaler := u.Unmarshaler
+	if unmarshaler == nil {
+		unmarshaler = DefaultMarshalerUnmarshaler{}
+	}
+	maxSize := u.MaxDecompressedSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxDecompressedSize
+	}
+
+	encoding, ok := pubsubMsg.Attributes[ContentEncodingAttribute]
+	if !ok {
+		return unmarshaler.Unmarshal(pubsubMsg)
+	}
+	if encoding != GzipContentEncoding {
+		return nil, errors.Errorf("unsupported content encoding %q of Pub/Sub message %s", encoding, pubsubMsg.ID)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(pubsubMsg.Data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot decompress payload of Pub/Sub message %s", pubsubMsg.ID)
+	}
+	defer r.Close()
+
+	// one byte more than allowed is read to tell if the payload is larger
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot decompress payload of Pub/Sub message %s", pubsubMsg.ID)
+	}
+	if len(data) > maxSize {
+		return nil, errors.Wrapf(
+			ErrDecompressedPayloadTooLarge,
+			"payload of Pub/Sub message %s is larger than %d bytes", pubsubMsg.ID, maxSize,
+		)
+	}
+
+	attributes := make(map[string]string, len(pubsubMsg.Attributes)-1)
+	for k, v := range pubsubMsg.Attributes {
+		if k != ContentEncodingAttribute {
+			attributes[k] = v
+		}
+	}
+
+	decompressedMsg := *pubsubMsg
+	decompressedMsg.Data = data
+	decompressedMsg.Attributes = attributes
+
+	return unmarshaler.Unmarshal(&decompressedMsg)
+}
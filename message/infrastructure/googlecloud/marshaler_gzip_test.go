@@ -0,0 +1,90 @@
+package googlecloud_test
+
+import (
+	"bytes"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/googlecloud"
+)
+
+func TestCompressingMarshaler(t *testing.T) {
+	m := googlecloud.CompressingMarshaler{Marshaler: googlecloud.DefaultMarshalerUnmarshaler{}}
+	u := googlecloud.DecompressingUnmarshaler{Unmarshaler: googlecloud.DefaultMarshalerUnmarshaler{}}
+
+	payload := bytes.Repeat([]byte(`{"foo":"bar"}`), 1000)
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	msg.Metadata.Set("foo", "bar")
+
+	marshaled, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, googlecloud.GzipContentEncoding, marshaled.Attributes[googlecloud.ContentEncodingAttribute])
+	assert.True(t, len(marshaled.Data) < len(payload), "payload should be compressed")
+
+	unmarshaledMsg, err := u.Unmarshal(marshaled)
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, unmarshaledMsg.UUID)
+	assert.Equal(t, payload, []byte(unmarshaledMsg.Payload))
+	assert.Equal(t, "bar", unmarshaledMsg.Metadata.Get("foo"))
+	assert.Empty(t, unmarshaledMsg.Metadata.Get(googlecloud.ContentEncodingAttribute))
+}
+
+func TestDecompressingUnmarshaler_uncompressed(t *testing.T) {
+	u := googlecloud.DecompressingUnmarshaler{Unmarshaler: googlecloud.DefaultMarshalerUnmarshaler{}}
+
+	unmarshaledMsg, err := u.Unmarshal(&pubsub.Message{
+		Data:       []byte("payload"),
+		Attributes: map[string]string{googlecloud.UUIDHeaderKey: "uuid"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "uuid", unmarshaledMsg.UUID)
+	assert.Equal(t, []byte("payload"), []byte(unmarshaledMsg.Payload))
+}
+
+func TestDecompressingUnmarshaler_unsupported_encoding(t *testing.T) {
+	u := googlecloud.DecompressingUnmarshaler{Unmarshaler: googlecloud.DefaultMarshalerUnmarshaler{}}
+
+	_, err := u.Unmarshal(&pubsub.Message{
+		Data:       []byte("payload"),
+		Attributes: map[string]string{googlecloud.ContentEncodingAttribute: "br"},
+	})
+	assert.Error(t, err)
+}
+
+func TestCompressingMarshaler_zero_value(t *testing.T) {
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+
+	marshaled, err := googlecloud.CompressingMarshaler{}.Marshal("topic", msg)
+	require.NoError(t, err)
+
+	unmarshaledMsg, err := googlecloud.DecompressingUnmarshaler{}.Unmarshal(marshaled)
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, unmarshaledMsg.UUID)
+	assert.Equal(t, []byte("payload"), []byte(unmarshaledMsg.Payload))
+}
+
+func TestDecompressingUnmarshaler_max_decompressed_size(t *testing.T) {
+	const maxSize = 1024
+
+	m := googlecloud.CompressingMarshaler{}
+	u := googlecloud.DecompressingUnmarshaler{MaxDecompressedSize: maxSize}
+
+	marshaled, err := m.Marshal("topic", message.NewMessage(watermill.NewUUID(), make([]byte, maxSize)))
+	require.NoError(t, err)
+	_, err = u.Unmarshal(marshaled)
+	assert.NoError(t, err, "payload of exactly MaxDecompressedSize should be decompressed")
+
+	// a small compressed payload expands past the limit
+	marshaled, err = m.Marshal("topic", message.NewMessage(watermill.NewUUID(), make([]byte, maxSize*100)))
+	require.NoError(t, err)
+	require.True(t, len(marshaled.Data) < maxSize)
+
+	_, err = u.Unmarshal(marshaled)
+	assert.True(t, errors.Is(err, googlecloud.ErrDecompressedPayloadTooLarge), "unexpected error: %v", err)
+}
@@ -0,0 +1,56 @@
+package googlecloud
+
+import (
+	"cloud.google.com/go/pubsub"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ContentTypeAttribute is the key of the Pub/Sub attribute that carries the content type of the payload.
+const ContentTypeAttribute = "content-type"
+
+// ProtobufContentType is the content type of Protocol Buffers payloads.
+const ProtobufContentType = "application/x-protobuf"
+
+// ProtobufMarshaler implements Marshaler and Unmarshaler for messages with Protocol Buffers payloads.
+// It works like DefaultMarshalerUnmarshaler, but additionally sets the `ContentTypeAttribute` attribute
+// to `ProtobufContentType`, so other consumers of the topic can recognize the payload.
+type ProtobufMarshaler struct {
+	DefaultMarshalerUnmarshaler
+
+	// NewMessage, when set, returns an empty message of the type expected in the payload.
+	// Payloads which can't be unmarshaled into it are then rejected both when marshaling and unmarshaling.
+	NewMessage func() proto.Message
+}
+
+func (m ProtobufMarshaler) Marshal(topic string, msg *message.Message) (*pubsub.Message, error) {
+	if err := m.validate(msg.Payload); err != nil {
+		return nil, errors.Wrapf(err, "invalid payload of message %s", msg.UUID)
+	}
+
+	marshaledMsg, err := m.DefaultMarshalerUnmarshaler.Marshal(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+	marshaledMsg.Attributes[ContentTypeAttribute] = ProtobufContentType
+
+	return marshaledMsg, nil
+}
+
+func (m ProtobufMarshaler) Unmarshal(pubsubMsg *pubsub.Message) (*message.Message, error) {
+	if err := m.validate(pubsubMsg.Data); err != nil {
+		return nil, errors.Wrapf(err, "invalid payload of Pub/Sub message %s", pubsubMsg.ID)
+	}
+
+	return m.DefaultMarshalerUnmarshaler.Unmarshal(pubsubMsg)
+}
+
+func (m ProtobufMarshaler) validate(payload []byte) error {
+	if m.NewMessage == nil {
+		return nil
+	}
+
+	return proto.Unmarshal(payload, m.NewMessage())
+}
@@ -0,0 +1,62 @@
+package googlecloud_test
+
+import (
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/googlecloud"
+)
+
+func TestProtobufMarshaler(t *testing.T) {
+	m := googlecloud.ProtobufMarshaler{
+		NewMessage: func() proto.Message { return &wrappers.StringValue{} },
+	}
+
+	payload, err := proto.Marshal(&wrappers.StringValue{Value: "hello"})
+	require.NoError(t, err)
+
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	msg.Metadata.Set("foo", "bar")
+
+	marshaled, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, googlecloud.ProtobufContentType, marshaled.Attributes[googlecloud.ContentTypeAttribute])
+	assert.Equal(t, "bar", marshaled.Attributes["foo"])
+
+	unmarshaledMsg, err := m.Unmarshal(marshaled)
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, unmarshaledMsg.UUID)
+	assert.Equal(t, googlecloud.ProtobufContentType, unmarshaledMsg.Metadata.Get(googlecloud.ContentTypeAttribute))
+
+	unmarshaledPayload := &wrappers.StringValue{}
+	require.NoError(t, proto.Unmarshal(unmarshaledMsg.Payload, unmarshaledPayload))
+	assert.Equal(t, "hello", unmarshaledPayload.Value)
+}
+
+func TestProtobufMarshaler_invalid_payload(t *testing.T) {
+	m := googlecloud.ProtobufMarshaler{
+		NewMessage: func() proto.Message { return &wrappers.StringValue{} },
+	}
+
+	// 0xff isn't a valid field tag
+	invalidPayload := []byte{0xff}
+
+	_, err := m.Marshal("topic", message.NewMessage(watermill.NewUUID(), invalidPayload))
+	assert.Error(t, err)
+
+	_, err = m.Unmarshal(&pubsub.Message{
+		Data:       invalidPayload,
+		Attributes: map[string]string{googlecloud.UUIDHeaderKey: watermill.NewUUID()},
+	})
+	assert.Error(t, err)
+
+	_, err = googlecloud.ProtobufMarshaler{}.Marshal("topic", message.NewMessage(watermill.NewUUID(), invalidPayload))
+	assert.NoError(t, err, "payload should not be validated without NewMessage")
+}
@@ -0,0 +1,291 @@
+package googlecloud_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/googlecloud"
+)
+
+func TestDefaultMarshalerUnmarshaler_ordering_key(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("foo", "bar")
+	msg.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "key")
+
+	marshaled, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, "key", marshaled.OrderingKey)
+	assert.NotContains(t, marshaled.Attributes, googlecloud.OrderingKeyMetadataKey)
+
+	unmarshaledMsg, err := m.Unmarshal(marshaled)
+	require.NoError(t, err)
+
+	assert.Equal(t, msg.UUID, unmarshaledMsg.UUID)
+	assert.Equal(t, "bar", unmarshaledMsg.Metadata.Get("foo"))
+	assert.Equal(t, "key", unmarshaledMsg.Metadata.Get(googlecloud.OrderingKeyMetadataKey))
+}
+
+func TestDefaultMarshalerUnmarshaler_deduplication_key(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{
+		DeduplicationKeyAttribute: "dedup_key",
+	}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("dedup_key", "overridden")
+
+	marshaled, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, marshaled.Attributes[googlecloud.UUIDHeaderKey])
+	assert.Equal(t, msg.UUID, marshaled.Attributes["dedup_key"])
+
+	// the message is published again on retry
+	republished, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, marshaled.Attributes, republished.Attributes)
+
+	// the consumed message is forwarded with the same key
+	unmarshaledMsg, err := m.Unmarshal(marshaled)
+	require.NoError(t, err)
+	forwarded, err := m.Marshal("other_topic", unmarshaledMsg)
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, forwarded.Attributes[googlecloud.UUIDHeaderKey])
+	assert.Equal(t, msg.UUID, forwarded.Attributes["dedup_key"])
+
+	m.DeduplicationKey = func(msg *message.Message) string {
+		return msg.Metadata.Get("order_id")
+	}
+	msg.Metadata.Set("order_id", "order-1")
+	marshaled, err = m.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, "order-1", marshaled.Attributes["dedup_key"])
+	assert.Equal(t, msg.UUID, marshaled.Attributes[googlecloud.UUIDHeaderKey])
+
+	m.DeduplicationKeyAttribute = googlecloud.UUIDHeaderKey
+	_, err = m.Marshal("topic", msg)
+	assert.Error(t, err)
+}
+
+func TestDefaultMarshalerUnmarshaler_empty_metadata(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+
+	marshaled, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{googlecloud.UUIDHeaderKey: msg.UUID}, marshaled.Attributes)
+
+	unmarshaledMsg, err := m.Unmarshal(marshaled)
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, unmarshaledMsg.UUID)
+	assert.Equal(t, msg.Payload, unmarshaledMsg.Payload)
+
+	// only the metadata set by Unmarshal is present, and it's not published again
+	republished, err := m.Marshal("topic", unmarshaledMsg)
+	require.NoError(t, err)
+	assert.Equal(t, marshaled.Attributes, republished.Attributes)
+
+	// each marshaled message owns its attributes, which wrapping marshalers modify
+	republished.Attributes["key"] = "value"
+	assert.Equal(t, map[string]string{googlecloud.UUIDHeaderKey: msg.UUID}, marshaled.Attributes)
+}
+
+func TestDefaultMarshalerUnmarshaler_publish_time(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{}
+	publishTime := time.Date(2019, 2, 1, 12, 30, 0, 123456789, time.UTC)
+
+	unmarshaledMsg, err := m.Unmarshal(&pubsub.Message{
+		Data:        []byte("payload"),
+		Attributes:  map[string]string{googlecloud.UUIDHeaderKey: watermill.NewUUID()},
+		PublishTime: publishTime,
+	})
+	require.NoError(t, err)
+
+	parsed, err := time.Parse(time.RFC3339Nano, unmarshaledMsg.Metadata.Get(googlecloud.PublishTimeMetadataKey))
+	require.NoError(t, err)
+	assert.True(t, publishTime.Equal(parsed))
+
+	// publish time is assigned by Pub/Sub, so it's not sent back when the message is republished
+	marshaled, err := m.Marshal("topic", unmarshaledMsg)
+	require.NoError(t, err)
+	assert.NotContains(t, marshaled.Attributes, googlecloud.PublishTimeMetadataKey)
+	assert.NotContains(t, marshaled.Attributes, "publishTime")
+}
+
+func TestDefaultMarshalerUnmarshaler_delivery_attempt(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{}
+	deliveryAttempt := 3
+
+	unmarshaledMsg, err := m.Unmarshal(&pubsub.Message{
+		Attributes:      map[string]string{googlecloud.UUIDHeaderKey: watermill.NewUUID()},
+		DeliveryAttempt: &deliveryAttempt,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "3", unmarshaledMsg.Metadata.Get(googlecloud.DeliveryAttemptMetadataKey))
+
+	// the delivery attempt is assigned by Pub/Sub, so it's not sent back when the message is republished
+	marshaled, err := m.Marshal("topic", unmarshaledMsg)
+	require.NoError(t, err)
+	assert.NotContains(t, marshaled.Attributes, googlecloud.DeliveryAttemptMetadataKey)
+
+	// the origin of a received message is set by Subscriber, so it's not sent either
+	unmarshaledMsg.Metadata.Set(googlecloud.SubscriptionMetadataKey, "subscription")
+	unmarshaledMsg.Metadata.Set(googlecloud.TopicMetadataKey, "topic")
+	marshaled, err = m.Marshal("other_topic", unmarshaledMsg)
+	require.NoError(t, err)
+	assert.NotContains(t, marshaled.Attributes, googlecloud.SubscriptionMetadataKey)
+	assert.NotContains(t, marshaled.Attributes, googlecloud.TopicMetadataKey)
+
+	unmarshaledMsg, err = m.Unmarshal(&pubsub.Message{
+		Attributes: map[string]string{googlecloud.UUIDHeaderKey: watermill.NewUUID()},
+	})
+	require.NoError(t, err)
+	assert.NotContains(t, unmarshaledMsg.Metadata, googlecloud.DeliveryAttemptMetadataKey)
+}
+
+func TestDefaultMarshalerUnmarshaler_trace_propagator(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{
+		TracePropagator: googlecloud.W3CTracePropagator{},
+	}
+	traceParent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.SetContext(googlecloud.ContextWithTraceParent(context.Background(), traceParent))
+	msg.Metadata.Set(googlecloud.TraceStateKey, "congo=t61rcWkgMzE")
+
+	marshaled, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, traceParent, marshaled.Attributes[googlecloud.TraceParentKey])
+
+	unmarshaledMsg, err := m.Unmarshal(marshaled)
+	require.NoError(t, err)
+	assert.Equal(t, traceParent, unmarshaledMsg.Metadata.Get(googlecloud.TraceParentKey))
+	assert.Equal(t, "congo=t61rcWkgMzE", unmarshaledMsg.Metadata.Get(googlecloud.TraceStateKey))
+}
+
+func TestDefaultMarshalerUnmarshaler_without_trace_propagator(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.SetContext(googlecloud.ContextWithTraceParent(
+		context.Background(),
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	))
+
+	marshaled, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.NotContains(t, marshaled.Attributes, googlecloud.TraceParentKey)
+}
+
+func TestDefaultMarshalerUnmarshaler_custom_attributes(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{
+		UUIDAttributeKey: "event_id",
+		MetadataToAttribute: func(metadataKey string) string {
+			if metadataKey == "internal" {
+				return ""
+			}
+			return "x-" + metadataKey
+		},
+		AttributeToMetadata: func(attributeKey string) string {
+			return strings.TrimPrefix(attributeKey, "x-")
+		},
+	}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("foo", "bar")
+	msg.Metadata.Set("internal", "value")
+
+	marshaled, err := m.Marshal("topic", msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"event_id": msg.UUID,
+		"x-foo":    "bar",
+	}, marshaled.Attributes)
+
+	unmarshaledMsg, err := m.Unmarshal(marshaled)
+	require.NoError(t, err)
+
+	assert.Equal(t, msg.UUID, unmarshaledMsg.UUID)
+	assert.Equal(t, "bar", unmarshaledMsg.Metadata.Get("foo"))
+	assert.NotContains(t, unmarshaledMsg.Metadata, "x-foo")
+	assert.NotContains(t, unmarshaledMsg.Metadata, "event_id")
+}
+
+func TestDefaultMarshalerUnmarshaler_custom_uuid_attribute_reserved(t *testing.T) {
+	m := googlecloud.DefaultMarshalerUnmarshaler{UUIDAttributeKey: "event_id"}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("event_id", "other")
+
+	_, err := m.Marshal("topic", msg)
+	assert.Error(t, err)
+}
+
+func TestDefaultMarshalerUnmarshaler_ordering_key_from_uuid(t *testing.T) {
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("tenant", "tenant_1")
+	msg.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+
+	marshaled, err := googlecloud.DefaultMarshalerUnmarshaler{OrderingKeyFromUUID: true}.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, marshaled.OrderingKey)
+
+	marshaled, err = googlecloud.DefaultMarshalerUnmarshaler{OrderingKeyFromMetadata: "tenant"}.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, "tenant_1", marshaled.OrderingKey)
+
+	marshaled, err = googlecloud.DefaultMarshalerUnmarshaler{}.Marshal("topic", msg)
+	require.NoError(t, err)
+	assert.Equal(t, "ordering_key", marshaled.OrderingKey)
+
+	_, err = googlecloud.DefaultMarshalerUnmarshaler{
+		OrderingKeyFromUUID:     true,
+		OrderingKeyFromMetadata: "tenant",
+	}.Marshal("topic", msg)
+	assert.Error(t, err)
+
+	config := googlecloud.PublisherConfig{
+		ProjectID:     "project",
+		Marshaler:     googlecloud.DefaultMarshalerUnmarshaler{OrderingKeyFromUUID: true},
+		TopicResolver: func(topic string) string { return topic },
+		Logger:        watermill.NopLogger{},
+	}
+	require.NoError(t, config.Validate())
+
+	config.OrderingKeyFn = func(msg *message.Message) string { return "key" }
+	assert.Error(t, config.Validate(), "OrderingKeyFn and OrderingKeyFromUUID are mutually exclusive")
+}
+
+func BenchmarkDefaultMarshalerUnmarshaler_Marshal(b *testing.B) {
+	for _, metadataCount := range []int{0, 1, 10, 20} {
+		b.Run(strconv.Itoa(metadataCount)+"_metadata", func(b *testing.B) {
+			m := googlecloud.DefaultMarshalerUnmarshaler{}
+
+			msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+			for i := 0; i < metadataCount; i++ {
+				msg.Metadata.Set("key_"+strconv.Itoa(i), "value")
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := m.Marshal("topic", msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
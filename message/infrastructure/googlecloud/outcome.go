@@ -0,0 +1,124 @@
+package googlecloud
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Outcome is how processing of a message ended.
+type Outcome int
+
+const (
+	// OutcomeAcked means the message was acked.
+	OutcomeAcked Outcome = iota
+	// OutcomeNacked means the message was nacked.
+	OutcomeNacked
+	// OutcomeCanceled means the context of the message was canceled before it was acked or nacked,
+	// for example because the subscriber was closed. The message is redelivered.
+	OutcomeCanceled
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeAcked:
+		return "acked"
+	case OutcomeNacked:
+		return "nacked"
+	case OutcomeCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// OutcomeFn is called with the outcome of processing a message received from the topic.
+type OutcomeFn func(topic string, msg *message.Message, outcome Outcome)
+
+// OutcomeSubscriberDecorator creates a subscriber decorator calling onOutcome once for each message
+// delivered by the subscriber, after it is acked or nacked by the handler, for example to count
+// successfully processed and failed messages.
+//
+// Messages are only observed, so the delivery isn't affected.
+// The outcome is known once the context of the message is done at the latest, as it is with `Subscriber`.
+// Close of the decorated subscriber waits for the outstanding outcomes.
+func OutcomeSubscriberDecorator(onOutcome OutcomeFn) message.SubscriberDecorator {
+	if onOutcome == nil {
+		panic("onOutcome function is nil")
+	}
+	return func(sub message.Subscriber) (message.Subscriber, error) {
+		return &outcomeSubscriberDecorator{
+			sub:       sub,
+			onOutcome: onOutcome,
+		}, nil
+	}
+}
+
+type outcomeSubscriberDecorator struct {
+	sub message.Subscriber
+
+	onOutcome OutcomeFn
+	wg        sync.WaitGroup
+}
+
+func (d *outcomeSubscriberDecorator) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	in, err := d.sub.Subscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *message.Message)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(out)
+
+		for msg := range in {
+			// Context copies the message, so it's not called concurrently with Ack or Nack
+			msgCtx := msg.Context()
+
+			d.wg.Add(1)
+			go func(msg *message.Message) {
+				defer d.wg.Done()
+				d.onOutcome(topic, msg, waitForOutcome(msgCtx, msg))
+			}(msg)
+
+			select {
+			case out <- msg:
+			case <-msgCtx.Done():
+				// not consumed, the subscriber nacks the message
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// waitForOutcome blocks until the message is acked or nacked, or ctx of the message is done.
+func waitForOutcome(ctx context.Context, msg *message.Message) Outcome {
+	select {
+	case <-msg.Acked():
+		return OutcomeAcked
+	case <-msg.Nacked():
+		return OutcomeNacked
+	case <-ctx.Done():
+	}
+
+	// the context may be canceled right after the message is acked or nacked
+	select {
+	case <-msg.Acked():
+		return OutcomeAcked
+	case <-msg.Nacked():
+		return OutcomeNacked
+	default:
+		return OutcomeCanceled
+	}
+}
+
+func (d *outcomeSubscriberDecorator) Close() error {
+	err := d.sub.Close()
+
+	d.wg.Wait()
+	return err
+}
@@ -0,0 +1,35 @@
+package googlecloud
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// pingTopic is the topic whose existence is checked by Ping.
+const pingTopic = "watermill-ping"
+
+// Ping checks if Pub/Sub can be reached, for example for readiness probes,
+// by checking if the "watermill-ping" topic exists (it doesn't have to). It returns when ctx is done at the latest.
+func (p *Publisher) Ping(ctx context.Context) error {
+	return ping(ctx, pubsubClient{p.client}.TopicExists)
+}
+
+// Ping checks if Pub/Sub can be reached, for example for readiness probes,
+// by checking if the "watermill-ping" topic exists (it doesn't have to). It returns when ctx is done at the latest.
+func (s *Subscriber) Ping(ctx context.Context) error {
+	return ping(ctx, s.client.TopicExists)
+}
+
+func ping(ctx context.Context, topicExists func(ctx context.Context, topic string) (bool, error)) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "ping failed")
+	}
+
+	// the topic doesn't have to exist, the existence check is the cheapest call reaching Pub/Sub
+	if _, err := topicExists(ctx, pingTopic); err != nil {
+		return errors.Wrap(err, "ping failed")
+	}
+
+	return nil
+}
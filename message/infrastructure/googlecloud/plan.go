@@ -0,0 +1,195 @@
+package googlecloud
+
+import (
+	"context"
+	"reflect"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+)
+
+// PlanAction is what `Subscriber` would do with a topic or a subscription when subscribing.
+type PlanAction string
+
+const (
+	// PlanCreate means the resource doesn't exist and would be created.
+	PlanCreate PlanAction = "create"
+	// PlanUpdate means the subscription exists and its properties would be updated,
+	// as UpdateSubscriptionIfExists is set.
+	PlanUpdate PlanAction = "update"
+	// PlanExists means the resource exists and would be used without changes.
+	PlanExists PlanAction = "exists"
+	// PlanMissing means the resource doesn't exist and creating it is forbidden by the config,
+	// so subscribing would fail.
+	PlanMissing PlanAction = "missing"
+)
+
+// PlannedResourceType is the type of the resource of a PlanStep.
+type PlannedResourceType string
+
+const (
+	PlannedTopic        PlannedResourceType = "topic"
+	PlannedSubscription PlannedResourceType = "subscription"
+)
+
+// PlanStep is the action `Subscriber` would take with a topic or a subscription.
+type PlanStep struct {
+	Type   PlannedResourceType
+	Name   string
+	Action PlanAction
+
+	// Update contains the properties which would be updated, for subscriptions with PlanUpdate.
+	Update pubsub.SubscriptionConfigToUpdate
+}
+
+// Plan reports which topics and subscriptions `Subscriber` would create or update when subscribing to the topics,
+// without creating or updating anything, for example to review the changes before a deploy.
+//
+// The steps are returned in the order the resources would be obtained, each resource is reported once.
+// Topics are not checked for existing subscriptions, as they are not needed to subscribe.
+// Like Subscribe, Plan fails if an existing subscription is attached to another topic or has another filter.
+func (s *Subscriber) Plan(ctx context.Context, topics ...string) ([]PlanStep, error) {
+	var steps []PlanStep
+	planned := map[PlannedResourceType]map[string]struct{}{
+		PlannedTopic:        {},
+		PlannedSubscription: {},
+	}
+
+	addStep := func(step PlanStep) {
+		if _, ok := planned[step.Type][step.Name]; ok {
+			return
+		}
+		planned[step.Type][step.Name] = struct{}{}
+		steps = append(steps, step)
+	}
+
+	for _, topic := range topics {
+		topicSteps, err := s.planSubscription(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+		for _, step := range topicSteps {
+			addStep(step)
+		}
+	}
+
+	return steps, nil
+}
+
+func (s *Subscriber) planSubscription(ctx context.Context, topic string) ([]PlanStep, error) {
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+	sub := s.client.Subscription(subscriptionName)
+
+	exists, err := s.client.SubscriptionExists(ctx, subscriptionName)
+	if err != nil {
+		return nil, existsError(err, "subscription", subscriptionName)
+	}
+
+	if exists {
+		var steps []PlanStep
+		// the dead letter topic is obtained when updating the subscription
+		if s.config.UpdateSubscriptionIfExists && s.config.DeadLetterPolicy != nil {
+			deadLetterTopicStep, err := s.planDeadLetterTopic(ctx)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, deadLetterTopicStep)
+		}
+
+		step, err := s.planExistingSubscription(ctx, sub, topic)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot plan subscription %s", subscriptionName)
+		}
+		return append(steps, step), nil
+	}
+
+	if s.config.DoNotCreateSubscriptionIfMissing {
+		return []PlanStep{{Type: PlannedSubscription, Name: subscriptionName, Action: PlanMissing}}, nil
+	}
+
+	topicStep, err := s.planTopic(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	steps := []PlanStep{topicStep}
+
+	if s.config.DeadLetterPolicy != nil {
+		deadLetterTopicStep, err := s.planDeadLetterTopic(ctx)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, deadLetterTopicStep)
+	}
+
+	subscriptionAction := PlanCreate
+	for _, step := range steps {
+		if step.Action == PlanMissing {
+			// the subscription can't be created without its topics
+			subscriptionAction = PlanMissing
+		}
+	}
+
+	return append(steps, PlanStep{Type: PlannedSubscription, Name: subscriptionName, Action: subscriptionAction}), nil
+}
+
+func (s *Subscriber) planExistingSubscription(
+	ctx context.Context,
+	sub *pubsub.Subscription,
+	topic string,
+) (PlanStep, error) {
+	step := PlanStep{Type: PlannedSubscription, Name: sub.ID(), Action: PlanExists}
+
+	config, err := sub.Config(ctx)
+	if err != nil {
+		return PlanStep{}, errors.Wrap(err, "could not fetch config for existing subscription")
+	}
+
+	if err := s.checkExistingSubscription(config, topic); err != nil {
+		return PlanStep{}, err
+	}
+
+	if !s.config.UpdateSubscriptionIfExists {
+		return step, nil
+	}
+
+	// the dead letter topic is not obtained, as it would be created if missing
+	var deadLetterTopic *pubsub.Topic
+	if s.config.DeadLetterPolicy != nil {
+		deadLetterTopic = s.client.Topic(s.config.DeadLetterPolicy.DeadLetterTopic)
+	}
+
+	expected := s.subscriptionConfigWithDeadLetterTopic(ctx, config.Topic, deadLetterTopic)
+	if update := s.subscriptionUpdate(config, expected); !reflect.DeepEqual(update, pubsub.SubscriptionConfigToUpdate{}) {
+		step.Action = PlanUpdate
+		step.Update = update
+	}
+
+	return step, nil
+}
+
+func (s *Subscriber) planDeadLetterTopic(ctx context.Context) (PlanStep, error) {
+	step, err := s.planTopic(ctx, s.config.DeadLetterPolicy.DeadLetterTopic)
+	if err != nil {
+		return PlanStep{}, errors.Wrap(err, "could not plan dead letter topic")
+	}
+
+	return step, nil
+}
+
+func (s *Subscriber) planTopic(ctx context.Context, topicName string) (PlanStep, error) {
+	step := PlanStep{Type: PlannedTopic, Name: topicName, Action: PlanExists}
+
+	exists, err := s.client.TopicExists(ctx, topicName)
+	if err != nil {
+		return PlanStep{}, existsError(err, "topic", topicName)
+	}
+
+	if !exists {
+		step.Action = PlanMissing
+		if s.config.CreateTopicIfMissing {
+			step.Action = PlanCreate
+		}
+	}
+
+	return step, nil
+}
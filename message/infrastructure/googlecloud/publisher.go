@@ -2,12 +2,19 @@ package googlecloud
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
 
+	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 )
 
@@ -16,51 +23,269 @@ var (
 	ErrPublisherClosed = errors.New("publisher is closed")
 	// ErrTopicDoesNotExist happens when trying to publish or subscribe to a topic that doesn't exist.
 	ErrTopicDoesNotExist = errors.New("topic does not exist")
+	// ErrMessageTooLarge happens when trying to publish a message larger than `MaxMessageSize`.
+	// The returned error is a `MessageTooLargeError` with the size of the message.
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrPermissionDenied happens when the credentials don't allow checking if a topic or subscription exists.
+	// It's not retried, as it's caused by missing IAM roles rather than a transient condition.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrTooManyAttributes happens when trying to publish a message with more than `MaxAttributes` attributes.
+	ErrTooManyAttributes = errors.New("too many attributes")
+	// ErrAttributeTooLong happens when trying to publish a message with an attribute key longer than
+	// `MaxAttributeKeyLength` or value longer than `MaxAttributeValueLength`.
+	// The returned error is an `AttributeTooLongError` with the offending key.
+	ErrAttributeTooLong = errors.New("attribute too long")
 )
 
+// MaxMessageSize is the maximum size of a Pub/Sub message in bytes, including the attributes and the ordering key.
+const MaxMessageSize = 10 * 1000 * 1000
+
+// MessageTooLargeError is returned by Publish when the marshaled message is larger than `MaxMessageSize`.
+// It unwraps to `ErrMessageTooLarge`.
+type MessageTooLargeError struct {
+	UUID    string
+	Size    int
+	MaxSize int
+}
+
+func (e MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message %s has %d bytes, the maximum is %d bytes", e.UUID, e.Size, e.MaxSize)
+}
+
+func (e MessageTooLargeError) Unwrap() error {
+	return ErrMessageTooLarge
+}
+
+const (
+	// MaxAttributes is the maximum number of attributes of a Pub/Sub message.
+	MaxAttributes = 100
+	// MaxAttributeKeyLength is the maximum length of a Pub/Sub attribute key in bytes.
+	MaxAttributeKeyLength = 256
+	// MaxAttributeValueLength is the maximum length of a Pub/Sub attribute value in bytes.
+	MaxAttributeValueLength = 1024
+)
+
+// AttributeTooLongError is returned by Publish when a key or value of the marshaled message attributes
+// is longer than `MaxAttributeKeyLength` or `MaxAttributeValueLength`.
+// It unwraps to `ErrAttributeTooLong`.
+type AttributeTooLongError struct {
+	UUID      string
+	Key       string
+	Length    int
+	MaxLength int
+	// Value is true when the value of the attribute is too long, and false when the key is.
+	Value bool
+}
+
+func (e AttributeTooLongError) Error() string {
+	part := "key"
+	if e.Value {
+		part = "value"
+	}
+	return fmt.Sprintf(
+		"message %s has attribute %s with %s of %d bytes, the maximum is %d bytes",
+		e.UUID, e.Key, part, e.Length, e.MaxLength,
+	)
+}
+
+func (e AttributeTooLongError) Unwrap() error {
+	return ErrAttributeTooLong
+}
+
 type Publisher struct {
 	ctx context.Context
 
-	topics     map[string]*pubsub.Topic
+	topics map[string]*cachedTopic
+	// creatingTopics are closed once the topics are created and cached, or creating them failed
+	creatingTopics map[string]chan struct{}
+	// topicUses counts the uses of the cached topics, to find the least recently used one
+	topicUses  atomic.Uint64
 	topicsLock sync.RWMutex
+
+	// inFlight are the results of messages being published, with their UUIDs
+	inFlight     map[*pubsub.PublishResult]string
+	inFlightLock sync.Mutex
+	// publishing counts the messages passed to the client library, which may block on flow control,
+	// before their results are added to inFlight
+	publishing sync.WaitGroup
+
 	closed     bool
+	closedLock sync.Mutex
+	// closeFinished is closed when Close is finished, with the result in closeErr
+	closeFinished chan struct{}
+	closeErr      error
 
 	client *pubsub.Client
-	config PublisherConfig
+	// ownsClient is true if the client was created by `Publisher`, so it's closed on Close
+	ownsClient bool
+	config     PublisherConfig
 }
 
 type PublisherConfig struct {
 	// ProjectID is the Google Cloud Engine project ID.
+	// It is required, unless the emulator is used (see DisableEmulatorAutodetect), which accepts any project ID.
 	ProjectID string
 
 	// If false (default), `Publisher` tries to create a topic if there is none with the requested name.
 	// Otherwise, trying to subscribe to non-existent subscription results in `ErrTopicDoesNotExist`.
 	DoNotCreateTopicIfMissing bool
 
-	// Settings for cloud.google.com/go/pubsub client library.
+	// KMSKeyName, when set, is the Cloud KMS key used to encrypt messages of topics created by `Publisher`,
+	// in the form projects/*/locations/*/keyRings/*/cryptoKeys/*.
+	// The key of an existing topic can't be changed, a different key is only logged.
+	KMSKeyName string
+
+	// TopicResolver transforms the topic passed to Publish into the name of the Pub/Sub topic the messages are
+	// published to, for example to prefix topics with the environment name. Defaults to `TopicName`.
+	TopicResolver TopicNameFn
+
+	// If true, messages with the same ordering key are published in order.
+	// The ordering key is taken from the message metadata under `OrderingKeyMetadataKey`.
+	// If false, the ordering key is dropped, for example from messages forwarded from an ordered subscription.
+	//
+	// When publishing a message with an ordering key fails, publishing with that key is resumed,
+	// so the next messages with the key can be published again.
+	EnableMessageOrdering bool
+
+	// OrderingKeyFn, when set, returns the ordering key of the message, taking precedence over the one set by
+	// the Marshaler, for example to derive it from a partition key in the metadata of the message.
+	// It has effect only with EnableMessageOrdering.
+	// It can't be set together with OrderingKeyFromUUID or OrderingKeyFromMetadata of DefaultMarshalerUnmarshaler.
+	OrderingKeyFn OrderingKeyFn
+
+	// PublishSettings are applied to every topic before publishing to it, for example to tune batching
+	// with DelayThreshold, CountThreshold and ByteThreshold.
+	// To bound the memory used by bursts of messages, set FlowControlSettings with
+	// LimitExceededBehavior set to pubsub.FlowControlBlock, so Publish blocks until outstanding messages are published.
+	// Nil means the defaults of cloud.google.com/go/pubsub client library.
 	PublishSettings *pubsub.PublishSettings
-	ClientOptions   []option.ClientOption
+
+	// If false (default) and the PUBSUB_EMULATOR_HOST environment variable is set, the client connects
+	// to the emulator at that address without authentication, unless ClientOptions contain an endpoint.
+	// Otherwise, PUBSUB_EMULATOR_HOST is ignored.
+	DisableEmulatorAutodetect bool
+
+	// MaxCachedTopics is the maximum number of topics kept by `Publisher` for publishing.
+	// Each topic runs its own goroutines, so for many short-lived topics the least recently used ones
+	// are evicted and stopped once the limit is exceeded, after the messages being published to them are sent.
+	// If 0 (default), topics are cached until Close.
+	MaxCachedTopics int
+
+	// OnTopicCreated, when set, is called with the name of each topic created by `Publisher`,
+	// for example to audit provisioning. It's not called for topics which already exist.
+	OnTopicCreated func(topic string)
+
+	// GRPCConnectionPoolSize is the number of gRPC connections to Pub/Sub, for example to avoid saturating
+	// a single connection under high throughput.
+	// If 0 (default), the client library opens as many connections as there are CPUs, up to 4.
+	// A single connection is used with the emulator.
+	GRPCConnectionPoolSize int
+
+	// GRPCKeepalive, when set, makes the client ping idle gRPC connections, so connections dropped silently,
+	// for example by NAT after a timeout, are detected and reestablished.
+	// Time below 10 seconds is raised to 10 seconds by gRPC.
+	// If nil (default), the client library pings connections idle for 5 minutes.
+	GRPCKeepalive *keepalive.ClientParameters
+
+	// GRPCDialOptions are used when connecting to Pub/Sub, for example to add interceptors.
+	GRPCDialOptions []grpc.DialOption
+
+	// ClientOptions are passed to the cloud.google.com/go/pubsub client.
+	// They are applied after GRPCConnectionPoolSize, GRPCKeepalive and GRPCDialOptions, so they take precedence.
+	ClientOptions []option.ClientOption
 
 	Marshaler Marshaler
+
+	// Logger is used to log warnings, for example about existing topics that differ from the config.
+	// Defaults to watermill.NopLogger.
+	Logger watermill.LoggerAdapter
+}
+
+type TopicNameFn func(topic string) string
+
+// OrderingKeyFn returns the Pub/Sub ordering key of the message.
+type OrderingKeyFn func(msg *message.Message) string
+
+// TopicName uses the topic passed to Publish as the Pub/Sub topic name.
+func TopicName(topic string) string {
+	return topic
+}
+
+// TopicNameWithPrefix uses the topic passed to Publish with a chosen prefix as the Pub/Sub topic name.
+func TopicNameWithPrefix(prefix string) TopicNameFn {
+	return func(topic string) string {
+		return prefix + topic
+	}
 }
 
 func (c *PublisherConfig) setDefaults() {
+	if c.ProjectID == "" && emulatorConfigured(c.DisableEmulatorAutodetect) {
+		c.ProjectID = emulatorProjectID
+	}
 	if c.Marshaler == nil {
 		c.Marshaler = DefaultMarshalerUnmarshaler{}
 	}
+	if c.TopicResolver == nil {
+		c.TopicResolver = TopicName
+	}
+	if c.Logger == nil {
+		c.Logger = watermill.NopLogger{}
+	}
+}
+
+func (c PublisherConfig) Validate() error {
+	if c.ProjectID == "" {
+		return errors.New("missing ProjectID")
+	}
+	if c.Marshaler == nil {
+		return errors.New("missing Marshaler")
+	}
+	if c.TopicResolver == nil {
+		return errors.New("missing TopicResolver")
+	}
+	if c.Logger == nil {
+		return errors.New("missing Logger")
+	}
+	if c.GRPCConnectionPoolSize < 0 {
+		return errors.Errorf("GRPCConnectionPoolSize must not be negative, got %d", c.GRPCConnectionPoolSize)
+	}
+	if c.MaxCachedTopics < 0 {
+		return errors.Errorf("MaxCachedTopics must not be negative, got %d", c.MaxCachedTopics)
+	}
+	if m, ok := c.Marshaler.(interface{ setsOrderingKey() bool }); ok && m.setsOrderingKey() && c.OrderingKeyFn != nil {
+		return errors.New("OrderingKeyFn can't be set together with a Marshaler setting the ordering key")
+	}
+
+	return nil
 }
 
 func NewPublisher(ctx context.Context, config PublisherConfig) (*Publisher, error) {
 	config.setDefaults()
 
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	pub := &Publisher{
-		ctx:    ctx,
-		topics: map[string]*pubsub.Topic{},
-		config: config,
+		ctx:            ctx,
+		topics:         map[string]*cachedTopic{},
+		creatingTopics: map[string]chan struct{}{},
+		inFlight:       map[*pubsub.PublishResult]string{},
+		closeFinished:  make(chan struct{}),
+		ownsClient:     true,
+		config:         config,
 	}
 
-	var err error
-	pub.client, err = pubsub.NewClient(ctx, config.ProjectID, config.ClientOptions...)
+	clientOpts := append(
+		grpcClientOptions(config.GRPCConnectionPoolSize, config.GRPCKeepalive, config.GRPCDialOptions),
+		config.ClientOptions...,
+	)
+	clientOpts, err := clientOptions(ctx, clientOpts, config.DisableEmulatorAutodetect)
+	if err != nil {
+		return nil, err
+	}
+
+	pub.client, err = pubsub.NewClient(ctx, config.ProjectID, clientOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -68,101 +293,513 @@ func NewPublisher(ctx context.Context, config PublisherConfig) (*Publisher, erro
 	return pub, nil
 }
 
+// NewPublisherWithClient creates a Publisher using a client created by the caller, for example shared with
+// other components or connected to an in-memory fake server (see cloud.google.com/go/pubsub/pstest) in tests.
+// ProjectID defaults to the project of the client, and ClientOptions and DisableEmulatorAutodetect are ignored.
+//
+// The client is not closed by Close, it's the responsibility of the caller.
+func NewPublisherWithClient(ctx context.Context, client *pubsub.Client, config PublisherConfig) (*Publisher, error) {
+	if client == nil {
+		return nil, errors.New("missing client")
+	}
+	if config.ProjectID == "" {
+		config.ProjectID = client.Project()
+	}
+	config.setDefaults()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Publisher{
+		ctx:            ctx,
+		topics:         map[string]*cachedTopic{},
+		creatingTopics: map[string]chan struct{}{},
+		inFlight:       map[*pubsub.PublishResult]string{},
+		closeFinished:  make(chan struct{}),
+		client:         client,
+		config:         config,
+	}, nil
+}
+
 // Publish publishes a set of messages on a Google Cloud Pub/Sub topic.
 // It blocks until all the messages are successfully published or an error occurred.
+// Each message is confirmed by Pub/Sub before the next one is published, so publish errors are returned
+// directly and the messages after the failed one are not published.
 //
 // To receive messages published to a topic, you must create a subscription to that topic.
 // Only messages published to the topic after the subscription is created are available to subscriber applications.
 //
+// The `topic` argument is transformed into the Pub/Sub topic name with the configured `TopicResolver` function.
+//
 // See https://cloud.google.com/pubsub/docs/publisher to find out more about how Google Cloud Pub/Sub Publishers work.
 func (p *Publisher) Publish(topic string, messages ...*message.Message) error {
-	if p.closed {
-		return ErrPublisherClosed
-	}
+	_, err := p.PublishWithResults(topic, messages...)
+	return err
+}
 
-	ctx := p.ctx
+// PublishWithContext publishes messages like Publish, but waits for each message to be confirmed by Pub/Sub
+// only until ctx is done, regardless of PublishSettings.Timeout, for example to publish some messages
+// with a tighter deadline. ctx is also used to obtain the topic.
+//
+// When ctx is done, the returned error wraps ctx.Err() and the remaining messages are not published.
+// The message which wasn't confirmed in time may still be published.
+func (p *Publisher) PublishWithContext(ctx context.Context, topic string, messages ...*message.Message) error {
+	_, err := p.publish(ctx, topic, messages)
+	return err
+}
+
+// PublishWithResults publishes messages like Publish and returns the IDs assigned to them by Pub/Sub,
+// in the order of messages, for example for idempotency tracking.
+// If publishing fails, the IDs of the messages published before are returned along with the error.
+func (p *Publisher) PublishWithResults(topic string, messages ...*message.Message) ([]string, error) {
+	return p.publish(p.ctx, topic, messages)
+}
 
-	t, err := p.topic(ctx, topic)
+func (p *Publisher) publish(ctx context.Context, topic string, messages []*message.Message) ([]string, error) {
+	if p.isClosed() {
+		return nil, ErrPublisherClosed
+	}
+
+	t, release, err := p.topic(ctx, p.config.TopicResolver(topic))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer release()
+
+	ids := make([]string, 0, len(messages))
 
 	for _, msg := range messages {
 		googlecloudMsg, err := p.config.Marshaler.Marshal(topic, msg)
 		if err != nil {
-			return errors.Wrapf(err, "cannot marshal message %s", msg.UUID)
+			return ids, errors.Wrapf(err, "cannot marshal message %s", msg.UUID)
+		}
+		if p.config.OrderingKeyFn != nil {
+			googlecloudMsg.OrderingKey = p.config.OrderingKeyFn(msg)
+		}
+		if !p.config.EnableMessageOrdering {
+			// the client library rejects messages with ordering key on topics without message ordering
+			googlecloudMsg.OrderingKey = ""
+		}
+		if size := messageSize(googlecloudMsg); size > MaxMessageSize {
+			return ids, MessageTooLargeError{UUID: msg.UUID, Size: size, MaxSize: MaxMessageSize}
+		}
+		if err := validateAttributes(msg.UUID, googlecloudMsg.Attributes); err != nil {
+			return ids, err
 		}
 
-		result := t.Publish(ctx, googlecloudMsg)
-		<-result.Ready()
+		if err := ctx.Err(); err != nil {
+			return ids, errors.Wrapf(err, "message %s not published", msg.UUID)
+		}
 
-		_, err = result.Get(ctx)
+		result, ok := p.publishInFlight(ctx, t, googlecloudMsg, msg.UUID)
+		if !ok {
+			return ids, ErrPublisherClosed
+		}
+		select {
+		case <-result.Ready():
+			p.removeInFlight(result)
+		case <-ctx.Done():
+			// the message may still be published, so its result is awaited in the background
+			go p.abandonResult(t, result, msg.UUID, googlecloudMsg.OrderingKey)
+			return ids, errors.Wrapf(ctx.Err(), "publishing message %s was not confirmed in time", msg.UUID)
+		}
+
+		id, err := result.Get(ctx)
 		if err != nil {
-			return errors.Wrapf(err, "publishing message %s failed", msg.UUID)
+			if googlecloudMsg.OrderingKey != "" {
+				// the client library pauses publishing with the ordering key after an error
+				t.ResumePublish(googlecloudMsg.OrderingKey)
+				return ids, errors.Wrapf(
+					err, "publishing message %s with ordering key %s failed", msg.UUID, googlecloudMsg.OrderingKey,
+				)
+			}
+			return ids, errors.Wrapf(err, "publishing message %s failed", msg.UUID)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// messageSize returns the size of the message as counted against `MaxMessageSize`.
+func messageSize(msg *pubsub.Message) int {
+	size := len(msg.Data) + len(msg.OrderingKey)
+	for k, v := range msg.Attributes {
+		size += len(k) + len(v)
+	}
+
+	return size
+}
+
+// validateAttributes checks the attributes against the Pub/Sub limits, which would make the publish rejected.
+func validateAttributes(uuid string, attributes map[string]string) error {
+	if len(attributes) > MaxAttributes {
+		return errors.Wrapf(
+			ErrTooManyAttributes,
+			"message %s has %d attributes, the maximum is %d", uuid, len(attributes), MaxAttributes,
+		)
+	}
+
+	for k, v := range attributes {
+		if len(k) > MaxAttributeKeyLength {
+			return AttributeTooLongError{UUID: uuid, Key: k, Length: len(k), MaxLength: MaxAttributeKeyLength}
+		}
+		if len(v) > MaxAttributeValueLength {
+			return AttributeTooLongError{UUID: uuid, Key: k, Length: len(v), MaxLength: MaxAttributeValueLength, Value: true}
 		}
 	}
 
 	return nil
 }
 
+// TopicExists checks if the topic exists, without creating it, regardless of DoNotCreateTopicIfMissing.
+// The topic name is resolved with the configured `TopicResolver` function.
+func (p *Publisher) TopicExists(ctx context.Context, topic string) (bool, error) {
+	topicName := p.config.TopicResolver(topic)
+
+	exists, err := p.client.Topic(topicName).Exists(ctx)
+	if err != nil {
+		return false, existsError(err, "topic", topicName)
+	}
+
+	return exists, nil
+}
+
 // Close notifies the Publisher to stop processing messages, send all the remaining messages and close the connection.
+// Errors of publishing the messages which were still being published are returned aggregated,
+// along with the error of closing the connection.
+//
+// Close is safe to call multiple times and concurrently, the subsequent calls wait for the first one to finish
+// and return the same error.
 func (p *Publisher) Close() error {
+	p.closedLock.Lock()
 	if p.closed {
-		return nil
+		p.closedLock.Unlock()
+		<-p.closeFinished
+		return p.closeErr
 	}
-
 	p.closed = true
+	p.closedLock.Unlock()
+
+	p.closeErr = p.close()
+	close(p.closeFinished)
+
+	return p.closeErr
+}
+
+func (p *Publisher) isClosed() bool {
+	p.closedLock.Lock()
+	defer p.closedLock.Unlock()
+
+	return p.closed
+}
 
+func (p *Publisher) close() error {
+	// messages are counted in publishing with inFlightLock held once they're checked to not be closed,
+	// so no message is published after they are waited for and the in-flight messages are collected
+	p.inFlightLock.Lock()
+	p.inFlightLock.Unlock()
+	p.publishing.Wait()
+
+	p.inFlightLock.Lock()
+	inFlight := make(map[*pubsub.PublishResult]string, len(p.inFlight))
+	for result, uuid := range p.inFlight {
+		inFlight[result] = uuid
+	}
+	p.inFlightLock.Unlock()
+
+	// stopping the topics publishes the messages waiting in their batches
 	p.topicsLock.Lock()
-	for _, t := range p.topics {
-		t.Stop()
+	for _, cached := range p.topics {
+		cached.topic.Stop()
 	}
 	p.topicsLock.Unlock()
 
-	return p.client.Close()
+	var err error
+	for result, uuid := range inFlight {
+		if _, publishErr := result.Get(context.Background()); publishErr != nil {
+			err = multierror.Append(err, errors.Wrapf(publishErr, "publishing message %s failed", uuid))
+		}
+	}
+
+	if p.ownsClient {
+		if closeErr := p.client.Close(); closeErr != nil {
+			err = multierror.Append(err, closeErr)
+		}
+	}
+
+	return err
 }
 
-func (p *Publisher) topic(ctx context.Context, topic string) (t *pubsub.Topic, err error) {
-	p.topicsLock.RLock()
-	t, ok := p.topics[topic]
-	p.topicsLock.RUnlock()
-	if ok {
-		return t, nil
+// publishInFlight publishes the message on the topic and registers its result as in-flight,
+// so Close waits for it. It returns false without publishing if the publisher is closed.
+//
+// inFlightLock isn't held while publishing, as publishing blocks when flow control limits are exceeded,
+// which would block other topics and Close as well.
+func (p *Publisher) publishInFlight(
+	ctx context.Context,
+	t *pubsub.Topic,
+	msg *pubsub.Message,
+	uuid string,
+) (*pubsub.PublishResult, bool) {
+	p.inFlightLock.Lock()
+	if p.isClosed() {
+		p.inFlightLock.Unlock()
+		return nil, false
 	}
+	p.publishing.Add(1)
+	p.inFlightLock.Unlock()
+
+	defer p.publishing.Done()
+
+	result := t.Publish(ctx, msg)
+
+	p.inFlightLock.Lock()
+	p.inFlight[result] = uuid
+	p.inFlightLock.Unlock()
+
+	return result, true
+}
+
+// abandonResult waits for the result of a message which the publishing call stopped waiting for.
+// If Close is called before the result is ready, Close waits for it and returns its error as well.
+func (p *Publisher) abandonResult(t *pubsub.Topic, result *pubsub.PublishResult, uuid string, orderingKey string) {
+	<-result.Ready()
+	p.removeInFlight(result)
+
+	_, err := result.Get(context.Background())
+	if err == nil {
+		return
+	}
+
+	p.config.Logger.Info("Publishing message not confirmed in time failed", watermill.LogFields{
+		"message_uuid": uuid,
+		"err":          err,
+	})
+	if orderingKey != "" {
+		// the client library pauses publishing with the ordering key after an error
+		t.ResumePublish(orderingKey)
+	}
+}
+
+func (p *Publisher) removeInFlight(result *pubsub.PublishResult) {
+	p.inFlightLock.Lock()
+	defer p.inFlightLock.Unlock()
+
+	delete(p.inFlight, result)
+}
+
+// cachedTopic is a topic kept by `Publisher` for publishing.
+type cachedTopic struct {
+	name  string
+	topic *pubsub.Topic
+
+	// lastUse is the value of topicUses when the topic was last used
+	lastUse atomic.Uint64
+	// users is the number of publishes using the topic, an evicted topic is stopped once there are none
+	users atomic.Int64
+	// evicted is guarded by topicsLock
+	evicted bool
+}
+
+// topic returns the topic, created if missing, from the cache of topics.
+// release must be called once the topic is not used anymore, so it can be stopped when evicted.
+//
+// Cached topics are used with topicsLock read-locked, and missing topics are created without holding it,
+// so publishing to the cached topics isn't blocked by creating other topics.
+func (p *Publisher) topic(ctx context.Context, topic string) (t *pubsub.Topic, release func(), err error) {
+	for {
+		p.topicsLock.RLock()
+		cached, ok := p.topics[topic]
+		if ok {
+			p.useTopic(cached)
+		}
+		p.topicsLock.RUnlock()
+		if ok {
+			return cached.topic, func() { p.releaseTopic(cached) }, nil
+		}
+
+		p.topicsLock.Lock()
+		if _, ok := p.topics[topic]; ok {
+			// cached in the meantime
+			p.topicsLock.Unlock()
+			continue
+		}
+		if creating, ok := p.creatingTopics[topic]; ok {
+			p.topicsLock.Unlock()
+
+			// created by another publish, if it fails the topic is created again
+			select {
+			case <-creating:
+				continue
+			case <-ctx.Done():
+				return nil, nil, errors.Wrapf(ctx.Err(), "topic %s not created in time", topic)
+			}
+		}
+		creating := make(chan struct{})
+		p.creatingTopics[topic] = creating
+		p.topicsLock.Unlock()
+
+		cached, err := p.createCachedTopic(ctx, topic, creating)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return cached.topic, func() { p.releaseTopic(cached) }, nil
+	}
+}
+
+// createCachedTopic creates the topic and adds it to the cache, used by the caller.
+// creating is closed once it's done.
+func (p *Publisher) createCachedTopic(ctx context.Context, topic string, creating chan struct{}) (*cachedTopic, error) {
+	t, err := p.createTopic(ctx, topic)
 
 	p.topicsLock.Lock()
-	defer func() {
+	delete(p.creatingTopics, topic)
+	close(creating)
+	if err != nil {
 		p.topicsLock.Unlock()
-		if err == nil {
-			p.topics[topic] = t
+		return nil, err
+	}
+
+	cached := &cachedTopic{name: topic, topic: t}
+	p.useTopic(cached)
+	p.topics[topic] = cached
+
+	evicted := p.evictTopics()
+	p.topicsLock.Unlock()
+
+	for _, t := range evicted {
+		t.Stop()
+	}
+
+	return cached, nil
+}
+
+// useTopic marks the topic as used by a publish, until it's released with releaseTopic.
+// It must be called with topicsLock held, at least for reading.
+func (p *Publisher) useTopic(cached *cachedTopic) {
+	cached.users.Add(1)
+	cached.lastUse.Store(p.topicUses.Add(1))
+}
+
+// evictTopics removes the least recently used topics from the cache above MaxCachedTopics,
+// and returns the ones which are not used anymore, to be stopped.
+// It must be called with topicsLock held.
+func (p *Publisher) evictTopics() []*pubsub.Topic {
+	if p.config.MaxCachedTopics == 0 {
+		return nil
+	}
+
+	var unused []*pubsub.Topic
+	for len(p.topics) > p.config.MaxCachedTopics {
+		var leastRecentlyUsed *cachedTopic
+		for _, cached := range p.topics {
+			if leastRecentlyUsed == nil || cached.lastUse.Load() < leastRecentlyUsed.lastUse.Load() {
+				leastRecentlyUsed = cached
+			}
 		}
-	}()
 
-	t = p.client.Topic(topic)
+		delete(p.topics, leastRecentlyUsed.name)
+		leastRecentlyUsed.evicted = true
 
-	// todo: theoretically, one could want different publish settings per topic, which is supported by the client lib
-	// different instances of publisher may be used then
-	if p.config.PublishSettings != nil {
-		t.PublishSettings = *p.config.PublishSettings
+		if leastRecentlyUsed.users.Load() == 0 {
+			unused = append(unused, leastRecentlyUsed.topic)
+		}
 	}
 
+	return unused
+}
+
+func (p *Publisher) releaseTopic(cached *cachedTopic) {
+	p.topicsLock.RLock()
+	// evicted doesn't change while topicsLock is read-locked, so either the topic was evicted while still used
+	// and the last user stops it, or evictTopics stops it
+	stop := cached.users.Add(-1) == 0 && cached.evicted
+	p.topicsLock.RUnlock()
+
+	if stop {
+		cached.topic.Stop()
+	}
+}
+
+func (p *Publisher) createTopic(ctx context.Context, topic string) (*pubsub.Topic, error) {
+	t := p.client.Topic(topic)
+
 	exists, err := t.Exists(ctx)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not check if topic %s exists", topic)
+		return nil, existsError(err, "topic", topic)
 	}
 
 	if exists {
-		return t, nil
+		if err := checkTopicKMSKeyName(ctx, t, p.config.KMSKeyName, p.config.Logger); err != nil {
+			return nil, err
+		}
+	} else {
+		if p.config.DoNotCreateTopicIfMissing {
+			return nil, errors.Wrap(ErrTopicDoesNotExist, topic)
+		}
+
+		t, err = p.client.CreateTopicWithConfig(ctx, topic, &pubsub.TopicConfig{KMSKeyName: p.config.KMSKeyName})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not create topic %s", topic)
+		}
+		if p.config.OnTopicCreated != nil {
+			p.config.OnTopicCreated(topic)
+		}
+	}
+
+	// todo: theoretically, one could want different publish settings per topic, which is supported by the client lib
+	// different instances of publisher may be used then
+	if p.config.PublishSettings != nil {
+		t.PublishSettings = *p.config.PublishSettings
 	}
+	t.EnableMessageOrdering = p.config.EnableMessageOrdering
+
+	return t, nil
+}
 
-	if p.config.DoNotCreateTopicIfMissing {
-		return nil, errors.Wrap(ErrTopicDoesNotExist, topic)
+// existsError wraps the error of checking if the resource exists.
+// Errors caused by missing permissions are returned as `ErrPermissionDenied` with guidance how to fix them.
+func existsError(err error, resource string, name string) error {
+	if grpc.Code(err) == codes.PermissionDenied {
+		return errors.Wrapf(
+			ErrPermissionDenied,
+			"could not check if %s %s exists, grant the roles/pubsub.viewer role to the service account, "+
+				"or roles/pubsub.editor to create it if it's missing (%s)",
+			resource,
+			name,
+			err,
+		)
 	}
 
-	t, err = p.client.CreateTopic(ctx, topic)
+	return errors.Wrapf(err, "could not check if %s %s exists", resource, name)
+}
+
+// checkTopicKMSKeyName logs a warning if the existing topic is encrypted with a different key than kmsKeyName.
+func checkTopicKMSKeyName(
+	ctx context.Context,
+	t *pubsub.Topic,
+	kmsKeyName string,
+	logger watermill.LoggerAdapter,
+) error {
+	if kmsKeyName == "" {
+		return nil
+	}
+
+	config, err := t.Config(ctx)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not create topic %s", topic)
+		return errors.Wrapf(err, "could not fetch config of topic %s", t.ID())
 	}
 
-	return t, nil
+	if config.KMSKeyName != kmsKeyName {
+		logger.Info("KMS key of existing topic differs, but it can't be changed", watermill.LogFields{
+			"topic":                 t.ID(),
+			"kms_key_name":          config.KMSKeyName,
+			"expected_kms_key_name": kmsKeyName,
+		})
+	}
+
+	return nil
 }
@@ -0,0 +1,264 @@
+package googlecloud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Run `docker-compose up` and set PUBSUB_EMULATOR_HOST=googlecloud:8085 for this to work
+
+func TestPublisher_topic_applies_publish_settings(t *testing.T) {
+	publishSettings := pubsub.PublishSettings{
+		DelayThreshold: time.Millisecond * 50,
+		CountThreshold: 10,
+		ByteThreshold:  1024,
+		Timeout:        time.Second * 30,
+		FlowControlSettings: pubsub.FlowControlSettings{
+			MaxOutstandingMessages: 100,
+			MaxOutstandingBytes:    1024 * 1024,
+			LimitExceededBehavior:  pubsub.FlowControlBlock,
+		},
+	}
+
+	p, err := NewPublisher(context.Background(), PublisherConfig{
+		ProjectID:       testProjectID,
+		PublishSettings: &publishSettings,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	topic, release, err := p.topic(context.Background(), "publish_settings_"+watermill.NewShortUUID())
+	require.NoError(t, err)
+	defer release()
+
+	assert.Equal(t, publishSettings, topic.PublishSettings)
+}
+
+func TestPublisher_max_cached_topics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const maxCachedTopics = 2
+
+	p, err := NewPublisher(ctx, PublisherConfig{
+		ProjectID:       testProjectID,
+		MaxCachedTopics: maxCachedTopics,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	var topics []*pubsub.Topic
+	for i := 0; i < 5; i++ {
+		topicName := fmt.Sprintf("max_cached_topics_%d_%s", i, watermill.NewShortUUID())
+		require.NoError(t, p.Publish(topicName, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+		topic, release, err := p.topic(ctx, topicName)
+		require.NoError(t, err)
+		release()
+		topics = append(topics, topic)
+
+		assert.LessOrEqual(t, len(p.topics), maxCachedTopics)
+	}
+
+	for i, topic := range topics {
+		_, err := topic.Publish(ctx, &pubsub.Message{Data: []byte{}}).Get(ctx)
+		if i < len(topics)-maxCachedTopics {
+			assert.Error(t, err, "evicted topic %d should be stopped", i)
+		} else {
+			assert.NoError(t, err, "cached topic %d should not be stopped", i)
+		}
+	}
+}
+
+func TestPublisher_evicted_topic_stopped_after_release(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p, err := NewPublisher(ctx, PublisherConfig{
+		ProjectID:       testProjectID,
+		MaxCachedTopics: 1,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	inUse, release, err := p.topic(ctx, "evicted_in_use_"+watermill.NewShortUUID())
+	require.NoError(t, err)
+
+	// evicts the topic in use
+	require.NoError(t, p.Publish("evicting_"+watermill.NewShortUUID(), message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	_, err = inUse.Publish(ctx, &pubsub.Message{Data: []byte{}}).Get(ctx)
+	assert.NoError(t, err, "topic in use should not be stopped")
+
+	release()
+
+	_, err = inUse.Publish(ctx, &pubsub.Message{Data: []byte{}}).Get(ctx)
+	assert.Error(t, err, "released evicted topic should be stopped")
+}
+
+func TestPublisher_topic_created_once(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var created int32
+	p, err := NewPublisher(ctx, PublisherConfig{
+		ProjectID:      testProjectID,
+		OnTopicCreated: func(topic string) { atomic.AddInt32(&created, 1) },
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	topicName := "topic_created_once_" + watermill.NewShortUUID()
+
+	const concurrency = 10
+	topics := make(chan *pubsub.Topic, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			topic, release, err := p.topic(ctx, topicName)
+			if !assert.NoError(t, err) {
+				topics <- nil
+				return
+			}
+			release()
+			topics <- topic
+		}()
+	}
+
+	first := <-topics
+	for i := 1; i < concurrency; i++ {
+		assert.Same(t, first, <-topics, "all publishes should use the same topic")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&created))
+}
+
+func TestPublisher_flow_control_blocked_publish(t *testing.T) {
+	// no emulator is needed, the client is connected to an in-memory fake server
+	defer setEmulatorHost(t, "")()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := pstest.NewServer()
+	defer srv.Close()
+
+	blockedTopic := "flow_control_blocked_" + watermill.NewShortUUID()
+	otherTopic := "flow_control_other_" + watermill.NewShortUUID()
+
+	// messages of blockedTopic are outstanding until release is closed
+	sent := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseAll()
+
+	conn, err := grpc.Dial(
+		srv.Addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(func(
+			ctx context.Context,
+			method string,
+			req, reply interface{},
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			if r, ok := req.(*pubsubpb.PublishRequest); ok && strings.HasSuffix(r.Topic, "/"+blockedTopic) {
+				select {
+				case sent <- struct{}{}:
+				default:
+				}
+				<-release
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client, err := pubsub.NewClient(ctx, testProjectID, option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	defer client.Close()
+
+	publishSettings := pubsub.DefaultPublishSettings
+	publishSettings.CountThreshold = 1
+	publishSettings.FlowControlSettings = pubsub.FlowControlSettings{
+		MaxOutstandingMessages: 1,
+		LimitExceededBehavior:  pubsub.FlowControlBlock,
+	}
+
+	p, err := NewPublisherWithClient(ctx, client, PublisherConfig{PublishSettings: &publishSettings})
+	require.NoError(t, err)
+
+	published := make(chan error, 2)
+	go func() {
+		published <- p.Publish(blockedTopic, message.NewMessage(watermill.NewUUID(), []byte("outstanding")))
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+		t.Fatal("message not sent")
+	}
+
+	go func() {
+		published <- p.Publish(blockedTopic, message.NewMessage(watermill.NewUUID(), []byte("blocked")))
+	}()
+	// let the publish block on flow control
+	time.Sleep(time.Millisecond * 100)
+
+	otherPublished := make(chan error, 1)
+	go func() {
+		otherPublished <- p.Publish(otherTopic, message.NewMessage(watermill.NewUUID(), []byte("other")))
+	}()
+	select {
+	case err := <-otherPublished:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("publishing to another topic should not wait for the blocked publish")
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- p.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		t.Fatalf("Close should wait for the blocked publish, returned %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+	assert.Equal(t, ErrPublisherClosed, p.Publish(otherTopic, message.NewMessage(watermill.NewUUID(), nil)))
+
+	releaseAll()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-published:
+			assert.NoError(t, err)
+		case <-ctx.Done():
+			t.Fatal("messages not published")
+		}
+	}
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("Close not finished")
+	}
+}
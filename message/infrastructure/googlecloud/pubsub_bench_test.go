@@ -17,11 +17,16 @@ func BenchmarkSubscriber(b *testing.B) {
 		ctx := context.Background()
 		logger := watermill.NopLogger{}
 
-		publisher, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{})
+		publisher, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+			ProjectID: testProjectID,
+		})
 
 		subscriber, err := googlecloud.NewSubscriber(
 			ctx,
-			googlecloud.SubscriberConfig{},
+			googlecloud.SubscriberConfig{
+				ProjectID:            testProjectID,
+				CreateTopicIfMissing: true,
+			},
 			logger,
 		)
 		if err != nil {
@@ -3,9 +3,17 @@
 package googlecloud_test
 
 import (
+	"context"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/ThreeDotsLabs/watermill/message/infrastructure"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/googlecloud"
 )
 
 // Run `docker-compose up` and set PUBSUB_EMULATOR_HOST=googlecloud:8085 for this to work
@@ -23,3 +31,70 @@ func TestPublishSubscribe_stress(t *testing.T) {
 		createPubSubWithSubscriptionName,
 	)
 }
+
+// TestSubscriber_Close_in_flight_stress closes the subscriber while messages are being delivered,
+// acked, nacked and processed, to be run with -race.
+func TestSubscriber_Close_in_flight_stress(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			topic := "close_in_flight_stress_" + watermill.NewShortUUID()
+
+			sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+				ProjectID:            testProjectID,
+				CreateTopicIfMissing: true,
+			}, watermill.NopLogger{})
+			require.NoError(t, err)
+
+			messages, err := sub.Subscribe(ctx, topic)
+			require.NoError(t, err)
+
+			produceMessages(t, ctx, topic, 50)
+
+			someReceived := make(chan struct{})
+			consumed := make(chan struct{})
+			go func() {
+				defer close(consumed)
+
+				received := 0
+				for msg := range messages {
+					received++
+					if received == 10 {
+						close(someReceived)
+					}
+
+					switch received % 3 {
+					case 0:
+						msg.Ack()
+					case 1:
+						msg.Nack()
+					default:
+						// still processed when closing
+						go func(msg *message.Message, delay time.Duration) {
+							time.Sleep(delay)
+							msg.Ack()
+						}(msg, time.Millisecond*time.Duration(received))
+					}
+				}
+			}()
+
+			select {
+			case <-someReceived:
+			case <-ctx.Done():
+				t.Fatal("messages not received")
+			}
+
+			require.NoError(t, sub.Close())
+
+			select {
+			case <-consumed:
+			case <-ctx.Done():
+				t.Fatal("output channel not closed")
+			}
+		})
+	}
+}
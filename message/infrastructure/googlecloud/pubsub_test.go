@@ -3,13 +3,27 @@ package googlecloud_test
 import (
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
@@ -19,11 +33,14 @@ import (
 
 // Run `docker-compose up` and set PUBSUB_EMULATOR_HOST=googlecloud:8085 for this to work
 
+const testProjectID = "tests"
+
 func newPubSub(t *testing.T, marshaler googlecloud.MarshalerUnmarshaler, subscriptionName googlecloud.SubscriptionNameFn) message.PubSub {
 	ctx := context.Background()
 	publisher, err := googlecloud.NewPublisher(
 		ctx,
 		googlecloud.PublisherConfig{
+			ProjectID: testProjectID,
 			Marshaler: marshaler,
 		},
 	)
@@ -34,6 +51,8 @@ func newPubSub(t *testing.T, marshaler googlecloud.MarshalerUnmarshaler, subscri
 	subscriber, err := googlecloud.NewSubscriber(
 		ctx,
 		googlecloud.SubscriberConfig{
+			ProjectID:                testProjectID,
+			CreateTopicIfMissing:     true,
 			GenerateSubscriptionName: subscriptionName,
 			SubscriptionConfig: pubsub.SubscriptionConfig{
 				RetainAckedMessages: false,
@@ -82,6 +101,8 @@ func TestSubscriberUnexpectedTopicForSubscription(t *testing.T) {
 	}
 
 	sub1, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                testProjectID,
+		CreateTopicIfMissing:     true,
 		GenerateSubscriptionName: subNameFn,
 	}, logger)
 	require.NoError(t, err)
@@ -89,6 +110,8 @@ func TestSubscriberUnexpectedTopicForSubscription(t *testing.T) {
 	topic1 := fmt.Sprintf("topic1_%d", testNumber)
 
 	sub2, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                testProjectID,
+		CreateTopicIfMissing:     true,
 		GenerateSubscriptionName: subNameFn,
 	}, logger)
 	require.NoError(t, err)
@@ -125,7 +148,9 @@ func TestSubscriberUnexpectedTopicForSubscription(t *testing.T) {
 }
 
 func produceMessages(t *testing.T, ctx context.Context, topic string, howMany int) {
-	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{})
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
 	require.NoError(t, err)
 	defer pub.Close()
 
@@ -136,3 +161,4210 @@ func produceMessages(t *testing.T, ctx context.Context, topic string, howMany in
 
 	require.NoError(t, pub.Publish(topic, messages...))
 }
+
+func TestSubscriber_subscription_topic_mismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topicA := "topic_mismatch_a_" + watermill.NewShortUUID()
+	topicB := "topic_mismatch_b_" + watermill.NewShortUUID()
+	subscriptionName := "topic_mismatch_" + watermill.NewShortUUID()
+
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	topic, err := client.CreateTopic(ctx, topicA)
+	require.NoError(t, err)
+	_, err = client.CreateSubscription(ctx, subscriptionName, pubsub.SubscriptionConfig{Topic: topic})
+	require.NoError(t, err)
+
+	newSubscriber := func(ignoreTopicMismatch bool) *googlecloud.Subscriber {
+		sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+			ProjectID:            testProjectID,
+			CreateTopicIfMissing: true,
+			GenerateSubscriptionName: func(topic string) string {
+				return subscriptionName
+			},
+			IgnoreTopicMismatch: ignoreTopicMismatch,
+		}, watermill.NewStdLogger(true, true))
+		require.NoError(t, err)
+		return sub
+	}
+
+	sub := newSubscriber(false)
+	defer sub.Close()
+
+	_, err = sub.Subscribe(ctx, topicB)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, googlecloud.ErrSubscriptionTopicMismatch), "unexpected error: %v", err)
+	assert.Contains(t, err.Error(), topicA)
+	assert.Contains(t, err.Error(), topicB)
+
+	ignoringSub := newSubscriber(true)
+	defer ignoringSub.Close()
+
+	messages, err := ignoringSub.Subscribe(ctx, topicB)
+	require.NoError(t, err)
+
+	// the existing subscription is used
+	produceMessages(t, ctx, topicA, 1)
+
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("message of the topic of the existing subscription not received")
+	}
+}
+
+func TestNewSubscriber_negative_max_outstanding_messages(t *testing.T) {
+	_, err := googlecloud.NewSubscriber(
+		context.Background(),
+		googlecloud.SubscriberConfig{
+			ProjectID:            testProjectID,
+			CreateTopicIfMissing: true,
+			ReceiveSettings: pubsub.ReceiveSettings{
+				MaxOutstandingMessages: -1,
+			},
+		},
+		watermill.NopLogger{},
+	)
+	require.Error(t, err)
+}
+
+func TestPublishSubscribe_ordering_key(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	logger := watermill.NewStdLogger(true, true)
+	topic := "ordering_key_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:             testProjectID,
+		CreateTopicIfMissing:  true,
+		EnableMessageOrdering: true,
+		ReceiveSettings: pubsub.ReceiveSettings{
+			NumGoroutines: 4,
+		},
+	}, logger)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:             testProjectID,
+		EnableMessageOrdering: true,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	var published []string
+	for i := 0; i < 3; i++ {
+		msg := message.NewMessage(watermill.NewUUID(), []byte{})
+		msg.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+		require.NoError(t, pub.Publish(topic, msg))
+
+		published = append(published, msg.UUID)
+	}
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	var received []string
+	for len(received) < len(published) {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, "ordering_key", msg.Metadata.Get(googlecloud.OrderingKeyMetadataKey))
+			received = append(received, msg.UUID)
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+
+	assert.Equal(t, published, received)
+}
+
+func TestSubscriber_nack_delay_from_metadata(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "nack_delay_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:             testProjectID,
+		CreateTopicIfMissing:  true,
+		NackDelayFromMetadata: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	const nackDelay = time.Second
+
+	delayed := message.NewMessage(watermill.NewUUID(), []byte{})
+	delayed.Metadata.Set(googlecloud.NackDelayMetadataKey, nackDelay.String())
+	notDelayed := message.NewMessage(watermill.NewUUID(), []byte{})
+	require.NoError(t, pub.Publish(topic, delayed, notDelayed))
+
+	nacked := map[string]time.Time{}
+	redelivered := map[string]time.Duration{}
+	for len(redelivered) < 2 {
+		select {
+		case msg := <-messages:
+			nackedAt, ok := nacked[msg.UUID]
+			if !ok {
+				nacked[msg.UUID] = time.Now()
+				msg.Nack()
+				continue
+			}
+			redelivered[msg.UUID] = time.Since(nackedAt)
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+
+	assert.GreaterOrEqual(t, int64(redelivered[delayed.UUID]), int64(nackDelay))
+	assert.Less(t, int64(redelivered[notDelayed.UUID]), int64(nackDelay))
+}
+
+func TestPublisher_ordering_key_fn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "ordering_key_fn_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:             testProjectID,
+		CreateTopicIfMissing:  true,
+		EnableMessageOrdering: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:             testProjectID,
+		EnableMessageOrdering: true,
+		OrderingKeyFn: func(msg *message.Message) string {
+			return "partition_" + msg.Metadata.Get("partition_key")
+		},
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte{})
+	msg.Metadata.Set("partition_key", "1")
+	require.NoError(t, pub.Publish(topic, msg))
+
+	select {
+	case received := <-messages:
+		assert.Equal(t, msg.UUID, received.UUID)
+		assert.Equal(t, "partition_1", received.Metadata.Get(googlecloud.OrderingKeyMetadataKey))
+		received.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+}
+
+func TestPublisher_ordering_key_without_message_ordering(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "ordering_key_without_message_ordering_" + watermill.NewShortUUID()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	// for example a message forwarded from an ordered subscription
+	msg := message.NewMessage(watermill.NewUUID(), []byte{})
+	msg.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+
+	require.NoError(t, pub.Publish(topic, msg))
+}
+
+func TestPublisher_ordering_key_resumed_after_failed_publish(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "ordering_key_resumed_" + watermill.NewShortUUID()
+
+	publishSettings := pubsub.DefaultPublishSettings
+	publishSettings.FlowControlSettings = pubsub.FlowControlSettings{
+		MaxOutstandingMessages: 10,
+		MaxOutstandingBytes:    100,
+		LimitExceededBehavior:  pubsub.FlowControlSignalError,
+	}
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:             testProjectID,
+		EnableMessageOrdering: true,
+		PublishSettings:       &publishSettings,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	tooLarge := message.NewMessage(watermill.NewUUID(), make([]byte, 1000))
+	tooLarge.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+	require.Error(t, pub.Publish(topic, tooLarge))
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte{})
+	msg.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+	require.NoError(t, pub.Publish(topic, msg))
+}
+
+func TestPublisher_ordering_key_resumed_after_server_error(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "ordering_key_server_error_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:             testProjectID,
+		CreateTopicIfMissing:  true,
+		EnableMessageOrdering: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:             testProjectID,
+		EnableMessageOrdering: true,
+		ClientOptions: []option.ClientOption{
+			failFirstCalls(t, "/google.pubsub.v1.Publisher/Publish", codes.InvalidArgument, 1),
+		},
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	failed := message.NewMessage(watermill.NewUUID(), []byte{})
+	failed.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+	err = pub.Publish(topic, failed)
+	require.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(errors.Cause(err)), "original error should be returned")
+	assert.Contains(t, err.Error(), "ordering_key")
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte{})
+	msg.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+	require.NoError(t, pub.Publish(topic, msg))
+
+	select {
+	case received := <-messages:
+		assert.Equal(t, msg.UUID, received.UUID)
+		assert.Equal(t, "ordering_key", received.Metadata.Get(googlecloud.OrderingKeyMetadataKey))
+		received.Ack()
+	case <-ctx.Done():
+		t.Fatal("publishing with the ordering key not resumed")
+	}
+}
+
+func TestSubscriber_dead_letter_policy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "dead_letter_policy_" + watermill.NewShortUUID()
+	deadLetterTopic := topic + "_dead_letter"
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		DeadLetterPolicy: &googlecloud.DeadLetterPolicy{
+			DeadLetterTopic:     deadLetterTopic,
+			MaxDeliveryAttempts: 10,
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	config := subscriptionConfig(t, ctx, topic)
+	require.NotNil(t, config.DeadLetterPolicy)
+	assert.Equal(t, fmt.Sprintf("projects/%s/topics/%s", testProjectID, deadLetterTopic), config.DeadLetterPolicy.DeadLetterTopic)
+	assert.Equal(t, 10, config.DeadLetterPolicy.MaxDeliveryAttempts)
+}
+
+func TestSubscriber_push_subscription(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "push_subscription_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		PushConfig:           &pubsub.PushConfig{Endpoint: "https://example.com/push"},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, googlecloud.ErrPushSubscription), "unexpected error: %v", err)
+
+	config := subscriptionConfig(t, ctx, topic)
+	assert.Equal(t, "https://example.com/push", config.PushConfig.Endpoint)
+}
+
+func TestSubscriber_bigquery_subscription(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "bigquery_subscription_" + watermill.NewShortUUID()
+	table := testProjectID + ".dataset.table"
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		BigQueryConfig: &pubsub.BigQueryConfig{
+			Table:         table,
+			WriteMetadata: true,
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, googlecloud.ErrBigQuerySubscription), "unexpected error: %v", err)
+
+	config := subscriptionConfig(t, ctx, topic)
+	assert.Equal(t, table, config.BigQueryConfig.Table)
+	assert.True(t, config.BigQueryConfig.WriteMetadata)
+}
+
+func TestSubscriber_delete_subscription_on_close(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "delete_subscription_on_close_" + watermill.NewShortUUID()
+	existingTopic := "delete_subscription_on_close_existing_" + watermill.NewShortUUID()
+
+	existingSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	require.NoError(t, existingSub.SubscribeInitialize(existingTopic))
+	require.NoError(t, existingSub.Close())
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                 testProjectID,
+		CreateTopicIfMissing:      true,
+		DeleteSubscriptionOnClose: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+	_, err = sub.Subscribe(ctx, existingTopic)
+	require.NoError(t, err)
+
+	require.NoError(t, sub.Close())
+
+	checkSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer checkSub.Close()
+
+	exists, err := checkSub.SubscriptionExists(ctx, topic)
+	require.NoError(t, err)
+	assert.False(t, exists, "created subscription should be deleted")
+
+	exists, err = checkSub.SubscriptionExists(ctx, existingTopic)
+	require.NoError(t, err)
+	assert.True(t, exists, "subscription existing before should not be deleted")
+}
+
+func TestSubscriber_retry_policy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "retry_policy_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		RetryPolicy: &googlecloud.RetryPolicy{
+			MinimumBackoff: time.Second * 15,
+			MaximumBackoff: time.Minute * 5,
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	config := subscriptionConfig(t, ctx, topic)
+	require.NotNil(t, config.RetryPolicy)
+	assert.Equal(t, time.Second*15, config.RetryPolicy.MinimumBackoff)
+	assert.Equal(t, time.Minute*5, config.RetryPolicy.MaximumBackoff)
+}
+
+func TestSubscriber_subscription_config_fn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	slowTopic := "subscription_config_fn_slow_" + watermill.NewShortUUID()
+	fastTopic := "subscription_config_fn_fast_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		SubscriptionConfig:   pubsub.SubscriptionConfig{AckDeadline: time.Second * 20},
+		SubscriptionConfigFn: func(ctx context.Context, topic string) pubsub.SubscriptionConfig {
+			if topic == slowTopic {
+				return pubsub.SubscriptionConfig{AckDeadline: time.Minute * 5}
+			}
+			return pubsub.SubscriptionConfig{AckDeadline: time.Second * 30}
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(slowTopic))
+	require.NoError(t, sub.SubscribeInitialize(fastTopic))
+
+	assert.Equal(t, time.Minute*5, subscriptionConfig(t, ctx, slowTopic).AckDeadline)
+	assert.Equal(t, time.Second*30, subscriptionConfig(t, ctx, fastTopic).AckDeadline)
+}
+
+func TestSubscriber_message_ordering_per_topic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	orderedTopic := "ordering_per_topic_ordered_" + watermill.NewShortUUID()
+	unorderedTopic := "ordering_per_topic_unordered_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		SubscriptionConfigFn: func(ctx context.Context, topic string) pubsub.SubscriptionConfig {
+			return pubsub.SubscriptionConfig{EnableMessageOrdering: topic == orderedTopic}
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	orderedMessages, err := sub.Subscribe(ctx, orderedTopic)
+	require.NoError(t, err)
+	unorderedMessages, err := sub.Subscribe(ctx, unorderedTopic)
+	require.NoError(t, err)
+
+	assert.True(t, subscriptionConfig(t, ctx, orderedTopic).EnableMessageOrdering)
+	assert.False(t, subscriptionConfig(t, ctx, unorderedTopic).EnableMessageOrdering)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:             testProjectID,
+		EnableMessageOrdering: true,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	publish := func(topic string) []*message.Message {
+		var published []*message.Message
+		for i := 0; i < 2; i++ {
+			msg := message.NewMessage(watermill.NewUUID(), []byte(fmt.Sprint(i)))
+			msg.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+			published = append(published, msg)
+		}
+		require.NoError(t, pub.Publish(topic, published...))
+		return published
+	}
+
+	receive := func(messages <-chan *message.Message, timeout time.Duration) *message.Message {
+		select {
+		case msg := <-messages:
+			return msg
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+
+	t.Run("ordered", func(t *testing.T) {
+		published := publish(orderedTopic)
+
+		first := receive(orderedMessages, time.Second*5)
+		require.NotNil(t, first)
+		assert.Equal(t, published[0].UUID, first.UUID)
+
+		assert.Nil(t, receive(orderedMessages, time.Millisecond*500), "next message with the key should wait for ack")
+		first.Ack()
+
+		second := receive(orderedMessages, time.Second*5)
+		require.NotNil(t, second)
+		assert.Equal(t, published[1].UUID, second.UUID)
+		second.Ack()
+	})
+
+	t.Run("unordered", func(t *testing.T) {
+		publish(unorderedTopic)
+
+		first := receive(unorderedMessages, time.Second*5)
+		require.NotNil(t, first)
+
+		// delivered while the first one is not acked yet
+		second := receive(unorderedMessages, time.Second*5)
+		require.NotNil(t, second, "messages of unordered topic should not be serialized")
+
+		first.Ack()
+		second.Ack()
+	})
+}
+
+func subscriptionConfig(t *testing.T, ctx context.Context, subscriptionName string) pubsub.SubscriptionConfig {
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	config, err := client.Subscription(subscriptionName).Config(ctx)
+	require.NoError(t, err)
+
+	return config
+}
+
+func TestSubscriber_resubscribe_after_receive_failed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "resubscribe_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:              testProjectID,
+		CreateTopicIfMissing:   true,
+		ReconnectRetryInterval: time.Millisecond * 100,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// receiving from a deleted subscription fails
+	require.NoError(t, client.Subscription(topic).Delete(ctx))
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 300)
+
+	_, err = client.CreateSubscription(ctx, topic, pubsub.SubscriptionConfig{
+		Topic: client.Topic(topic),
+	})
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case msg, ok := <-messages:
+		require.True(t, ok, "output channel closed")
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+}
+
+func TestSubscriber_Errors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		ReconnectMaxAttempts: 1,
+		ClientOptions: []option.ClientOption{
+			failFirstCalls(t, "/google.pubsub.v1.Subscriber/StreamingPull", codes.PermissionDenied, 1),
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	messages, err := sub.Subscribe(ctx, "errors_"+watermill.NewShortUUID())
+	require.NoError(t, err)
+
+	select {
+	case err := <-sub.Errors():
+		assert.Equal(t, codes.PermissionDenied, status.Code(errors.Cause(err)), "unexpected error: %v", err)
+	case <-ctx.Done():
+		t.Fatal("no error received")
+	}
+
+	// receiving isn't retried, so the output channel is closed
+	_, ok := <-messages
+	assert.False(t, ok)
+	assert.Equal(t, codes.PermissionDenied, status.Code(errors.Cause(sub.LastError())))
+
+	require.NoError(t, sub.Close())
+
+	_, ok = <-sub.Errors()
+	assert.False(t, ok, "errors channel should be closed")
+}
+
+func TestSubscriber_LastError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	messages, err := sub.Subscribe(ctx, "last_error_"+watermill.NewShortUUID())
+	require.NoError(t, err)
+	assert.NoError(t, sub.LastError())
+
+	require.NoError(t, sub.Close())
+
+	_, ok := <-messages
+	require.False(t, ok)
+	assert.True(t, errors.Is(sub.LastError(), context.Canceled), "unexpected error: %v", sub.LastError())
+}
+
+func TestSubscriber_duplicate_subscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "duplicate_subscribe_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	subscribeCtx, cancelSubscribe := context.WithCancel(ctx)
+	messages, err := sub.Subscribe(subscribeCtx, topic)
+	require.NoError(t, err)
+
+	_, err = sub.Subscribe(ctx, topic)
+	assert.True(t, errors.Is(err, googlecloud.ErrAlreadySubscribed), "unexpected error: %v", err)
+
+	// subscribing again is possible once the previous subscription is finished
+	cancelSubscribe()
+	for range messages {
+	}
+
+	_, err = sub.Subscribe(ctx, topic)
+	assert.NoError(t, err)
+
+	sub, err = googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:               testProjectID,
+		CreateTopicIfMissing:    true,
+		AllowDuplicateSubscribe: true,
+		// a single stream for each subscription, as the emulator delivers messages to the streams in turns
+		ReceiveSettings: pubsub.ReceiveSettings{NumGoroutines: 1},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// the previous subscriber still receives from the subscription of topic
+	topic = "duplicate_subscribe_allowed_" + watermill.NewShortUUID()
+
+	var outputs [2]<-chan *message.Message
+	var cancels [2]context.CancelFunc
+	for i := range outputs {
+		subscribeCtx, cancelSubscribe := context.WithCancel(ctx)
+		defer cancelSubscribe()
+
+		outputs[i], err = sub.Subscribe(subscribeCtx, topic)
+		require.NoError(t, err)
+		cancels[i] = cancelSubscribe
+	}
+
+	// receives from both subscriptions, returning the index of the one which received a message
+	receive := func() int {
+		produceMessages(t, ctx, topic, 1)
+
+		for {
+			select {
+			case msg, ok := <-outputs[0]:
+				if ok {
+					msg.Ack()
+					return 0
+				}
+				outputs[0] = nil
+			case msg, ok := <-outputs[1]:
+				if ok {
+					msg.Ack()
+					return 1
+				}
+				outputs[1] = nil
+			case err := <-sub.Errors():
+				t.Fatalf("receiving failed: %v", err)
+			case <-ctx.Done():
+				t.Fatal("Test timed out")
+			}
+		}
+	}
+
+	// the emulator prefers one of the subscriptions, so it's stopped once it receives,
+	// the other one has to keep receiving
+	received := receive()
+	cancels[received]()
+	assert.Equal(t, 1-received, receive(), "both subscriptions should receive")
+}
+
+func TestOutcomeSubscriberDecorator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "outcome_decorator_" + watermill.NewShortUUID()
+
+	var lock sync.Mutex
+	outcomes := map[string][]googlecloud.Outcome{}
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	decorated, err := googlecloud.OutcomeSubscriberDecorator(
+		func(outcomeTopic string, msg *message.Message, outcome googlecloud.Outcome) {
+			assert.Equal(t, topic, outcomeTopic)
+
+			lock.Lock()
+			defer lock.Unlock()
+			outcomes[msg.UUID] = append(outcomes[msg.UUID], outcome)
+		},
+	)(sub)
+	require.NoError(t, err)
+
+	messages, err := decorated.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	acked := message.NewMessage(watermill.NewUUID(), []byte{})
+	nacked := message.NewMessage(watermill.NewUUID(), []byte{})
+	require.NoError(t, pub.Publish(topic, acked, nacked))
+
+	// the nacked message is redelivered, and acked then
+	for delivered := 0; delivered < 3; delivered++ {
+		select {
+		case msg := <-messages:
+			lock.Lock()
+			redelivered := len(outcomes[msg.UUID]) > 0
+			lock.Unlock()
+
+			if msg.UUID != nacked.UUID || redelivered {
+				msg.Ack()
+				continue
+			}
+
+			msg.Nack()
+			// wait for the outcome, so the redelivered message is acked
+			assert.Eventually(t, func() bool {
+				lock.Lock()
+				defer lock.Unlock()
+				return len(outcomes[msg.UUID]) > 0
+			}, time.Second, time.Millisecond*10)
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+
+	require.NoError(t, decorated.Close())
+
+	assert.Equal(t, map[string][]googlecloud.Outcome{
+		acked.UUID:  {googlecloud.OutcomeAcked},
+		nacked.UUID: {googlecloud.OutcomeNacked, googlecloud.OutcomeAcked},
+	}, outcomes)
+}
+
+// TestSubscriber_concurrent_subscribe_and_close is meant to be run with the race detector (`make test_race`).
+func TestSubscriber_concurrent_subscribe_and_close(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "concurrent_subscribe_close_" + watermill.NewShortUUID()
+
+	for i := 0; i < 10; i++ {
+		sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+			ProjectID:            testProjectID,
+			CreateTopicIfMissing: true,
+		}, watermill.NopLogger{})
+		require.NoError(t, err)
+
+		subscribed := make(chan (<-chan *message.Message), 1)
+		go func() {
+			messages, err := sub.Subscribe(ctx, topic)
+			if err != nil {
+				assert.Equal(t, googlecloud.ErrSubscriberClosed, errors.Cause(err))
+				close(subscribed)
+				return
+			}
+			subscribed <- messages
+		}()
+
+		require.NoError(t, sub.Close())
+
+		messages, ok := <-subscribed
+		if !ok {
+			continue
+		}
+
+		select {
+		case _, open := <-messages:
+			assert.False(t, open, "output channel should be closed")
+		case <-ctx.Done():
+			t.Fatal("output channel was not closed")
+		}
+	}
+}
+
+func TestSubscriber_independent_subscriptions_on_same_topic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "independent_subscriptions_" + watermill.NewShortUUID()
+	logger := watermill.NewStdLogger(true, true)
+	howManyMessages := 10
+
+	var allMessages []<-chan *message.Message
+	for _, group := range []string{"_group1", "_group2"} {
+		sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+			ProjectID:                testProjectID,
+			CreateTopicIfMissing:     true,
+			GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix(group),
+		}, logger)
+		require.NoError(t, err)
+		defer sub.Close()
+
+		messages, err := sub.Subscribe(ctx, topic)
+		require.NoError(t, err)
+		allMessages = append(allMessages, messages)
+	}
+
+	produceMessages(t, ctx, topic, howManyMessages)
+
+	for _, messages := range allMessages {
+		received := map[string]struct{}{}
+		for len(received) < howManyMessages {
+			select {
+			case msg := <-messages:
+				received[msg.UUID] = struct{}{}
+				msg.Ack()
+			case <-ctx.Done():
+				t.Fatal("Test timed out")
+			}
+		}
+	}
+}
+
+func TestSubscriber_filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "filter_" + watermill.NewShortUUID()
+	logger := watermill.NewStdLogger(true, true)
+
+	sub1, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		Filter:               `attributes.type = "created"`,
+	}, logger)
+	require.NoError(t, err)
+	defer sub1.Close()
+
+	require.NoError(t, sub1.SubscribeInitialize(topic))
+	assert.Equal(t, `attributes.type = "created"`, subscriptionConfig(t, ctx, topic).Filter)
+
+	sub2, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		Filter:               `attributes.type = "deleted"`,
+	}, logger)
+	require.NoError(t, err)
+	defer sub2.Close()
+
+	_, err = sub2.Subscribe(ctx, topic)
+	require.Equal(t, googlecloud.ErrUnexpectedFilter, errors.Cause(err))
+
+	subWithoutFilter, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, logger)
+	require.NoError(t, err)
+	defer subWithoutFilter.Close()
+
+	_, err = subWithoutFilter.Subscribe(ctx, topic)
+	require.Equal(t, googlecloud.ErrUnexpectedFilter, errors.Cause(err))
+
+	subWithSubscriptionConfigFilter, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		SubscriptionConfig: pubsub.SubscriptionConfig{
+			Filter: `attributes.type = "created"`,
+		},
+	}, logger)
+	require.NoError(t, err)
+	defer subWithSubscriptionConfigFilter.Close()
+
+	require.NoError(t, subWithSubscriptionConfigFilter.SubscribeInitialize(topic))
+}
+
+func TestPublishSubscribe_emulator_without_client_options(t *testing.T) {
+	previousEmulatorHost, emulatorHostSet := os.LookupEnv("PUBSUB_EMULATOR_HOST")
+	defer func() {
+		if emulatorHostSet {
+			os.Setenv("PUBSUB_EMULATOR_HOST", previousEmulatorHost)
+		} else {
+			os.Unsetenv("PUBSUB_EMULATOR_HOST")
+		}
+	}()
+
+	emulatorHost := previousEmulatorHost
+	if emulatorHost == "" {
+		// the address of the emulator from docker-compose.yml
+		emulatorHost = "googlecloud:8085"
+	}
+	require.NoError(t, os.Setenv("PUBSUB_EMULATOR_HOST", emulatorHost))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "emulator_" + watermill.NewShortUUID()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:                 testProjectID,
+		DoNotCreateTopicIfMissing: true,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	// the topic doesn't exist, so the emulator answers the existence check instead of the real API
+	err = pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte{}))
+	require.Equal(t, googlecloud.ErrTopicDoesNotExist, errors.Cause(err))
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NopLogger{})
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+}
+
+func TestSubscriber_close_timeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "close_timeout_" + watermill.NewShortUUID()
+	closeTimeout := time.Millisecond * 500
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		CloseTimeout:         closeTimeout,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case <-messages:
+		// never acked
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	closeStarted := time.Now()
+	err = sub.Close()
+	assert.Equal(t, googlecloud.ErrCloseTimeout, errors.Cause(err))
+	assert.True(t, time.Since(closeStarted) < closeTimeout*4, "Close took %s", time.Since(closeStarted))
+
+	_, open := <-messages
+	assert.False(t, open, "output channel should be closed")
+
+	assert.Equal(t, err, sub.Close(), "subsequent Close should return the same error")
+}
+
+func TestSubscriber_close_timeout_message_context(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "close_timeout_message_context_" + watermill.NewShortUUID()
+	closeTimeout := time.Second * 2
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		CloseTimeout:         closeTimeout,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	closeErr := make(chan error)
+	go func() {
+		closeErr <- sub.Close()
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+	assert.NoError(t, msg.Context().Err(), "message context should be available until CloseTimeout")
+	msg.Ack()
+
+	select {
+	case err := <-closeErr:
+		require.NoError(t, err)
+	case <-time.After(closeTimeout):
+		t.Fatal("Close should return once in-flight messages are acked")
+	}
+
+	assert.Error(t, msg.Context().Err(), "message context should be canceled after Close")
+}
+
+func TestSubscriber_handler_longer_than_ack_deadline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits past the ack deadline")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	topic := "handler_longer_than_ack_deadline_" + watermill.NewShortUUID()
+	ackDeadline := time.Second * 10
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		AckDeadline:          ackDeadline,
+		ReceiveSettings: pubsub.ReceiveSettings{
+			MaxExtension:       time.Minute,
+			MaxExtensionPeriod: ackDeadline,
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	// the handler takes longer than the ack deadline
+	time.Sleep(ackDeadline + time.Second*2)
+	msg.Ack()
+
+	select {
+	case redelivered := <-messages:
+		t.Fatalf("message %s should not be redelivered, the ack deadline should be extended", redelivered.UUID)
+	case <-time.After(time.Second * 2):
+	}
+}
+
+func TestPublishSubscribe_compression(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "compression_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		Unmarshaler: googlecloud.DecompressingUnmarshaler{
+			Unmarshaler: googlecloud.DefaultMarshalerUnmarshaler{},
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	compressingPub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+		Marshaler: googlecloud.CompressingMarshaler{
+			Marshaler: googlecloud.DefaultMarshalerUnmarshaler{},
+		},
+	})
+	require.NoError(t, err)
+	defer compressingPub.Close()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	compressedMsg := message.NewMessage(watermill.NewUUID(), []byte(`{"compressed":true}`))
+	require.NoError(t, compressingPub.Publish(topic, compressedMsg))
+
+	uncompressedMsg := message.NewMessage(watermill.NewUUID(), []byte(`{"compressed":false}`))
+	require.NoError(t, pub.Publish(topic, uncompressedMsg))
+
+	received := map[string]string{}
+	for len(received) < 2 {
+		select {
+		case msg := <-messages:
+			received[msg.UUID] = string(msg.Payload)
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+
+	assert.Equal(t, `{"compressed":true}`, received[compressedMsg.UUID])
+	assert.Equal(t, `{"compressed":false}`, received[uncompressedMsg.UUID])
+}
+
+func TestPublisher_message_too_large(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	msg := message.NewMessage(watermill.NewUUID(), make([]byte, googlecloud.MaxMessageSize))
+	err = pub.Publish("message_too_large_"+watermill.NewShortUUID(), msg)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, googlecloud.ErrMessageTooLarge))
+
+	var tooLargeErr googlecloud.MessageTooLargeError
+	require.True(t, errors.As(err, &tooLargeErr))
+	assert.Equal(t, msg.UUID, tooLargeErr.UUID)
+	assert.Equal(t, googlecloud.MaxMessageSize, tooLargeErr.MaxSize)
+	assert.True(t, tooLargeErr.Size > googlecloud.MaxMessageSize, "attributes should count against the size")
+}
+
+func TestPublisher_attribute_limits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	topic := "attribute_limits_" + watermill.NewShortUUID()
+
+	t.Run("too_many_attributes", func(t *testing.T) {
+		msg := message.NewMessage(watermill.NewUUID(), []byte{})
+		// the UUID is an attribute too
+		for i := 0; i < googlecloud.MaxAttributes; i++ {
+			msg.Metadata.Set(fmt.Sprintf("key_%d", i), "value")
+		}
+
+		err := pub.Publish(topic, msg)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, googlecloud.ErrTooManyAttributes))
+	})
+
+	t.Run("key_too_long", func(t *testing.T) {
+		key := strings.Repeat("k", googlecloud.MaxAttributeKeyLength+1)
+		msg := message.NewMessage(watermill.NewUUID(), []byte{})
+		msg.Metadata.Set(key, "value")
+
+		err := pub.Publish(topic, msg)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, googlecloud.ErrAttributeTooLong))
+
+		var tooLongErr googlecloud.AttributeTooLongError
+		require.True(t, errors.As(err, &tooLongErr))
+		assert.Equal(t, msg.UUID, tooLongErr.UUID)
+		assert.Equal(t, key, tooLongErr.Key)
+		assert.False(t, tooLongErr.Value)
+	})
+
+	t.Run("value_too_long", func(t *testing.T) {
+		msg := message.NewMessage(watermill.NewUUID(), []byte{})
+		msg.Metadata.Set("key", strings.Repeat("v", googlecloud.MaxAttributeValueLength+1))
+
+		err := pub.Publish(topic, msg)
+		require.Error(t, err)
+
+		var tooLongErr googlecloud.AttributeTooLongError
+		require.True(t, errors.As(err, &tooLongErr))
+		assert.Equal(t, "key", tooLongErr.Key)
+		assert.Equal(t, googlecloud.MaxAttributeValueLength, tooLongErr.MaxLength)
+		assert.True(t, tooLongErr.Value)
+	})
+
+	t.Run("within_limits", func(t *testing.T) {
+		msg := message.NewMessage(watermill.NewUUID(), []byte{})
+		for i := 0; i < googlecloud.MaxAttributes-1; i++ {
+			msg.Metadata.Set(fmt.Sprintf("key_%d", i), "value")
+		}
+		msg.Metadata.Set("key_0", strings.Repeat("v", googlecloud.MaxAttributeValueLength))
+
+		assert.NoError(t, pub.Publish(topic, msg))
+	})
+}
+
+func TestPing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	assert.NoError(t, pub.Ping(ctx))
+	assert.NoError(t, sub.Ping(ctx))
+
+	canceledCtx, cancelPing := context.WithCancel(ctx)
+	cancelPing()
+
+	assert.Error(t, pub.Ping(canceledCtx))
+	assert.Error(t, sub.Ping(canceledCtx))
+}
+
+func TestKMSKeyName(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	kmsKeyName := fmt.Sprintf("projects/%s/locations/global/keyRings/ring/cryptoKeys/key", testProjectID)
+	publisherTopic := "kms_key_name_publisher_" + watermill.NewShortUUID()
+	subscriberTopic := "kms_key_name_subscriber_" + watermill.NewShortUUID()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:  testProjectID,
+		KMSKeyName: kmsKeyName,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	require.NoError(t, pub.Publish(publisherTopic, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		KMSKeyName:           kmsKeyName,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(subscriberTopic))
+
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, topic := range []string{publisherTopic, subscriberTopic} {
+		config, err := client.Topic(topic).Config(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, kmsKeyName, config.KMSKeyName, "topic %s", topic)
+	}
+
+	logger := watermill.NewCaptureLogger()
+	otherKeyPub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:  testProjectID,
+		KMSKeyName: kmsKeyName + "_other",
+		Logger:     logger,
+	})
+	require.NoError(t, err)
+	defer otherKeyPub.Close()
+
+	require.NoError(t, otherKeyPub.Publish(publisherTopic, message.NewMessage(watermill.NewUUID(), []byte{})))
+	assert.Len(t, logger.Captured()[watermill.InfoLogLevel], 1, "different key of existing topic should be logged")
+}
+
+func TestPublisher_PublishWithResults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "publish_with_results_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	published := []*message.Message{
+		message.NewMessage(watermill.NewUUID(), []byte("1")),
+		message.NewMessage(watermill.NewUUID(), []byte("2")),
+		message.NewMessage(watermill.NewUUID(), []byte("3")),
+	}
+
+	ids, err := pub.PublishWithResults(topic, published...)
+	require.NoError(t, err)
+	require.Len(t, ids, len(published))
+
+	uniqueIDs := map[string]struct{}{}
+	for _, id := range ids {
+		assert.NotEmpty(t, id)
+		uniqueIDs[id] = struct{}{}
+	}
+	assert.Len(t, uniqueIDs, len(published), "IDs should be unique")
+
+	for range published {
+		select {
+		case msg := <-messages:
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+}
+
+func TestPublisher_publish_server_error(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+		ClientOptions: []option.ClientOption{
+			failFirstCalls(t, "/google.pubsub.v1.Publisher/Publish", codes.InvalidArgument, 1),
+		},
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	topic := "publish_server_error_" + watermill.NewShortUUID()
+	failed := message.NewMessage(watermill.NewUUID(), []byte{})
+	notPublished := message.NewMessage(watermill.NewUUID(), []byte{})
+
+	// Publish waits for the server to confirm each message, so the error is returned directly
+	ids, err := pub.PublishWithResults(topic, failed, notPublished)
+	require.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(errors.Cause(err)))
+	assert.Contains(t, err.Error(), failed.UUID)
+	assert.Empty(t, ids, "messages after the failed one should not be published")
+
+	assert.NoError(t, pub.Publish(topic, notPublished))
+}
+
+func TestPublisher_Close_flushes_batched_messages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "close_flush_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	publishSettings := pubsub.DefaultPublishSettings
+	// nothing is sent until the publisher is closed
+	publishSettings.DelayThreshold = time.Hour
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:       testProjectID,
+		PublishSettings: &publishSettings,
+	})
+	require.NoError(t, err)
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte{})
+	published := make(chan error, 1)
+	go func() {
+		published <- pub.Publish(topic, msg)
+	}()
+
+	select {
+	case <-published:
+		t.Fatal("message published before Close")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	require.NoError(t, pub.Close())
+	require.NoError(t, <-published)
+
+	select {
+	case received := <-messages:
+		assert.Equal(t, msg.UUID, received.UUID)
+		received.Ack()
+	case <-ctx.Done():
+		t.Fatal("message not published on Close")
+	}
+}
+
+func TestPublisher_Close_returns_publish_errors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "close_publish_errors_" + watermill.NewShortUUID()
+
+	publishSettings := pubsub.DefaultPublishSettings
+	publishSettings.DelayThreshold = time.Hour
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:       testProjectID,
+		PublishSettings: &publishSettings,
+		ClientOptions: []option.ClientOption{
+			failFirstCalls(t, "/google.pubsub.v1.Publisher/Publish", codes.PermissionDenied, 1),
+		},
+	})
+	require.NoError(t, err)
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte{})
+	published := make(chan error, 1)
+	go func() {
+		published <- pub.Publish(topic, msg)
+	}()
+
+	// let the message be batched
+	time.Sleep(time.Millisecond * 500)
+
+	err = pub.Close()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), msg.UUID)
+
+	var publishErrs *multierror.Error
+	require.True(t, errors.As(err, &publishErrs))
+	require.Len(t, publishErrs.Errors, 1)
+	assert.Equal(t, codes.PermissionDenied, status.Code(errors.Cause(publishErrs.Errors[0])))
+
+	assert.Error(t, <-published)
+}
+
+func TestPublisher_Close_while_getting_topic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "close_while_getting_topic_" + watermill.NewShortUUID()
+
+	// the client is owned by the test, so it keeps working after the publisher is closed
+	client, err := pubsub.NewClient(ctx, testProjectID, delayCalls(t, "/google.pubsub.v1.Publisher/GetTopic", time.Second))
+	require.NoError(t, err)
+	defer client.Close()
+
+	pub, err := googlecloud.NewPublisherWithClient(ctx, client, googlecloud.PublisherConfig{})
+	require.NoError(t, err)
+
+	published := make(chan error, 1)
+	go func() {
+		published <- pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte{}))
+	}()
+
+	// let the publish check if the topic exists
+	time.Sleep(time.Millisecond * 200)
+	require.NoError(t, pub.Close())
+
+	err = <-published
+	assert.True(t, errors.Is(err, googlecloud.ErrPublisherClosed), "unexpected error: %v", err)
+}
+
+func TestPublisher_publish_not_blocked_by_creating_topic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "publish_not_blocked_" + watermill.NewShortUUID()
+	otherTopic := "publish_not_blocked_other_" + watermill.NewShortUUID()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+		ClientOptions: []option.ClientOption{
+			delayCalls(t, "/google.pubsub.v1.Publisher/GetTopic", time.Second*3),
+		},
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	// caches the topic
+	require.NoError(t, pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	published := make(chan error, 1)
+	go func() {
+		published <- pub.Publish(otherTopic, message.NewMessage(watermill.NewUUID(), []byte{}))
+	}()
+
+	// let the other publish check if its topic exists
+	time.Sleep(time.Millisecond * 200)
+
+	started := time.Now()
+	require.NoError(t, pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte{})))
+	assert.Less(t, int64(time.Since(started)), int64(time.Second), "publishing to the cached topic waited for creating the other topic")
+
+	require.NoError(t, <-published)
+}
+
+func TestPublisher_topic_resolver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "topic_resolver_" + watermill.NewShortUUID()
+	resolvedTopic := "staging-" + topic
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, resolvedTopic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:     testProjectID,
+		TopicResolver: googlecloud.TopicNameWithPrefix("staging-"),
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte{})
+	require.NoError(t, pub.Publish(topic, msg))
+
+	select {
+	case received := <-messages:
+		assert.Equal(t, msg.UUID, received.UUID)
+		received.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+}
+
+func TestSubscriber_ack_deadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "ack_deadline_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		AckDeadline:          time.Minute * 3,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+	assert.Equal(t, time.Minute*3, subscriptionConfig(t, ctx, topic).AckDeadline)
+}
+
+func TestSubscriber_exactly_once_delivery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "exactly_once_" + watermill.NewShortUUID()
+	logger := watermill.NewCaptureLogger()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                 testProjectID,
+		CreateTopicIfMissing:      true,
+		EnableExactlyOnceDelivery: true,
+	}, logger)
+	require.NoError(t, err)
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+	assert.True(t, subscriptionConfig(t, ctx, topic).EnableExactlyOnceDelivery)
+
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	// Close waits for the ack to be confirmed
+	require.NoError(t, sub.Close())
+	assert.Empty(t, logger.Captured()[watermill.ErrorLogLevel])
+
+	sub, err = googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                 testProjectID,
+		CreateTopicIfMissing:      true,
+		EnableExactlyOnceDelivery: true,
+	}, logger)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err = sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	select {
+	case msg := <-messages:
+		t.Fatalf("acked message %s was redelivered", msg.UUID)
+	case <-time.After(time.Second):
+		// ok
+	}
+}
+
+func TestSubscriptionExists_TopicExists(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "exists_" + watermill.NewShortUUID()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NopLogger{})
+	require.NoError(t, err)
+	defer sub.Close()
+
+	topicExists, err := pub.TopicExists(ctx, topic)
+	require.NoError(t, err)
+	assert.False(t, topicExists)
+
+	subscriptionExists, err := sub.SubscriptionExists(ctx, topic)
+	require.NoError(t, err)
+	assert.False(t, subscriptionExists)
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	topicExists, err = pub.TopicExists(ctx, topic)
+	require.NoError(t, err)
+	assert.True(t, topicExists)
+
+	subscriptionExists, err = sub.SubscriptionExists(ctx, topic)
+	require.NoError(t, err)
+	assert.True(t, subscriptionExists)
+}
+
+func TestSubscriber_Subscription(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "subscription_" + watermill.NewShortUUID()
+	subscriptionName := topic + "_sub"
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                testProjectID,
+		CreateTopicIfMissing:     true,
+		GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix("_sub"),
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	subscription, err := sub.Subscription(ctx, topic)
+	require.NoError(t, err)
+	assert.Equal(t, subscriptionName, subscription.ID())
+
+	exists, err := subscription.Exists(ctx)
+	require.NoError(t, err)
+	assert.True(t, exists, "subscription should be created")
+
+	require.NoError(t, sub.Close())
+
+	_, err = sub.Subscription(ctx, topic)
+	assert.Equal(t, googlecloud.ErrSubscriberClosed, err)
+}
+
+func TestSubscriber_labels_and_retention(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "labels_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		Labels:               map[string]string{"cost_center": "payments"},
+		RetainAckedMessages:  true,
+		RetentionDuration:    time.Hour * 24,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	config := subscriptionConfig(t, ctx, topic)
+	assert.Equal(t, map[string]string{"cost_center": "payments"}, config.Labels)
+	assert.True(t, config.RetainAckedMessages)
+	assert.Equal(t, time.Hour*24, config.RetentionDuration)
+}
+
+func TestSubscriber_missing_topic_and_subscription_errors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "missing_topic_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                 testProjectID,
+		DoNotCreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, googlecloud.ErrTopicDoesNotExist), "unexpected error: %v", err)
+	assert.False(t, errors.Is(err, googlecloud.ErrSubscriptionDoesNotExist))
+
+	err = sub.SubscribeInitialize(topic)
+	assert.True(t, errors.Is(err, googlecloud.ErrTopicDoesNotExist), "unexpected error: %v", err)
+
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.CreateTopic(ctx, topic)
+	require.NoError(t, err)
+
+	sub, err = googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                        testProjectID,
+		CreateTopicIfMissing:             true,
+		DoNotCreateSubscriptionIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, googlecloud.ErrSubscriptionDoesNotExist), "unexpected error: %v", err)
+	assert.False(t, errors.Is(err, googlecloud.ErrTopicDoesNotExist))
+}
+
+func TestSubscriber_missing_subscription_does_not_check_topic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// any topic existence check fails, neither the topic nor the subscription exist
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                        testProjectID,
+		DoNotCreateSubscriptionIfMissing: true,
+		DeadLetterPolicy:                 &googlecloud.DeadLetterPolicy{DeadLetterTopic: "dead_letter_" + watermill.NewShortUUID()},
+		EnableMessageOrdering:            true,
+		ClientOptions: []option.ClientOption{
+			failFirstCalls(t, "/google.pubsub.v1.Publisher/GetTopic", codes.FailedPrecondition, math.MaxInt32),
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	topic := "missing_subscription_" + watermill.NewShortUUID()
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, googlecloud.ErrSubscriptionDoesNotExist), "unexpected error: %v", err)
+	assert.NotEqual(t, codes.FailedPrecondition, status.Code(errors.Cause(err)), "topic should not be checked")
+
+	err = sub.SubscribeInitialize(topic)
+	assert.True(t, errors.Is(err, googlecloud.ErrSubscriptionDoesNotExist), "unexpected error: %v", err)
+}
+
+func TestSubscriber_existing_subscription_does_not_access_topic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "existing_subscription_" + watermill.NewShortUUID()
+
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	createdTopic, err := client.CreateTopic(ctx, topic)
+	require.NoError(t, err)
+	_, err = client.CreateSubscription(ctx, topic, pubsub.SubscriptionConfig{Topic: createdTopic})
+	require.NoError(t, err)
+
+	// access is granted to the subscription, but not to its topic
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		ClientOptions: []option.ClientOption{
+			failFirstCalls(t, "/google.pubsub.v1.Publisher/GetTopic", codes.PermissionDenied, math.MaxInt32),
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+}
+
+func TestSubscriber_failed_subscribe_releases_resources(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                 testProjectID,
+		DoNotCreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	topic := "failed_subscribe_" + watermill.NewShortUUID()
+
+	// the first failure may start goroutines of the client library
+	_, err = sub.Subscribe(ctx, topic)
+	require.Error(t, err)
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		_, err := sub.Subscribe(ctx, topic)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, googlecloud.ErrTopicDoesNotExist), "unexpected error: %v", err)
+	}
+
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines+2, "failed Subscribe should not leave goroutines")
+
+	closed := make(chan error)
+	go func() {
+		closed <- sub.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Close should not wait for failed subscriptions")
+	}
+}
+
+// failFirstCalls returns a client option connecting to the emulator which fails the first `failures` calls
+// of the gRPC method with the code.
+func failFirstCalls(t *testing.T, method string, code codes.Code, failures int) option.ClientOption {
+	var lock sync.Mutex
+	shouldFail := func(calledMethod string) bool {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if calledMethod != method || failures == 0 {
+			return false
+		}
+		failures--
+		return true
+	}
+
+	conn, err := grpc.Dial(
+		os.Getenv("PUBSUB_EMULATOR_HOST"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(func(
+			ctx context.Context,
+			calledMethod string,
+			req, reply interface{},
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			if shouldFail(calledMethod) {
+				return status.Error(code, "injected error")
+			}
+			return invoker(ctx, calledMethod, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(
+			ctx context.Context,
+			desc *grpc.StreamDesc,
+			cc *grpc.ClientConn,
+			calledMethod string,
+			streamer grpc.Streamer,
+			opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			if shouldFail(calledMethod) {
+				return nil, status.Error(code, "injected error")
+			}
+			return streamer(ctx, desc, cc, calledMethod, opts...)
+		}),
+	)
+	require.NoError(t, err)
+
+	return option.WithGRPCConn(conn)
+}
+
+// delayCalls returns a client option connecting to the emulator which delays the calls of the unary gRPC method.
+func delayCalls(t *testing.T, method string, delay time.Duration) option.ClientOption {
+	conn, err := grpc.Dial(
+		os.Getenv("PUBSUB_EMULATOR_HOST"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(func(
+			ctx context.Context,
+			calledMethod string,
+			req, reply interface{},
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			if calledMethod == method {
+				time.Sleep(delay)
+			}
+			return invoker(ctx, calledMethod, req, reply, cc, opts...)
+		}),
+	)
+	require.NoError(t, err)
+
+	return option.WithGRPCConn(conn)
+}
+
+func TestSubscriber_subscription_exists_errors(t *testing.T) {
+	testCases := []struct {
+		Name         string
+		Code         codes.Code
+		ExpectedErr  error
+		ExpectedCode codes.Code
+	}{
+		{
+			Name:        "permission_denied",
+			Code:        codes.PermissionDenied,
+			ExpectedErr: googlecloud.ErrPermissionDenied,
+		},
+		{
+			Name:        "not_found",
+			Code:        codes.NotFound,
+			ExpectedErr: googlecloud.ErrSubscriptionDoesNotExist,
+		},
+		{
+			Name:         "other",
+			Code:         codes.FailedPrecondition,
+			ExpectedCode: codes.FailedPrecondition,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+				ProjectID:                        testProjectID,
+				CreateTopicIfMissing:             true,
+				DoNotCreateSubscriptionIfMissing: true,
+				ClientOptions: []option.ClientOption{
+					failFirstCalls(t, "/google.pubsub.v1.Subscriber/GetSubscription", tc.Code, 1),
+				},
+			}, watermill.NewStdLogger(true, true))
+			require.NoError(t, err)
+			defer sub.Close()
+
+			err = sub.SubscribeInitialize("subscription_exists_errors_" + watermill.NewShortUUID())
+			require.Error(t, err)
+
+			if tc.ExpectedErr != nil {
+				assert.True(t, errors.Is(err, tc.ExpectedErr), "unexpected error: %v", err)
+			} else {
+				assert.Equal(t, tc.ExpectedCode, status.Code(errors.Cause(err)), "unexpected error: %v", err)
+				assert.False(t, errors.Is(err, googlecloud.ErrPermissionDenied))
+			}
+		})
+	}
+}
+
+func TestSubscriber_create_retry_policy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const createSubscription = "/google.pubsub.v1.Subscriber/CreateSubscription"
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		ClientOptions:        []option.ClientOption{failFirstCalls(t, createSubscription, codes.Internal, 1)},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	err = sub.SubscribeInitialize("create_retry_policy_" + watermill.NewShortUUID())
+	require.Error(t, err)
+	assert.Equal(t, codes.Internal, status.Code(errors.Cause(err)))
+
+	sub, err = googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		CreateRetryPolicy: googlecloud.CreateRetryPolicy{
+			MaxAttempts: 3,
+			Interval:    time.Millisecond * 10,
+		},
+		ClientOptions: []option.ClientOption{failFirstCalls(t, createSubscription, codes.Internal, 2)},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	topic := "create_retry_policy_" + watermill.NewShortUUID()
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("message not received")
+	}
+}
+
+func TestSubscriber_create_topic_if_missing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "create_topic_if_missing_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID: testProjectID,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.Subscribe(ctx, topic)
+	assert.True(t, errors.Is(err, googlecloud.ErrTopicDoesNotExist), "topic should not be created by default: %v", err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:                 testProjectID,
+		DoNotCreateTopicIfMissing: true,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	exists, err := pub.TopicExists(ctx, topic)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	createSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer createSub.Close()
+
+	_, err = createSub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	exists, err = pub.TopicExists(ctx, topic)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestNewSubscriber_create_topic_if_missing_conflict(t *testing.T) {
+	_, err := googlecloud.NewSubscriber(context.Background(), googlecloud.SubscriberConfig{
+		ProjectID:                 testProjectID,
+		CreateTopicIfMissing:      true,
+		DoNotCreateTopicIfMissing: true,
+	}, watermill.NopLogger{})
+	assert.Error(t, err)
+}
+
+func TestSubscriber_Seek(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "seek_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		RetainAckedMessages:  true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	err = sub.Seek(ctx, topic, time.Now())
+	require.Equal(t, googlecloud.ErrSubscriptionDoesNotExist, errors.Cause(err))
+
+	err = sub.SeekToSnapshot(ctx, topic, "snapshot")
+	require.Equal(t, googlecloud.ErrSubscriptionDoesNotExist, errors.Cause(err))
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	// the emulator doesn't keep the payload of messages redelivered after seeking,
+	// so only seeking itself is checked here
+	require.NoError(t, sub.Seek(ctx, topic, time.Now().Add(-time.Minute)))
+}
+
+func TestSubscriber_CreateSnapshot_DeleteSnapshot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "snapshot_" + watermill.NewShortUUID()
+	snapshotName := topic + "_snapshot"
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.CreateSnapshot(ctx, topic, snapshotName)
+	require.Equal(t, googlecloud.ErrSubscriptionDoesNotExist, errors.Cause(err))
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	expiration, err := sub.CreateSnapshot(ctx, topic, snapshotName)
+	if status.Code(errors.Cause(err)) == codes.Unimplemented {
+		t.Skip("snapshots are not supported by the emulator")
+	}
+	require.NoError(t, err)
+	assert.True(t, expiration.After(time.Now()))
+	assert.True(t, snapshotExists(t, ctx, snapshotName))
+
+	require.NoError(t, sub.SeekToSnapshot(ctx, topic, snapshotName))
+
+	require.NoError(t, sub.DeleteSnapshot(ctx, snapshotName))
+	assert.False(t, snapshotExists(t, ctx, snapshotName))
+}
+
+func snapshotExists(t *testing.T, ctx context.Context, snapshotName string) bool {
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	snapshots := client.Snapshots(ctx)
+	for {
+		snapshot, err := snapshots.Next()
+		if err == iterator.Done {
+			return false
+		}
+		require.NoError(t, err)
+
+		if snapshot.ID() == snapshotName {
+			return true
+		}
+	}
+}
+
+func TestSubscriber_max_concurrent_delivery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "max_concurrent_delivery_" + watermill.NewShortUUID()
+	maxConcurrentDelivery := 2
+	howManyMessages := 6
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:             testProjectID,
+		CreateTopicIfMissing:  true,
+		MaxConcurrentDelivery: maxConcurrentDelivery,
+		ReceiveSettings: pubsub.ReceiveSettings{
+			NumGoroutines: howManyMessages,
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, howManyMessages)
+
+	var inFlight []*message.Message
+	received := 0
+	for received < howManyMessages {
+		select {
+		case msg := <-messages:
+			received++
+			inFlight = append(inFlight, msg)
+			require.True(t, len(inFlight) <= maxConcurrentDelivery, "%d messages in flight", len(inFlight))
+		case <-time.After(time.Millisecond * 500):
+			require.Len(t, inFlight, maxConcurrentDelivery, "no messages delivered, but limit not reached")
+			inFlight[0].Ack()
+			inFlight = inFlight[1:]
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+
+	for _, msg := range inFlight {
+		msg.Ack()
+	}
+}
+
+func TestSubscriber_output_channel_buffer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "output_channel_buffer_" + watermill.NewShortUUID()
+	buffer := 5
+	metricsHook := newMetricsHookMock()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		OutputChannelBuffer:  buffer,
+		MetricsHook:          metricsHook,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, buffer+1)
+
+	// messages are received while the first one is processed
+	first := <-messages
+	assert.Eventually(t, func() bool {
+		return len(messages) == buffer
+	}, time.Second*5, time.Millisecond*10, "buffer should be filled while the handler is busy")
+	first.Ack()
+
+	require.NoError(t, sub.Close())
+
+	_, open := <-messages
+	assert.False(t, open, "buffered messages should not be consumed after Close")
+
+	metricsHook.lock.Lock()
+	defer metricsHook.lock.Unlock()
+	assert.Equal(t, 1, metricsHook.acked[topic])
+	assert.Equal(t, buffer, metricsHook.nacked[topic], "buffered messages should be nacked on Close")
+}
+
+type metricsHookMock struct {
+	lock            sync.Mutex
+	received        map[string]int
+	acked           map[string]int
+	nacked          map[string]int
+	unmarshalErrors map[string]int
+}
+
+func newMetricsHookMock() *metricsHookMock {
+	return &metricsHookMock{
+		received:        map[string]int{},
+		acked:           map[string]int{},
+		nacked:          map[string]int{},
+		unmarshalErrors: map[string]int{},
+	}
+}
+
+func (m *metricsHookMock) count(counts map[string]int, topic string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counts[topic]++
+}
+
+func (m *metricsHookMock) counts(topic string) (received, acked, nacked, unmarshalErrors int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.received[topic], m.acked[topic], m.nacked[topic], m.unmarshalErrors[topic]
+}
+
+func (m *metricsHookMock) OnReceive(topic string)                     { m.count(m.received, topic) }
+func (m *metricsHookMock) OnAck(topic string, elapsed time.Duration)  { m.count(m.acked, topic) }
+func (m *metricsHookMock) OnNack(topic string, elapsed time.Duration) { m.count(m.nacked, topic) }
+func (m *metricsHookMock) OnUnmarshalError(topic string, err error) {
+	m.count(m.unmarshalErrors, topic)
+}
+
+type failingUnmarshaler struct {
+	googlecloud.DefaultMarshalerUnmarshaler
+}
+
+func (u failingUnmarshaler) Unmarshal(pubsubMsg *pubsub.Message) (*message.Message, error) {
+	if pubsubMsg.Attributes["fail"] != "" {
+		return nil, errors.New("unmarshal failed")
+	}
+	return u.DefaultMarshalerUnmarshaler.Unmarshal(pubsubMsg)
+}
+
+func TestSubscriber_metrics_hook(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "metrics_hook_" + watermill.NewShortUUID()
+	metricsHook := newMetricsHookMock()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		MetricsHook:          metricsHook,
+		Unmarshaler:          failingUnmarshaler{},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	failingMsg := message.NewMessage(watermill.NewUUID(), []byte{})
+	failingMsg.Metadata.Set("fail", "true")
+	require.NoError(t, pub.Publish(topic, failingMsg, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	assert.Eventually(t, func() bool {
+		received, acked, nacked, unmarshalErrors := metricsHook.counts(topic)
+		return received >= 2 && acked == 1 && nacked >= 1 && unmarshalErrors >= 1
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestSubscriber_on_unmarshal_error(t *testing.T) {
+	testCases := []struct {
+		Name             string
+		OnUnmarshalError googlecloud.UnmarshalErrorAction
+		DeadLetterPolicy *googlecloud.DeadLetterPolicy
+		ExpectedAcked    bool
+	}{
+		{
+			Name:             "nack",
+			OnUnmarshalError: googlecloud.UnmarshalErrorNack,
+			ExpectedAcked:    false,
+		},
+		{
+			Name:             "ack",
+			OnUnmarshalError: googlecloud.UnmarshalErrorAck,
+			ExpectedAcked:    true,
+		},
+		{
+			Name:             "dead_letter",
+			OnUnmarshalError: googlecloud.UnmarshalErrorDeadLetter,
+			DeadLetterPolicy: &googlecloud.DeadLetterPolicy{
+				DeadLetterTopic:     "on_unmarshal_error_dead_letter_" + watermill.NewShortUUID(),
+				MaxDeliveryAttempts: 5,
+			},
+			ExpectedAcked: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			topic := "on_unmarshal_error_" + tc.Name + "_" + watermill.NewShortUUID()
+			metricsHook := newMetricsHookMock()
+
+			sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+				ProjectID:            testProjectID,
+				CreateTopicIfMissing: true,
+				OnUnmarshalError:     tc.OnUnmarshalError,
+				DeadLetterPolicy:     tc.DeadLetterPolicy,
+				MetricsHook:          metricsHook,
+				Unmarshaler:          failingUnmarshaler{},
+			}, watermill.NewStdLogger(true, true))
+			require.NoError(t, err)
+			defer sub.Close()
+
+			_, err = sub.Subscribe(ctx, topic)
+			require.NoError(t, err)
+
+			var deadLetterMessages <-chan *message.Message
+			if tc.DeadLetterPolicy != nil {
+				deadLetterSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+					ProjectID:            testProjectID,
+					CreateTopicIfMissing: true,
+				}, watermill.NewStdLogger(true, true))
+				require.NoError(t, err)
+				defer deadLetterSub.Close()
+
+				deadLetterMessages, err = deadLetterSub.Subscribe(ctx, tc.DeadLetterPolicy.DeadLetterTopic)
+				require.NoError(t, err)
+			}
+
+			pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+				ProjectID: testProjectID,
+			})
+			require.NoError(t, err)
+			defer pub.Close()
+
+			failingMsg := message.NewMessage(watermill.NewUUID(), []byte{})
+			failingMsg.Metadata.Set("fail", "true")
+			require.NoError(t, pub.Publish(topic, failingMsg))
+
+			if deadLetterMessages != nil {
+				select {
+				case msg := <-deadLetterMessages:
+					assert.Equal(t, failingMsg.UUID, msg.UUID)
+					msg.Ack()
+				case <-ctx.Done():
+					t.Fatal("Message not forwarded to the dead letter topic")
+				}
+			}
+
+			if tc.ExpectedAcked {
+				assert.Eventually(t, func() bool {
+					_, acked, _, _ := metricsHook.counts(topic)
+					return acked == 1
+				}, time.Second*5, time.Millisecond*10)
+
+				// give Pub/Sub the chance to redeliver the message
+				time.Sleep(time.Millisecond * 500)
+				_, _, nacked, unmarshalErrors := metricsHook.counts(topic)
+				assert.Equal(t, 0, nacked)
+				assert.Equal(t, 1, unmarshalErrors, "acked message should not be redelivered")
+			} else {
+				assert.Eventually(t, func() bool {
+					_, _, nacked, unmarshalErrors := metricsHook.counts(topic)
+					return nacked >= 2 && unmarshalErrors >= 2
+				}, time.Second*5, time.Millisecond*10, "nacked message should be redelivered")
+
+				_, acked, _, _ := metricsHook.counts(topic)
+				assert.Equal(t, 0, acked)
+			}
+		})
+	}
+}
+
+func TestSubscriber_message_log_fields(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "message_log_fields_" + watermill.NewShortUUID()
+	logger := watermill.NewCaptureLogger()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:             testProjectID,
+		CreateTopicIfMissing:  true,
+		EnableMessageOrdering: true,
+		OnUnmarshalError:      googlecloud.UnmarshalErrorAck,
+		Unmarshaler:           failingUnmarshaler{},
+	}, logger)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:             testProjectID,
+		EnableMessageOrdering: true,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	failingMsg := message.NewMessage(watermill.NewUUID(), []byte{})
+	failingMsg.Metadata.Set("fail", "true")
+	failingMsg.Metadata.Set(googlecloud.OrderingKeyMetadataKey, "ordering_key")
+	ids, err := pub.PublishWithResults(topic, failingMsg)
+	require.NoError(t, err)
+
+	expectedFields := watermill.LogFields{
+		"provider":          googlecloud.ProviderName,
+		"topic":             topic,
+		"subscription_name": topic,
+		"message_id":        ids[0],
+		"ordering_key":      "ordering_key",
+	}
+	assert.Eventually(t, func() bool {
+		for _, msg := range logger.Captured()[watermill.ErrorLogLevel] {
+			if msg.Msg == "Could not unmarshal Google Cloud PubSub message" {
+				return assert.Equal(t, expectedFields, msg.Fields)
+			}
+		}
+		return false
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestSubscriber_subscription_name_log_field(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "subscription_name_log_field_" + watermill.NewShortUUID()
+	logger := watermill.NewCaptureLogger()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                testProjectID,
+		CreateTopicIfMissing:     true,
+		GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix("_suffix"),
+	}, logger)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	assert.True(t, logger.Has(watermill.CapturedMessage{
+		Level: watermill.InfoLogLevel,
+		Fields: watermill.LogFields{
+			"provider":          googlecloud.ProviderName,
+			"topic":             topic,
+			"subscription_name": topic + "_suffix",
+		},
+		Msg: "Subscribing to Google Cloud PubSub topic",
+	}), "subscription_name should be the resolved subscription name")
+}
+
+func TestSubscriber_log_field_transforms(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "log_field_transforms_" + watermill.NewShortUUID()
+	logger := watermill.NewCaptureLogger()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		LogFieldTransforms: map[string]googlecloud.LogFieldFn{
+			"subscription_name": googlecloud.HashLogField,
+			"provider":          googlecloud.OmitLogField,
+		},
+	}, logger)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	hashedName := googlecloud.HashLogField(topic)
+	assert.NotEqual(t, topic, hashedName)
+	assert.Equal(t, hashedName, googlecloud.HashLogField(topic), "hash should be stable")
+
+	assert.True(t, logger.Has(watermill.CapturedMessage{
+		Level: watermill.InfoLogLevel,
+		Fields: watermill.LogFields{
+			"topic":             topic,
+			"subscription_name": hashedName,
+		},
+		Msg: "Subscribing to Google Cloud PubSub topic",
+	}))
+
+	for _, messages := range logger.Captured() {
+		for _, msg := range messages {
+			assert.NotContains(t, msg.Fields, "provider", "message %q", msg.Msg)
+			if name, ok := msg.Fields["subscription_name"]; ok {
+				assert.Equal(t, hashedName, name, "message %q", msg.Msg)
+			}
+		}
+	}
+}
+
+func TestSubscriber_unmarshal_error_handler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "unmarshal_error_handler_" + watermill.NewShortUUID()
+	metricsHook := newMetricsHookMock()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		MetricsHook:          metricsHook,
+		Unmarshaler:          failingUnmarshaler{},
+		UnmarshalErrorHandler: func(
+			pubsubMsg *pubsub.Message,
+			err error,
+		) (*message.Message, googlecloud.UnmarshalErrorAction) {
+			if pubsubMsg.Attributes["fail"] == "repairable" {
+				msg := message.NewMessage(pubsubMsg.Attributes[googlecloud.UUIDHeaderKey], []byte("repaired"))
+				return msg, googlecloud.UnmarshalErrorNack
+			}
+			return nil, googlecloud.UnmarshalErrorAck
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	unrepairableMsg := message.NewMessage(watermill.NewUUID(), []byte{})
+	unrepairableMsg.Metadata.Set("fail", "unrepairable")
+	repairableMsg := message.NewMessage(watermill.NewUUID(), []byte{})
+	repairableMsg.Metadata.Set("fail", "repairable")
+	require.NoError(t, pub.Publish(topic, unrepairableMsg, repairableMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, repairableMsg.UUID, msg.UUID)
+		assert.Equal(t, "repaired", string(msg.Payload))
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Repaired message not delivered")
+	}
+
+	assert.Eventually(t, func() bool {
+		_, acked, _, unmarshalErrors := metricsHook.counts(topic)
+		return acked == 2 && unmarshalErrors == 2
+	}, time.Second*5, time.Millisecond*10)
+	_, _, nacked, _ := metricsHook.counts(topic)
+	assert.Equal(t, 0, nacked)
+}
+
+func TestNewSubscriber_on_unmarshal_error_dead_letter_without_policy(t *testing.T) {
+	_, err := googlecloud.NewSubscriber(context.Background(), googlecloud.SubscriberConfig{
+		ProjectID:        testProjectID,
+		OnUnmarshalError: googlecloud.UnmarshalErrorDeadLetter,
+	}, watermill.NopLogger{})
+	assert.Error(t, err)
+}
+
+type tenantCtxKey struct{}
+
+func TestSubscriber_message_context_values(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "message_context_values_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	subscribeCtx := context.WithValue(ctx, tenantCtxKey{}, "tenant")
+	messages, err := sub.Subscribe(subscribeCtx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "tenant", msg.Context().Value(tenantCtxKey{}))
+		assert.NoError(t, msg.Context().Err())
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+}
+
+func TestSubscriber_cancel_subscribe_context(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic1 := "cancel_subscribe_context_1_" + watermill.NewShortUUID()
+	topic2 := "cancel_subscribe_context_2_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	subscribeCtx1, cancelSubscribe1 := context.WithCancel(ctx)
+	messages1, err := sub.Subscribe(subscribeCtx1, topic1)
+	require.NoError(t, err)
+
+	messages2, err := sub.Subscribe(ctx, topic2)
+	require.NoError(t, err)
+
+	cancelSubscribe1()
+
+	select {
+	case _, open := <-messages1:
+		require.False(t, open, "output channel of the canceled subscription should be closed")
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	produceMessages(t, ctx, topic2, 1)
+
+	select {
+	case msg, open := <-messages2:
+		require.True(t, open, "output channel of the other subscription should stay open")
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+}
+
+func TestSubscriber_update_subscription_if_exists(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "update_subscription_" + watermill.NewShortUUID()
+
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	pubsubTopic, err := client.CreateTopic(ctx, topic)
+	require.NoError(t, err)
+
+	_, err = client.CreateSubscription(ctx, topic, pubsub.SubscriptionConfig{
+		Topic:       pubsubTopic,
+		AckDeadline: time.Second * 10,
+	})
+	require.NoError(t, err)
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                  testProjectID,
+		CreateTopicIfMissing:       true,
+		AckDeadline:                time.Second * 30,
+		Labels:                     map[string]string{"team": "payments"},
+		UpdateSubscriptionIfExists: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	config := subscriptionConfig(t, ctx, topic)
+	assert.Equal(t, time.Second*30, config.AckDeadline)
+	assert.Equal(t, map[string]string{"team": "payments"}, config.Labels)
+}
+
+func TestSubscriber_update_subscription_if_exists_reconcile_fields(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "reconcile_fields_" + watermill.NewShortUUID()
+
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	pubsubTopic, err := client.CreateTopic(ctx, topic)
+	require.NoError(t, err)
+
+	_, err = client.CreateSubscription(ctx, topic, pubsub.SubscriptionConfig{
+		Topic:       pubsubTopic,
+		AckDeadline: time.Second * 10,
+		Labels:      map[string]string{"team": "tuned_manually"},
+	})
+	require.NoError(t, err)
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                  testProjectID,
+		AckDeadline:                time.Second * 30,
+		Labels:                     map[string]string{"team": "payments"},
+		UpdateSubscriptionIfExists: true,
+		ReconcileFields:            googlecloud.ReconcileAckDeadline,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	config := subscriptionConfig(t, ctx, topic)
+	assert.Equal(t, time.Second*30, config.AckDeadline)
+	assert.Equal(t, map[string]string{"team": "tuned_manually"}, config.Labels)
+}
+
+func TestSubscriber_SubscribeMulti(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	suffix := "_" + watermill.NewShortUUID()
+	topics := []string{"subscribe_multi_a" + suffix, "subscribe_multi_b" + suffix, "subscribe_multi_c" + suffix}
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	messages, err := sub.SubscribeMulti(ctx, topics...)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	expectedTopics := map[string]string{}
+	for _, topic := range topics {
+		for i := 0; i < 2; i++ {
+			msg := message.NewMessage(watermill.NewUUID(), []byte{})
+			require.NoError(t, pub.Publish(topic, msg))
+			expectedTopics[msg.UUID] = topic
+		}
+	}
+
+	receivedTopics := map[string]string{}
+	for len(receivedTopics) < len(expectedTopics) {
+		select {
+		case msg := <-messages:
+			topic := msg.Metadata.Get(googlecloud.TopicMetadataKey)
+			receivedTopics[msg.UUID] = topic
+			assert.Equal(t, topic, msg.Metadata.Get(googlecloud.SubscriptionMetadataKey))
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+	assert.Equal(t, expectedTopics, receivedTopics)
+
+	// all the subscriptions are finished on Close
+	require.NoError(t, sub.Close())
+	for range messages {
+		t.Fatal("unexpected message")
+	}
+	assert.Equal(t, 0, sub.Stats().ActiveSubscriptions)
+
+	_, err = sub.SubscribeMulti(ctx)
+	assert.Error(t, err)
+}
+
+func TestSubscriber_SubscribeMatching(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prefix := "subscribe_matching_" + watermill.NewShortUUID() + "_"
+	matchingTopics := []string{prefix + "a", prefix + "b", prefix + "c"}
+	otherTopic := "other_" + prefix
+
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, topic := range append(matchingTopics, otherTopic) {
+		_, err := client.CreateTopic(ctx, topic)
+		require.NoError(t, err)
+	}
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID: testProjectID,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	subscribeCtx, cancelSubscribe := context.WithCancel(ctx)
+	messages, err := sub.SubscribeMatching(subscribeCtx, prefix)
+	require.NoError(t, err)
+
+	// messages of the other topic are delivered only by its own subscription
+	otherMessages, err := sub.Subscribe(ctx, otherTopic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	expected := map[string]bool{}
+	for _, topic := range matchingTopics {
+		msg := message.NewMessage(watermill.NewUUID(), []byte{})
+		require.NoError(t, pub.Publish(topic, msg))
+		expected[msg.UUID] = true
+	}
+	otherMsg := message.NewMessage(watermill.NewUUID(), []byte{})
+	require.NoError(t, pub.Publish(otherTopic, otherMsg))
+
+	received := map[string]bool{}
+	for len(received) < len(expected) {
+		select {
+		case msg := <-messages:
+			received[msg.UUID] = true
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+	assert.Equal(t, expected, received)
+
+	select {
+	case msg := <-otherMessages:
+		assert.Equal(t, otherMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	// the merged channel is closed once the subscriptions are finished
+	cancelSubscribe()
+	for range messages {
+		t.Fatal("unexpected message")
+	}
+
+	_, err = sub.SubscribeMatching(ctx, "no_topic_"+prefix)
+	assert.True(t, errors.Is(err, googlecloud.ErrTopicDoesNotExist), "unexpected error: %v", err)
+}
+
+func TestPublishSubscribe_grpc_dial_options(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var calls int64
+	countCalls := grpc.WithChainUnaryInterceptor(func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		atomic.AddInt64(&calls, 1)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:              testProjectID,
+		CreateTopicIfMissing:   true,
+		GRPCConnectionPoolSize: 2,
+		GRPCDialOptions:        []grpc.DialOption{countCalls},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize("grpc_dial_options_"+watermill.NewShortUUID()))
+	assert.NotZero(t, atomic.LoadInt64(&calls), "dial options should be applied")
+}
+
+func TestSubscriber_delivery_attempt_metadata(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "delivery_attempt_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		// Pub/Sub provides the delivery attempt only for subscriptions with a dead letter policy
+		DeadLetterPolicy: &googlecloud.DeadLetterPolicy{
+			DeadLetterTopic:     topic + "_dead_letter",
+			MaxDeliveryAttempts: 5,
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	for _, expectedAttempt := range []string{"1", "2"} {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, expectedAttempt, msg.Metadata.Get(googlecloud.DeliveryAttemptMetadataKey))
+			if expectedAttempt == "1" {
+				msg.Nack()
+			} else {
+				msg.Ack()
+			}
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+}
+
+func TestPubSub_concurrent_close(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	_, err = sub.Subscribe(ctx, "concurrent_close_"+watermill.NewShortUUID())
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, sub.Close())
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, pub.Close())
+		}()
+	}
+	wg.Wait()
+
+	assert.NoError(t, sub.Close())
+	assert.NoError(t, pub.Close())
+}
+
+func TestSubscriber_rate_limit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "rate_limit_" + watermill.NewShortUUID()
+	rateLimit := googlecloud.RateLimit{MessagesPerSecond: 20, Burst: 5}
+	const messagesCount = 25
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		RateLimit:            &rateLimit,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+	produceMessages(t, ctx, topic, messagesCount)
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	started := time.Now()
+	for i := 0; i < messagesCount; i++ {
+		select {
+		case msg := <-messages:
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+
+	// the burst is delivered at once, the rest at most at the configured rate
+	minDuration := time.Duration(float64(messagesCount-rateLimit.Burst) / rateLimit.MessagesPerSecond * float64(time.Second))
+	assert.GreaterOrEqual(t, int64(time.Since(started)), int64(minDuration*9/10), "delivered too fast")
+}
+
+func TestSubscriber_Pause_Resume(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "pause_resume_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	sub.Pause(topic)
+	produceMessages(t, ctx, topic, 3)
+
+	select {
+	case <-messages:
+		t.Fatal("message delivered while paused")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	sub.Resume(topic)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-messages:
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("messages not delivered after resume")
+		}
+	}
+
+	// resuming again does nothing
+	sub.Resume(topic)
+}
+
+func TestSubscriber_delivery_not_blocked_by_subscribing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	topic := "delivery_not_blocked_" + watermill.NewShortUUID()
+	otherTopic := "delivery_not_blocked_other_" + watermill.NewShortUUID()
+
+	// checking if the subscription exists is slow, which is done while subscribing
+	const subscriptionExistsDelay = time.Second * 3
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		ClientOptions:        []option.ClientOption{delayCalls(t, "/google.pubsub.v1.Subscriber/GetSubscription", subscriptionExistsDelay)},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	// the client library gets the subscription config before receiving, so wait until receiving started
+	produceMessages(t, ctx, topic, 1)
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("message not delivered")
+	}
+
+	subscribed := make(chan struct{})
+	go func() {
+		defer close(subscribed)
+		_, err := sub.Subscribe(ctx, otherTopic)
+		assert.NoError(t, err)
+	}()
+
+	// wait for the other Subscribe to be checking if its subscription exists
+	time.Sleep(time.Millisecond * 200)
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-subscribed:
+		t.Fatal("message not delivered while subscribing to another topic")
+	case <-ctx.Done():
+		t.Fatal("message not delivered")
+	}
+
+	<-subscribed
+}
+
+func TestDeadLetterForwarder_Redrive(t *testing.T) {
+	// a message nacked while its subscription stops may be redelivered only after its ack deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	topic := "redrive_" + watermill.NewShortUUID()
+	deadLetterTopic := topic + "_dead_letter"
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		DeadLetterPolicy: &googlecloud.DeadLetterPolicy{
+			DeadLetterTopic:     deadLetterTopic,
+			MaxDeliveryAttempts: 5,
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	deadLetterSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer deadLetterSub.Close()
+
+	// messages are delivered only to the subscriptions existing when they are dead lettered
+	require.NoError(t, deadLetterSub.SubscribeInitialize(deadLetterTopic))
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	redrivenMsg := message.NewMessage(watermill.NewUUID(), []byte("redriven"))
+	redrivenMsg.Metadata.Set("foo", "bar")
+	skippedMsg := message.NewMessage(watermill.NewUUID(), []byte("skipped"))
+	require.NoError(t, pub.Publish(topic, redrivenMsg, skippedMsg))
+
+	deadLettered := 0
+	for deadLettered < 2 {
+		select {
+		case msg := <-messages:
+			if msg.Metadata.Get(googlecloud.DeliveryAttemptMetadataKey) == "5" {
+				deadLettered++
+			}
+			msg.Nack()
+		case <-ctx.Done():
+			t.Fatal("messages not dead lettered")
+		}
+	}
+
+	forwarder, err := googlecloud.NewDeadLetterForwarder(deadLetterSub, pub, googlecloud.DeadLetterForwarderConfig{
+		IdleTimeout: time.Second,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	redriven, err := forwarder.Redrive(ctx, deadLetterTopic, topic, func(msg *message.Message) bool {
+		return msg.UUID == redrivenMsg.UUID
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, redriven)
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, redrivenMsg.UUID, msg.UUID)
+		assert.Equal(t, redrivenMsg.Payload, msg.Payload)
+		assert.Equal(t, "bar", msg.Metadata.Get("foo"))
+		assert.Equal(t, "1", msg.Metadata.Get(googlecloud.DeliveryAttemptMetadataKey))
+		for k := range msg.Metadata {
+			assert.NotContains(t, k, "CloudPubSubDeadLetter")
+		}
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("message not redriven")
+	}
+
+	// the skipped message stays in the dead letter topic
+	deadLetterMessages, err := deadLetterSub.Subscribe(ctx, deadLetterTopic)
+	require.NoError(t, err)
+
+	select {
+	case msg := <-deadLetterMessages:
+		assert.Equal(t, skippedMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("skipped message not left in the dead letter topic")
+	}
+}
+
+func TestDeadLetterForwarder_Redrive_skipped_messages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	topic := "redrive_skipped_" + watermill.NewShortUUID()
+	deadLetterTopic := topic + "_dead_letter"
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	metricsHook := newMetricsHookMock()
+	deadLetterSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		MetricsHook:          metricsHook,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer deadLetterSub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+	require.NoError(t, deadLetterSub.SubscribeInitialize(deadLetterTopic))
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	// the messages which are not selected come first
+	var deadLettered []*message.Message
+	selected := map[string]struct{}{}
+	for i := 0; i < 10; i++ {
+		deadLettered = append(deadLettered, message.NewMessage(watermill.NewUUID(), []byte("skipped")))
+	}
+	for i := 0; i < 5; i++ {
+		msg := message.NewMessage(watermill.NewUUID(), []byte("selected"))
+		deadLettered = append(deadLettered, msg)
+		selected[msg.UUID] = struct{}{}
+	}
+	require.NoError(t, pub.Publish(deadLetterTopic, deadLettered...))
+
+	forwarder, err := googlecloud.NewDeadLetterForwarder(deadLetterSub, pub, googlecloud.DeadLetterForwarderConfig{
+		IdleTimeout: time.Millisecond * 500,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	redriven, err := forwarder.Redrive(ctx, deadLetterTopic, topic, func(msg *message.Message) bool {
+		_, ok := selected[msg.UUID]
+		return ok
+	})
+	require.NoError(t, err)
+	assert.Equal(t, len(selected), redriven)
+
+	// the skipped messages were not nacked and redelivered while redriving
+	deliveries, _, _, _ := metricsHook.counts(deadLetterTopic)
+	assert.Equal(t, len(deadLettered), deliveries)
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	received := map[string]struct{}{}
+	for len(received) < len(selected) {
+		select {
+		case msg := <-messages:
+			assert.Contains(t, selected, msg.UUID)
+			received[msg.UUID] = struct{}{}
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatalf("only %d of %d selected messages redriven", len(received), len(selected))
+		}
+	}
+}
+
+func TestSubscriber_Stats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "stats_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	assert.Equal(t, 0, sub.Stats().ActiveSubscriptions)
+
+	subscribeCtx, cancelSubscribe := context.WithCancel(ctx)
+	messages, err := sub.Subscribe(subscribeCtx, topic)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sub.Stats().ActiveSubscriptions)
+
+	produceMessages(t, ctx, topic, 2)
+
+	var held []*message.Message
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			held = append(held, msg)
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+
+	assert.Equal(t, 2, sub.Stats().InFlightMessages[topic])
+
+	held[0].Ack()
+	assert.Eventually(t, func() bool {
+		return sub.Stats().InFlightMessages[topic] == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	held[1].Nack()
+	assert.Eventually(t, func() bool {
+		_, ok := sub.Stats().InFlightMessages[topic]
+		return !ok
+	}, time.Second*5, time.Millisecond*10)
+
+	cancelSubscribe()
+	assert.Eventually(t, func() bool {
+		return sub.Stats().ActiveSubscriptions == 0
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestSubscriber_Drain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "drain_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	var inFlight *message.Message
+	select {
+	case inFlight = <-messages:
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- sub.Drain(ctx)
+	}()
+
+	select {
+	case <-drained:
+		t.Fatal("Drain should wait for the in-flight message")
+	case <-time.After(time.Millisecond * 500):
+	}
+	assert.NoError(t, inFlight.Context().Err(), "in-flight message should not be canceled")
+
+	inFlight.Ack()
+	select {
+	case err := <-drained:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("Drain not finished after the message was acked")
+	}
+
+	_, open := <-messages
+	assert.False(t, open, "output channel should be closed")
+
+	messages, err = sub.Subscribe(ctx, topic)
+	require.NoError(t, err, "Subscribe should work after Drain")
+
+	produceMessages(t, ctx, topic, 1)
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("message not received after Drain")
+	}
+}
+
+func TestSubscriber_Drain_timeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "drain_timeout_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	var inFlight *message.Message
+	select {
+	case inFlight = <-messages:
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+	inFlightCtx := inFlight.Context()
+
+	drainCtx, cancelDrain := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancelDrain()
+
+	err = sub.Drain(drainCtx)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	assert.Error(t, inFlightCtx.Err(), "in-flight message should be canceled")
+
+	_, open := <-messages
+	assert.False(t, open, "output channel should be closed")
+
+	require.NoError(t, sub.Close())
+	assert.Equal(t, googlecloud.ErrSubscriberClosed, sub.Drain(ctx))
+}
+
+func TestSubscriber_ack_and_nack(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "ack_and_nack_" + watermill.NewShortUUID()
+	metricsHook := newMetricsHookMock()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                 testProjectID,
+		CreateTopicIfMissing:      true,
+		EnableExactlyOnceDelivery: true,
+		MetricsHook:               metricsHook,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case msg := <-messages:
+		assert.True(t, msg.Ack())
+		assert.False(t, msg.Nack(), "nack after ack should be ignored")
+		assert.True(t, msg.Ack())
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	assert.Eventually(t, func() bool {
+		_, acked, _, _ := metricsHook.counts(topic)
+		return acked == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	select {
+	case <-messages:
+		t.Fatal("acked message should not be redelivered")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	received, acked, nacked, _ := metricsHook.counts(topic)
+	assert.Equal(t, 1, received)
+	assert.Equal(t, 1, acked)
+	assert.Equal(t, 0, nacked)
+}
+
+func TestSubscriber_SubscribeN(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "subscribe_n_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		// messages leased by the client library but not delivered when stopping are redelivered
+		// only after the ack deadline
+		ReceiveSettings: pubsub.ReceiveSettings{MaxOutstandingMessages: 1},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+	produceMessages(t, ctx, topic, 5)
+
+	_, err = sub.SubscribeN(ctx, topic, 0)
+	require.Error(t, err)
+
+	messages, err := sub.SubscribeN(ctx, topic, 3)
+	require.NoError(t, err)
+
+	delivered := map[string]struct{}{}
+	nacked := false
+	for msg := range messages {
+		if !nacked {
+			// nacked messages don't count
+			nacked = true
+			msg.Nack()
+			continue
+		}
+		delivered[msg.UUID] = struct{}{}
+		msg.Ack()
+	}
+	require.NoError(t, ctx.Err(), "channel should be closed before timeout")
+	assert.Len(t, delivered, 3)
+
+	// the subscription is finished, so the remaining messages can be received again
+	messages, err = sub.SubscribeN(ctx, topic, 2)
+	require.NoError(t, err)
+
+	for msg := range messages {
+		_, ok := delivered[msg.UUID]
+		assert.False(t, ok, "acked message %s delivered again", msg.UUID)
+		msg.Ack()
+	}
+	require.NoError(t, ctx.Err(), "channel should be closed before timeout")
+}
+
+func TestSubscriber_origin_metadata(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "origin_metadata_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                testProjectID,
+		GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix("_origin"),
+		CreateTopicIfMissing:     true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	optedOutSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                testProjectID,
+		GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix("_opted_out"),
+		CreateTopicIfMissing:     true,
+		DisableOriginMetadata:    true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer optedOutSub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	optedOutMessages, err := optedOutSub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, topic+"_origin", msg.Metadata.Get(googlecloud.SubscriptionMetadataKey))
+		assert.Equal(t, topic, msg.Metadata.Get(googlecloud.TopicMetadataKey))
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	select {
+	case msg := <-optedOutMessages:
+		assert.NotContains(t, msg.Metadata, googlecloud.SubscriptionMetadataKey)
+		assert.NotContains(t, msg.Metadata, googlecloud.TopicMetadataKey)
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+}
+
+func TestSubscriber_routing_key_attribute(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "routing_key_attribute_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		RoutingKeyAttribute:  "event_type",
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	withRoutingKey := message.NewMessage(watermill.NewUUID(), []byte{})
+	withRoutingKey.Metadata.Set("event_type", "OrderPlaced")
+	require.NoError(t, pub.Publish(topic, withRoutingKey))
+
+	withoutRoutingKey := message.NewMessage(watermill.NewUUID(), []byte{})
+	require.NoError(t, pub.Publish(topic, withoutRoutingKey))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			if msg.UUID == withRoutingKey.UUID {
+				assert.Equal(t, "OrderPlaced", msg.Metadata.Get(googlecloud.RoutingKeyMetadataKey))
+			} else {
+				assert.NotContains(t, msg.Metadata, googlecloud.RoutingKeyMetadataKey)
+			}
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+}
+
+func TestSubscriber_delivery_timeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "delivery_timeout_" + watermill.NewShortUUID()
+	metricsHook := newMetricsHookMock()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		DeliveryTimeout:      time.Millisecond * 200,
+		MetricsHook:          metricsHook,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	// nothing reads the output channel, so the message is nacked
+	assert.Eventually(t, func() bool {
+		_, _, nacked, _ := metricsHook.counts(topic)
+		return nacked >= 1
+	}, time.Second*5, time.Millisecond*10)
+
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("nacked message should be redelivered")
+	}
+
+	_, err = googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:       testProjectID,
+		DeliveryTimeout: -time.Second,
+	}, watermill.NopLogger{})
+	assert.Error(t, err)
+}
+
+func TestSubscriber_Plan(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "plan_" + watermill.NewShortUUID()
+	subscriptionName := googlecloud.TopicSubscriptionName(topic)
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	steps, err := sub.Plan(ctx, topic, topic)
+	require.NoError(t, err)
+	assert.Equal(t, []googlecloud.PlanStep{
+		{Type: googlecloud.PlannedTopic, Name: topic, Action: googlecloud.PlanCreate},
+		{Type: googlecloud.PlannedSubscription, Name: subscriptionName, Action: googlecloud.PlanCreate},
+	}, steps)
+
+	exists, err := sub.SubscriptionExists(ctx, topic)
+	require.NoError(t, err)
+	assert.False(t, exists, "Plan should not create the subscription")
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	steps, err = sub.Plan(ctx, topic)
+	require.NoError(t, err)
+	assert.Equal(t, []googlecloud.PlanStep{
+		{Type: googlecloud.PlannedSubscription, Name: subscriptionName, Action: googlecloud.PlanExists},
+	}, steps)
+
+	updatingSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                  testProjectID,
+		UpdateSubscriptionIfExists: true,
+		AckDeadline:                time.Second * 42,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer updatingSub.Close()
+
+	steps, err = updatingSub.Plan(ctx, topic)
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.Equal(t, googlecloud.PlanUpdate, steps[0].Action)
+	assert.Equal(t, time.Second*42, steps[0].Update.AckDeadline)
+
+	config := subscriptionConfig(t, ctx, subscriptionName)
+	assert.NotEqual(t, time.Second*42, config.AckDeadline, "Plan should not update the subscription")
+
+	missingTopic := "plan_missing_" + watermill.NewShortUUID()
+	notCreatingSub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID: testProjectID,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer notCreatingSub.Close()
+
+	steps, err = notCreatingSub.Plan(ctx, missingTopic)
+	require.NoError(t, err)
+	assert.Equal(t, []googlecloud.PlanStep{
+		{Type: googlecloud.PlannedTopic, Name: missingTopic, Action: googlecloud.PlanMissing},
+		{
+			Type:   googlecloud.PlannedSubscription,
+			Name:   googlecloud.TopicSubscriptionName(missingTopic),
+			Action: googlecloud.PlanMissing,
+		},
+	}, steps)
+}
+
+func TestPublisher_PublishWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID: testProjectID,
+		ClientOptions: []option.ClientOption{
+			delayCalls(t, "/google.pubsub.v1.Publisher/Publish", time.Millisecond*500),
+		},
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	topic := "publish_with_context_" + watermill.NewShortUUID()
+	require.NoError(t, pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	publishCtx, publishCancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer publishCancel()
+
+	notConfirmed := message.NewMessage(watermill.NewUUID(), []byte{})
+	notPublished := message.NewMessage(watermill.NewUUID(), []byte{})
+
+	err = pub.PublishWithContext(publishCtx, topic, notConfirmed, notPublished)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	assert.Contains(t, err.Error(), notConfirmed.UUID)
+
+	assert.NoError(t, pub.PublishWithContext(ctx, topic, notPublished))
+}
+
+func TestSubscriber_OldestInFlight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "oldest_in_flight_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	assert.Equal(t, time.Duration(0), sub.OldestInFlight(topic))
+
+	produceMessages(t, ctx, topic, 1)
+
+	var held *message.Message
+	select {
+	case held = <-messages:
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	// the message is held, as if its handler was stuck
+	first := sub.OldestInFlight(topic)
+	time.Sleep(time.Millisecond * 200)
+	second := sub.OldestInFlight(topic)
+	assert.Greater(t, second, first)
+	assert.GreaterOrEqual(t, second, time.Millisecond*200)
+
+	held.Ack()
+	assert.Eventually(t, func() bool {
+		return sub.OldestInFlight(topic) == 0
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestSubscriber_max_delivery_attempts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "max_delivery_attempts_" + watermill.NewShortUUID()
+	metricsHook := newMetricsHookMock()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		MaxDeliveryAttempts:  3,
+		MetricsHook:          metricsHook,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	// the subscription has no dead letter policy, so the deliveries are counted by Subscriber
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-messages:
+			msg.Nack()
+		case <-ctx.Done():
+			t.Fatal("Test timed out")
+		}
+	}
+
+	assert.Eventually(t, func() bool {
+		_, acked, _, _ := metricsHook.counts(topic)
+		return acked == 1
+	}, time.Second*5, time.Millisecond*10, "message should be dropped after 3 delivery attempts")
+
+	select {
+	case <-messages:
+		t.Fatal("dropped message should not be delivered")
+	case <-time.After(time.Millisecond * 500):
+	}
+}
+
+func TestSubscriber_Close_closes_all_subscriptions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	var outputs []<-chan *message.Message
+	for i := 0; i < 5; i++ {
+		messages, err := sub.Subscribe(ctx, fmt.Sprintf("close_all_%d_%s", i, watermill.NewShortUUID()))
+		require.NoError(t, err)
+		outputs = append(outputs, messages)
+	}
+
+	require.NoError(t, sub.Close())
+
+	for i, messages := range outputs {
+		select {
+		case _, ok := <-messages:
+			assert.False(t, ok, "output channel %d should be closed", i)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("output channel %d not closed", i)
+		}
+	}
+}
+
+func TestSubscriber_SubscribeWithHandle_Unsubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	unsubscribedTopic := "unsubscribe_" + watermill.NewShortUUID()
+	keptTopic := "unsubscribe_kept_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	unsubscribed, err := sub.SubscribeWithHandle(ctx, unsubscribedTopic)
+	require.NoError(t, err)
+	kept, err := sub.SubscribeWithHandle(ctx, keptTopic)
+	require.NoError(t, err)
+
+	unsubscribed.Unsubscribe()
+
+	select {
+	case <-unsubscribed.Done():
+	default:
+		t.Fatal("subscription should be done after Unsubscribe returns")
+	}
+	select {
+	case _, ok := <-unsubscribed.Messages():
+		assert.False(t, ok, "output channel should be closed")
+	default:
+		t.Fatal("output channel not closed")
+	}
+
+	// calling it again doesn't block
+	unsubscribed.Unsubscribe()
+
+	produceMessages(t, ctx, keptTopic, 1)
+
+	select {
+	case msg, ok := <-kept.Messages():
+		require.True(t, ok, "output channel of other subscription should stay open")
+		msg.Ack()
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not delivered to other subscription")
+	}
+
+	select {
+	case <-kept.Done():
+		t.Fatal("other subscription should not be done")
+	default:
+	}
+}
+
+func TestSubscriber_message_processing_timeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	topic := "message_processing_timeout_" + watermill.NewShortUUID()
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:                testProjectID,
+		CreateTopicIfMissing:     true,
+		MessageProcessingTimeout: time.Millisecond * 200,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	var slowUUID string
+	select {
+	case msg := <-messages:
+		slowUUID = msg.UUID
+		msgCtx := msg.Context()
+
+		deadline, ok := msgCtx.Deadline()
+		require.True(t, ok, "message context should have a deadline")
+		assert.WithinDuration(t, time.Now().Add(time.Millisecond*200), deadline, time.Millisecond*200)
+
+		// the handler is too slow to ack
+		select {
+		case <-msgCtx.Done():
+			assert.Equal(t, context.DeadlineExceeded, msgCtx.Err())
+		case <-ctx.Done():
+			t.Fatal("message context should time out")
+		}
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, slowUUID, msg.UUID, "timed out message should be redelivered")
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("timed out message not redelivered")
+	}
+}
+
+func TestSubscriber_handler_longer_than_several_ack_deadlines(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits past several ack deadlines")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	topic := "handler_longer_than_several_ack_deadlines_" + watermill.NewShortUUID()
+	ackDeadline := time.Second * 10
+
+	sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		AckDeadline:          ackDeadline,
+		ReceiveSettings: pubsub.ReceiveSettings{
+			MaxExtension: time.Minute,
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, ctx, topic, 1)
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	// the handler works in steps for a few ack deadlines, without extending the deadline itself,
+	// the client library keeps extending it until the message is acked
+	for i := 0; i < 5; i++ {
+		time.Sleep(ackDeadline / 2)
+		require.NoError(t, msg.Context().Err())
+	}
+	msg.Ack()
+
+	select {
+	case redelivered := <-messages:
+		t.Fatalf("message %s should not be redelivered, the ack deadline should be extended", redelivered.UUID)
+	case <-time.After(ackDeadline):
+	}
+}
+
+func TestPublishSubscribe_created_callbacks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var lock sync.Mutex
+	var createdTopics, createdSubscriptions []string
+	onTopicCreated := func(topic string) {
+		lock.Lock()
+		defer lock.Unlock()
+		createdTopics = append(createdTopics, topic)
+	}
+	onSubscriptionCreated := func(subscription string) {
+		lock.Lock()
+		defer lock.Unlock()
+		createdSubscriptions = append(createdSubscriptions, subscription)
+	}
+	created := func() ([]string, []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, createdTopics...), append([]string{}, createdSubscriptions...)
+	}
+
+	topic := "created_callbacks_" + watermill.NewShortUUID()
+	newSubscriber := func() *googlecloud.Subscriber {
+		sub, err := googlecloud.NewSubscriber(ctx, googlecloud.SubscriberConfig{
+			ProjectID:             testProjectID,
+			CreateTopicIfMissing:  true,
+			OnTopicCreated:        onTopicCreated,
+			OnSubscriptionCreated: onSubscriptionCreated,
+		}, watermill.NewStdLogger(true, true))
+		require.NoError(t, err)
+		return sub
+	}
+
+	sub := newSubscriber()
+	defer sub.Close()
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	topics, subscriptions := created()
+	assert.Equal(t, []string{topic}, topics)
+	assert.Equal(t, []string{googlecloud.TopicSubscriptionName(topic)}, subscriptions)
+
+	// the topic and the subscription exist already
+	otherSub := newSubscriber()
+	defer otherSub.Close()
+	require.NoError(t, otherSub.SubscribeInitialize(topic))
+
+	pub, err := googlecloud.NewPublisher(ctx, googlecloud.PublisherConfig{
+		ProjectID:      testProjectID,
+		OnTopicCreated: onTopicCreated,
+	})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	require.NoError(t, pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	topics, subscriptions = created()
+	assert.Equal(t, []string{topic}, topics, "existing topic should not be reported")
+	assert.Len(t, subscriptions, 1, "existing subscription should not be reported")
+
+	publishedTopic := "created_callbacks_published_" + watermill.NewShortUUID()
+	require.NoError(t, pub.Publish(publishedTopic, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	topics, _ = created()
+	assert.Equal(t, []string{topic, publishedTopic}, topics)
+}
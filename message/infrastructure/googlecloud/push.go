@@ -0,0 +1,175 @@
+package googlecloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ErrPushSubscription happens when trying to receive messages from a push subscription.
+// Messages of push subscriptions are delivered by Pub/Sub via HTTP, use `PushHandler` to receive them.
+var ErrPushSubscription = errors.New("push subscriptions are delivered via HTTP, Subscriber only supports pull")
+
+// PushHandlerConfig configures `PushHandler`.
+type PushHandlerConfig struct {
+	// Unmarshaler transforms the pushed message into watermill/message.Message.
+	// Defaults to `DefaultMarshalerUnmarshaler`.
+	Unmarshaler Unmarshaler
+}
+
+func (c *PushHandlerConfig) setDefaults() {
+	if c.Unmarshaler == nil {
+		c.Unmarshaler = DefaultMarshalerUnmarshaler{}
+	}
+}
+
+// PushHandler is an http.Handler receiving messages pushed by Pub/Sub to the endpoint of a push subscription
+// (see SubscriberConfig.PushConfig) and sending them to the channel returned by Messages.
+//
+// The request is answered when the message is acked (with 204 No Content) or nacked (with 500 Internal Server Error),
+// Pub/Sub redelivers nacked messages.
+//
+// See https://cloud.google.com/pubsub/docs/push to find out more about push subscriptions.
+type PushHandler struct {
+	config PushHandlerConfig
+	logger watermill.LoggerAdapter
+
+	messages chan *message.Message
+
+	closing    chan struct{}
+	closed     bool
+	closedLock sync.Mutex
+	requestsWg sync.WaitGroup
+}
+
+// NewPushHandler creates a PushHandler. Register it as the handler of the push endpoint on an HTTP server.
+func NewPushHandler(config PushHandlerConfig, logger watermill.LoggerAdapter) *PushHandler {
+	config.setDefaults()
+
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	return &PushHandler{
+		config:   config,
+		logger:   logger,
+		messages: make(chan *message.Message),
+		closing:  make(chan struct{}),
+	}
+}
+
+// pushRequest is the body of requests sent by Pub/Sub to push endpoints.
+type pushRequest struct {
+	Message struct {
+		Attributes  map[string]string `json:"attributes"`
+		Data        []byte            `json:"data"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt *int   `json:"deliveryAttempt"`
+}
+
+// Messages returns the channel with pushed messages. It is closed by Close.
+func (h *PushHandler) Messages() <-chan *message.Message {
+	return h.messages
+}
+
+func (h *PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.closedLock.Lock()
+	if h.closed {
+		h.closedLock.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	h.requestsWg.Add(1)
+	h.closedLock.Unlock()
+	defer h.requestsWg.Done()
+
+	logFields := watermill.LogFields{"provider": ProviderName}
+
+	req := pushRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Info("Cannot decode push request", logFields.Add(watermill.LogFields{"err": err}))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logFields = logFields.Add(watermill.LogFields{
+		"subscription_name": req.Subscription,
+		"message_id":        req.Message.MessageID,
+	})
+
+	msg, err := h.config.Unmarshaler.Unmarshal(&pubsub.Message{
+		ID:              req.Message.MessageID,
+		Data:            req.Message.Data,
+		Attributes:      req.Message.Attributes,
+		PublishTime:     req.Message.PublishTime,
+		DeliveryAttempt: req.DeliveryAttempt,
+		OrderingKey:     req.Message.OrderingKey,
+	})
+	if err != nil {
+		h.logger.Info("Cannot unmarshal pushed message", logFields.Add(watermill.LogFields{"err": err}))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logFields = logFields.Add(watermill.LogFields{"message_uuid": msg.UUID})
+
+	msg.SetContext(r.Context())
+
+	select {
+	case h.messages <- msg:
+		h.logger.Trace("Message sent to consumer", logFields)
+	case <-h.closing:
+		h.logger.Trace("Closing, message discarded", logFields)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		h.logger.Trace("Request canceled, message discarded", logFields)
+		return
+	}
+
+	select {
+	case <-msg.Acked():
+		h.logger.Trace("Message acked", logFields)
+		w.WriteHeader(http.StatusNoContent)
+	case <-msg.Nacked():
+		h.logger.Trace("Message nacked", logFields)
+		w.WriteHeader(http.StatusInternalServerError)
+	case <-h.closing:
+		h.logger.Trace("Closing, message nacked", logFields)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+		h.logger.Info("Request canceled without ack received", logFields)
+	}
+}
+
+// Close rejects new requests, answers the pending ones with 503 Service Unavailable
+// and closes the channel returned by Messages.
+func (h *PushHandler) Close() error {
+	h.closedLock.Lock()
+	if h.closed {
+		h.closedLock.Unlock()
+		return nil
+	}
+	h.closed = true
+	h.closedLock.Unlock()
+
+	close(h.closing)
+	h.requestsWg.Wait()
+	close(h.messages)
+
+	return nil
+}
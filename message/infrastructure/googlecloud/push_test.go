@@ -0,0 +1,108 @@
+package googlecloud_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/infrastructure/googlecloud"
+)
+
+// pushRequestBody is a request sent by Pub/Sub to push endpoints, with "payload" as data.
+const pushRequestBody = `{
+	"message": {
+		"attributes": {"_watermill_message_uuid": "uuid", "foo": "bar"},
+		"data": "cGF5bG9hZA==",
+		"messageId": "2070443601311540",
+		"publishTime": "2021-02-26T19:13:55.749Z"
+	},
+	"subscription": "projects/myproject/subscriptions/mysubscription"
+}`
+
+func servePush(handler http.Handler, body string) <-chan *httptest.ResponseRecorder {
+	recorded := make(chan *httptest.ResponseRecorder, 1)
+
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(body)))
+		recorded <- w
+	}()
+
+	return recorded
+}
+
+func receivePushed(t *testing.T, handler *googlecloud.PushHandler) *message.Message {
+	select {
+	case msg := <-handler.Messages():
+		return msg
+	case <-time.After(time.Second * 5):
+		t.Fatal("Pushed message not received")
+		return nil
+	}
+}
+
+func TestPushHandler(t *testing.T) {
+	handler := googlecloud.NewPushHandler(googlecloud.PushHandlerConfig{}, watermill.NewStdLogger(true, true))
+	defer handler.Close()
+
+	recorded := servePush(handler, pushRequestBody)
+
+	msg := receivePushed(t, handler)
+	assert.Equal(t, "uuid", msg.UUID)
+	assert.Equal(t, []byte("payload"), []byte(msg.Payload))
+	assert.Equal(t, "bar", msg.Metadata.Get("foo"))
+	assert.Equal(t, "2021-02-26T19:13:55.749Z", msg.Metadata.Get(googlecloud.PublishTimeMetadataKey))
+	msg.Ack()
+
+	assert.Equal(t, http.StatusNoContent, (<-recorded).Code)
+}
+
+func TestPushHandler_nil_logger(t *testing.T) {
+	handler := googlecloud.NewPushHandler(googlecloud.PushHandlerConfig{}, nil)
+	defer handler.Close()
+
+	recorded := servePush(handler, pushRequestBody)
+
+	receivePushed(t, handler).Ack()
+
+	assert.Equal(t, http.StatusNoContent, (<-recorded).Code)
+}
+
+func TestPushHandler_nack(t *testing.T) {
+	handler := googlecloud.NewPushHandler(googlecloud.PushHandlerConfig{}, watermill.NewStdLogger(true, true))
+	defer handler.Close()
+
+	recorded := servePush(handler, pushRequestBody)
+
+	receivePushed(t, handler).Nack()
+
+	assert.Equal(t, http.StatusInternalServerError, (<-recorded).Code, "nacked message should be redelivered")
+}
+
+func TestPushHandler_invalid_request(t *testing.T) {
+	handler := googlecloud.NewPushHandler(googlecloud.PushHandlerConfig{}, watermill.NewStdLogger(true, true))
+	defer handler.Close()
+
+	assert.Equal(t, http.StatusBadRequest, (<-servePush(handler, "not json")).Code)
+}
+
+func TestPushHandler_Close(t *testing.T) {
+	handler := googlecloud.NewPushHandler(googlecloud.PushHandlerConfig{}, watermill.NewStdLogger(true, true))
+
+	recorded := servePush(handler, pushRequestBody)
+	receivePushed(t, handler)
+
+	require.NoError(t, handler.Close())
+
+	assert.Equal(t, http.StatusServiceUnavailable, (<-recorded).Code)
+	_, open := <-handler.Messages()
+	assert.False(t, open, "messages channel should be closed")
+	assert.Equal(t, http.StatusServiceUnavailable, (<-servePush(handler, pushRequestBody)).Code)
+}
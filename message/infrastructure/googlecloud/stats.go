@@ -0,0 +1,88 @@
+package googlecloud
+
+import (
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// SubscriberStats is a snapshot of what `Subscriber` is processing.
+type SubscriberStats struct {
+	// ActiveSubscriptions is the number of subscriptions started with Subscribe whose output channels are open.
+	ActiveSubscriptions int
+
+	// InFlightMessages is the number of messages delivered to the output channel and not acked or nacked yet,
+	// by topic. Topics without in-flight messages are omitted.
+	InFlightMessages map[string]int
+}
+
+type subscriberStats struct {
+	activeSubscriptions int
+
+	// inFlight holds when the in-flight messages were delivered to the output channel, by topic
+	inFlight map[string]map[*pubsub.Message]time.Time
+}
+
+// Stats returns the numbers of active subscriptions and in-flight messages, for example to expose them to operators.
+func (s *Subscriber) Stats() SubscriberStats {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	stats := SubscriberStats{
+		ActiveSubscriptions: s.stats.activeSubscriptions,
+		InFlightMessages:    make(map[string]int, len(s.stats.inFlight)),
+	}
+	for topic, messages := range s.stats.inFlight {
+		stats.InFlightMessages[topic] = len(messages)
+	}
+
+	return stats
+}
+
+// OldestInFlight returns how long the oldest in-flight message of the topic has been delivered to the output channel
+// without being acked or nacked, or 0 if the topic has no in-flight messages.
+// It grows while a handler is stuck on a message, so it can be used for alerting.
+func (s *Subscriber) OldestInFlight(topic string) time.Duration {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	var oldest time.Time
+	for _, delivered := range s.stats.inFlight[topic] {
+		if oldest.IsZero() || delivered.Before(oldest) {
+			oldest = delivered
+		}
+	}
+
+	if oldest.IsZero() {
+		return 0
+	}
+	return s.config.clock.Now().Sub(oldest)
+}
+
+func (s *Subscriber) updateStats(update func(stats *subscriberStats)) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	update(&s.stats)
+}
+
+// addInFlight tracks the message delivered to the output channel until the returned function is called.
+func (s *Subscriber) addInFlight(topic string, pubsubMsg *pubsub.Message) (remove func()) {
+	delivered := s.config.clock.Now()
+
+	s.updateStats(func(stats *subscriberStats) {
+		if stats.inFlight[topic] == nil {
+			stats.inFlight[topic] = map[*pubsub.Message]time.Time{}
+		}
+		stats.inFlight[topic][pubsubMsg] = delivered
+	})
+
+	return func() {
+		s.updateStats(func(stats *subscriberStats) {
+			delete(stats.inFlight[topic], pubsubMsg)
+			if len(stats.inFlight[topic]) == 0 {
+				delete(stats.inFlight, topic)
+			}
+		})
+	}
+}
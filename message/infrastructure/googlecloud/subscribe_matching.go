@@ -0,0 +1,113 @@
+package googlecloud
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// SubscribeMatching subscribes to all the existing topics of the project whose names start with prefix,
+// like Subscribe does for a single topic, and merges their messages into the returned channel.
+// Topics created after SubscribeMatching is called are not subscribed to.
+//
+// If no topic matches, the returned error wraps `ErrTopicDoesNotExist`.
+// If subscribing to any of the topics fails, the subscriptions started before are stopped and the error is returned.
+//
+// The returned channel is closed once all the subscriptions are finished, when ctx is canceled
+// or the Subscriber is closed.
+func (s *Subscriber) SubscribeMatching(ctx context.Context, prefix string) (<-chan *message.Message, error) {
+	topics, err := s.topicsWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(topics) == 0 {
+		return nil, errors.Wrapf(ErrTopicDoesNotExist, "no topic with prefix %s", prefix)
+	}
+
+	return s.SubscribeMulti(ctx, topics...)
+}
+
+// SubscribeMulti subscribes to all the topics, like Subscribe does for a single topic,
+// and merges their messages into the returned channel, so a single handler can process them.
+// Unless DisableOriginMetadata is set, messages carry the topic and subscription they came from in their metadata,
+// under `TopicMetadataKey` and `SubscriptionMetadataKey`.
+//
+// If subscribing to any of the topics fails, the subscriptions started before are stopped and the error is returned.
+//
+// The returned channel is closed once all the subscriptions are finished, when ctx is canceled
+// or the Subscriber is closed.
+func (s *Subscriber) SubscribeMulti(ctx context.Context, topics ...string) (<-chan *message.Message, error) {
+	if len(topics) == 0 {
+		return nil, errors.New("no topics to subscribe to")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var outputs []<-chan *message.Message
+	for _, topic := range topics {
+		output, err := s.Subscribe(ctx, topic)
+		if err != nil {
+			cancel()
+			return nil, errors.Wrapf(err, "cannot subscribe to topic %s", topic)
+		}
+		outputs = append(outputs, output)
+	}
+
+	return mergeMessages(outputs, cancel), nil
+}
+
+// topicsWithPrefix returns the names of the topics of the project starting with prefix.
+func (s *Subscriber) topicsWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var topics []string
+
+	it := s.client.Topics(ctx)
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not list topics")
+		}
+
+		if strings.HasPrefix(t.ID(), prefix) {
+			topics = append(topics, t.ID())
+		}
+	}
+
+	return topics, nil
+}
+
+// mergeMessages forwards the messages of all the channels to the returned channel,
+// which is closed, and done called, once all the channels are closed.
+func mergeMessages(channels []<-chan *message.Message, done func()) <-chan *message.Message {
+	merged := make(chan *message.Message)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(channels))
+	for _, ch := range channels {
+		go func(ch <-chan *message.Message) {
+			defer wg.Done()
+			for msg := range ch {
+				select {
+				case merged <- msg:
+				case <-msg.Context().Done():
+					// not consumed, the subscriber nacks the message
+				}
+			}
+		}(ch)
+	}
+
+	go func() {
+		wg.Wait()
+		done()
+		close(merged)
+	}()
+
+	return merged
+}
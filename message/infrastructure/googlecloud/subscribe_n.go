@@ -0,0 +1,66 @@
+package googlecloud
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// SubscribeN subscribes to the topic like Subscribe and stops the subscription once n messages are acked,
+// for example to consume a known number of messages in tests or one-shot batch jobs.
+//
+// Messages are delivered one at a time, the next one after the previous one is acked or nacked.
+// Nacked messages don't count, so the same message may be delivered again.
+// The returned channel is closed after the n-th message is acked and the subscription is finished,
+// or earlier when ctx is canceled or the Subscriber is closed.
+//
+// Messages leased by the client library but not delivered when the subscription stops are redelivered
+// after their ack deadline, ReceiveSettings.MaxOutstandingMessages limits how many are leased.
+func (s *Subscriber) SubscribeN(ctx context.Context, topic string, n int) (<-chan *message.Message, error) {
+	if n <= 0 {
+		return nil, errors.Errorf("n must be positive, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	messages, err := s.Subscribe(ctx, topic)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	output := make(chan *message.Message)
+	go func() {
+		defer close(output)
+
+		acked := 0
+		for msg := range messages {
+			// Context copies the message, so it's not called concurrently with Ack or Nack
+			msgCtx := msg.Context()
+
+			select {
+			case output <- msg:
+			case <-msgCtx.Done():
+				// not consumed, the subscriber nacks the message
+				continue
+			}
+
+			if waitForOutcome(msgCtx, msg) == OutcomeAcked {
+				acked++
+			}
+			if acked == n {
+				break
+			}
+		}
+
+		cancel()
+		// messages received while stopping are not delivered, so they are nacked
+		for msg := range messages {
+			msg.Nack()
+		}
+	}()
+
+	return output, nil
+}
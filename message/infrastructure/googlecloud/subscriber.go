@@ -3,12 +3,17 @@ package googlecloud
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"sync"
+	"time"
 
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"google.golang.org/api/option"
 
@@ -23,6 +28,22 @@ var (
 	ErrSubscriptionDoesNotExist = errors.New("subscription does not exist")
 	// ErrUnexpectedTopic happens when the subscription resolved from SubscriptionNameFn is for a different topic than expected.
 	ErrUnexpectedTopic = errors.New("requested subscription already exists, but for other topic than expected")
+	// ErrSubscriptionTopicMismatch is another name of ErrUnexpectedTopic. Unless SubscriberConfig.IgnoreTopicMismatch
+	// is set, it happens for example after a rename, when the subscription is still attached to the old topic.
+	ErrSubscriptionTopicMismatch = ErrUnexpectedTopic
+	// ErrCloseTimeout happens when in-flight messages were not acked or nacked within SubscriberConfig.CloseTimeout.
+	ErrCloseTimeout = errors.New("closing subscriber timed out")
+	// ErrUnexpectedFilter happens when the subscription resolved from SubscriptionNameFn has a different filter than configured.
+	ErrUnexpectedFilter = errors.New("requested subscription already exists, but with other filter than expected")
+	// ErrBigQuerySubscription happens when trying to receive messages from a BigQuery subscription.
+	// Messages of BigQuery subscriptions are written to the BigQuery table by Pub/Sub and can't be pulled.
+	ErrBigQuerySubscription = errors.New("BigQuery subscriptions are delivered to BigQuery, Subscriber only supports pull")
+	// ErrAlreadySubscribed happens when subscribing to a subscription which the subscriber already receives from,
+	// unless SubscriberConfig.AllowDuplicateSubscribe is set.
+	ErrAlreadySubscribed = errors.New("already subscribed")
+	// ErrMaxDeliveryAttemptsExceeded is logged when a message delivered more than SubscriberConfig.MaxDeliveryAttempts
+	// times is dropped.
+	ErrMaxDeliveryAttemptsExceeded = errors.New("message exceeded max delivery attempts")
 )
 
 // Subscriber attaches to a Google Cloud Pub/Sub subscription and returns a Go channel with messages from the topic.
@@ -30,15 +51,57 @@ var (
 //
 // For more info on how Google Cloud Pub/Sub Subscribers work, check https://cloud.google.com/pubsub/docs/subscriber.
 type Subscriber struct {
-	closing chan struct{}
-	closed  bool
+	// closing is closed by Close to broadcast to all the subscriptions that the subscriber is closing,
+	// nothing is ever sent to it
+	closing    chan struct{}
+	closed     bool
+	closedLock sync.Mutex
+
+	// closeFinished is closed when Close is finished, with the result in closeErr
+	closeFinished chan struct{}
+	closeErr      error
+
+	// closeTimeoutExceeded is closed when in-flight messages didn't make it within CloseTimeout
+	closeTimeoutExceeded chan struct{}
 
 	allSubscriptionsWaitGroup sync.WaitGroup
-	activeSubscriptions       map[string]*pubsub.Subscription
-	activeSubscriptionsLock   sync.RWMutex
+	// drain are the subscriptions started since the last Drain, guarded by closedLock
+	drain *drainGroup
+
+	activeSubscriptions     map[string]*pubsub.Subscription
+	activeSubscriptionsLock sync.RWMutex
+
+	// createdSubscriptions are the active subscriptions created by `Subscriber`, guarded by activeSubscriptionsLock
+	createdSubscriptions map[string]*pubsub.Subscription
+	// receivingSubscriptions are the names of subscriptions being received from, guarded by activeSubscriptionsLock
+	receivingSubscriptions map[string]struct{}
+	// pausedSubscriptions are closed when the subscriptions are resumed
+	pausedSubscriptions     map[string]chan struct{}
+	pausedSubscriptionsLock sync.RWMutex
+
+	// errs receives the errors of receiving messages, it's closed on Close
+	errs chan error
+
+	lastErr error
+	// lastErrStopped is true if lastErr is the error of receiving stopped cleanly, not a failure
+	lastErrStopped bool
+	// lastErrSubscription is the subscription which lastErr comes from
+	lastErrSubscription string
+	lastErrLock         sync.Mutex
+
+	stats     subscriberStats
+	statsLock sync.Mutex
+
+	client subscriberClient
+	// ownsClient is true if the client was created by `Subscriber`, so it's closed on Close
+	ownsClient bool
+	config     SubscriberConfig
 
-	client *pubsub.Client
-	config SubscriberConfig
+	// rateLimiter limits the rate of messages delivered by all the subscriptions, it's nil without RateLimit
+	rateLimiter *rate.Limiter
+
+	// deliveryAttempts counts deliveries of messages, it's nil without MaxDeliveryAttempts
+	deliveryAttempts *deliveryAttempts
 
 	logger watermill.LoggerAdapter
 }
@@ -51,30 +114,424 @@ type SubscriberConfig struct {
 	// By default, subscriptions expire after 31 days of inactivity.
 	//
 	// A topic can have multiple subscriptions, but a given subscription belongs to a single topic.
+	// Subscribers using the same subscription name compete for messages, while subscribers using different
+	// subscription names (for example generated with `TopicSubscriptionNameWithSuffix`) each receive all messages.
 	GenerateSubscriptionName SubscriptionNameFn
 
 	// ProjectID is the Google Cloud Engine project ID.
+	// It is required, unless the emulator is used (see DisableEmulatorAutodetect), which accepts any project ID.
 	ProjectID string
 
 	// If false (default), `Subscriber` tries to create a subscription if there is none with the requested name.
 	// Otherwise, trying to use non-existent subscription results in `ErrSubscriptionDoesNotExist`.
 	DoNotCreateSubscriptionIfMissing bool
 
-	// If false (default), `Subscriber` tries to create a topic if there is none with the requested name
-	// and it is trying to create a new subscription with this topic name.
-	// Otherwise, trying to create a subscription on non-existent topic results in `ErrTopicDoesNotExist`.
+	// If true, Close deletes the subscriptions created by `Subscriber`, for example for ephemeral consumers
+	// with generated subscription names. Subscriptions which existed before are not deleted.
+	DeleteSubscriptionOnClose bool
+
+	// If true, `Subscriber` creates the topic if there is none with the requested name
+	// and it is trying to create a new subscription with this topic name (the same applies to the dead letter topic).
+	// If false (default), trying to create a subscription on non-existent topic results in `ErrTopicDoesNotExist`,
+	// so subscribing doesn't change topics.
+	//
+	// Before CreateTopicIfMissing was added, `Subscriber` created missing topics unless DoNotCreateTopicIfMissing
+	// was set. To keep that behavior, set CreateTopicIfMissing to true.
+	CreateTopicIfMissing bool
+
+	// Deprecated: missing topics are not created unless CreateTopicIfMissing is set.
+	// If true, trying to create a subscription on non-existent topic results in `ErrTopicDoesNotExist`.
+	// It can't be set together with CreateTopicIfMissing.
 	DoNotCreateTopicIfMissing bool
 
+	// KMSKeyName, when set, is the Cloud KMS key used to encrypt messages of topics created by `Subscriber`,
+	// in the form projects/*/locations/*/keyRings/*/cryptoKeys/*.
+	// The key of an existing topic can't be changed, a different key is only logged.
+	KMSKeyName string
+
+	// If true, subscriptions created by `Subscriber` have message ordering enabled.
+	// Messages with the same ordering key are then delivered in the order they were published.
+	// The ordering key is available in the message metadata under `OrderingKeyMetadataKey`.
+	//
+	// Messages are delivered one by one, so ordering is preserved even with multiple ReceiveSettings.NumGoroutines.
+	//
+	// To enable message ordering only for some topics, leave it false and set EnableMessageOrdering
+	// in the config returned by SubscriptionConfigFn. Messages of the other topics are then delivered concurrently.
+	EnableMessageOrdering bool
+
+	// If true, subscriptions created by `Subscriber` have exactly-once delivery enabled.
+	// Acks and nacks are then confirmed by Pub/Sub before the message is considered processed,
+	// and failed confirmations are logged.
+	EnableExactlyOnceDelivery bool
+
+	// AckDeadline, when set, is applied to subscriptions created by `Subscriber`.
+	// It is how long Pub/Sub waits for the message to be acked before redelivering it, between 10 seconds and 10 minutes.
+	//
+	// While `Subscriber` waits for the message to be acked or nacked, the client library keeps extending the deadline
+	// automatically, but only up to ReceiveSettings.MaxExtension. Set it accordingly for handlers that take longer.
+	// Handlers can't extend the deadline of a single message on demand: the client library doesn't expose
+	// the ack ID of a received message, so it can't be modAcked outside of the automatic extension.
+	AckDeadline time.Duration
+
+	// Labels, when set, are applied to subscriptions created by `Subscriber`, for example to track costs.
+	Labels map[string]string
+
+	// If true, subscriptions created by `Subscriber` retain acknowledged messages for RetentionDuration,
+	// so they can be replayed later.
+	RetainAckedMessages bool
+
+	// RetentionDuration, when set, is how long subscriptions created by `Subscriber` retain unacknowledged messages
+	// (and acknowledged messages when RetainAckedMessages is set), between 10 minutes and 7 days.
+	RetentionDuration time.Duration
+
+	// Filter, when set, is applied to subscriptions created by `Subscriber`, so only messages with attributes
+	// matching the filter expression are delivered. See https://cloud.google.com/pubsub/docs/filtering for the syntax.
+	//
+	// Filters can't be changed after the subscription is created. If the subscription already exists with
+	// a different filter (including no filter at all), subscribing results in `ErrUnexpectedFilter`.
+	Filter string
+
+	// If true, mutable properties of an existing subscription (ack deadline, retention, dead letter policy,
+	// retry policy, labels, push config and BigQuery config) are updated when they differ from the configured ones.
+	// Properties which are not configured are left unchanged. Immutable properties can't be updated:
+	// a different filter results in `ErrUnexpectedFilter`, a different message ordering is logged.
+	UpdateSubscriptionIfExists bool
+
+	// If false (default), subscribing fails with `ErrSubscriptionTopicMismatch` when the subscription exists,
+	// but is attached to another topic than the subscribed one.
+	// If true, the mismatch is logged and the existing subscription is used as it is.
+	IgnoreTopicMismatch bool
+
+	// ReconcileFields limits which properties of existing subscriptions are updated when UpdateSubscriptionIfExists
+	// is set, for example to update only the dead letter policy without clobbering manually tuned labels.
+	// Combine the fields with |, like ReconcileAckDeadline|ReconcileDeadLetterPolicy.
+	// If 0 (default), all the properties are updated.
+	ReconcileFields ReconcileField
+
+	// DeadLetterPolicy, when set, is applied to subscriptions created by `Subscriber`.
+	// Messages that could not be delivered within MaxDeliveryAttempts are then forwarded to the dead letter topic
+	// instead of being redelivered forever.
+	//
+	// If the dead letter topic doesn't exist, it is created if CreateTopicIfMissing is set.
+	DeadLetterPolicy *DeadLetterPolicy
+
+	// MaxDeliveryAttempts, when greater than 0, limits how many times a message is delivered by subscriptions
+	// without a dead letter policy, so a message which always fails isn't redelivered forever.
+	// OnMaxDeliveryAttempts decides what happens with messages delivered more times.
+	// It can't be set together with DeadLetterPolicy, which limits the delivery attempts on the server.
+	//
+	// The delivery attempt provided by Pub/Sub is used when available. Otherwise the deliveries are counted
+	// by `Subscriber`, best effort: only the recently delivered messages are remembered, and deliveries to other
+	// subscribers of the subscription are not counted.
+	MaxDeliveryAttempts int
+
+	// OnMaxDeliveryAttempts decides what happens with messages delivered more than MaxDeliveryAttempts times.
+	// Defaults to `MaxDeliveryAttemptsDrop`, so they are acked.
+	OnMaxDeliveryAttempts MaxDeliveryAttemptsAction
+
+	// RetryPolicy, when set, is applied to subscriptions created by `Subscriber`.
+	// Nacked messages are then redelivered with an exponential backoff instead of immediately.
+	RetryPolicy *RetryPolicy
+
+	// PushConfig, when set, is applied to subscriptions created by `Subscriber`, making them push subscriptions.
+	// Pub/Sub delivers messages of push subscriptions to the endpoint via HTTP, so they can't be received
+	// with Subscribe, which returns `ErrPushSubscription` after creating the subscription.
+	// Use `PushHandler` to receive them instead.
+	PushConfig *pubsub.PushConfig
+
+	// BigQueryConfig, when set, is applied to subscriptions created by `Subscriber`, making them BigQuery subscriptions.
+	// Pub/Sub writes messages of BigQuery subscriptions to the table, so they can't be received with Subscribe,
+	// which returns `ErrBigQuerySubscription` after creating the subscription.
+	BigQueryConfig *pubsub.BigQueryConfig
+
+	// CreateRetryPolicy specifies how checking if topics and subscriptions exist and creating them is retried
+	// after transient errors, for example when the API is briefly unavailable on startup.
+	// By default, they are not retried.
+	CreateRetryPolicy CreateRetryPolicy
+
+	// ReconnectRetryInterval is how long `Subscriber` waits before receiving again after receiving from a subscription
+	// failed, for example due to a transient network error. Defaults to 5 seconds.
+	ReconnectRetryInterval time.Duration
+
+	// ReconnectMaxAttempts limits how many times receiving from a subscription is attempted before giving up
+	// and closing the output channel. 0 (default) means retrying until the subscriber is closed.
+	ReconnectMaxAttempts int
+
+	// CloseTimeout is how long in-flight messages (already delivered to the output channel) have to be acked or nacked
+	// after Close is called. Once it passes, the remaining messages are nacked, their contexts are canceled,
+	// output channels are closed and Close returns `ErrCloseTimeout`.
+	//
+	// If 0 (default), in-flight messages are nacked as soon as Close is called.
+	CloseTimeout time.Duration
+
+	// DeliveryTimeout is how long a received message waits to be read from the output channel.
+	// Messages not read within it are nacked, so they are redelivered, possibly to another subscriber,
+	// instead of blocking the client library while the consumer isn't reading.
+	//
+	// If 0 (default), messages wait until they are read or the subscription stops.
+	DeliveryTimeout time.Duration
+
+	// MessageProcessingTimeout, when set, is the timeout of the contexts of delivered messages, so handlers
+	// can bound their work. It's counted from when the message is sent to the output channel, including
+	// the time it waits to be read. Messages not acked or nacked before their context expires are nacked,
+	// so they are redelivered.
+	MessageProcessingTimeout time.Duration
+
+	// MaxConcurrentDelivery limits how many messages of a subscription are delivered to the output channel
+	// and not yet acked or nacked at the same time, regardless of ReceiveSettings.
+	// 0 (default) means no limit other than the one of the client library.
+	MaxConcurrentDelivery int
+
+	// RateLimit, when set, limits how many messages per second are delivered by all the subscriptions
+	// of the subscriber together, for example to protect a downstream database.
+	//
+	// Messages waiting for the limiter are already leased from Pub/Sub, so their ack deadline is extended
+	// by the client library, up to ReceiveSettings.MaxExtension. If the wait is longer than that,
+	// for example because of a low limit and high ReceiveSettings.MaxOutstandingMessages, they are redelivered.
+	RateLimit *RateLimit
+
+	// If false (default), subscribing to a subscription which the subscriber already receives from,
+	// for example calling Subscribe twice with the same topic, fails with `ErrAlreadySubscribed`
+	// until the previous subscription's context is canceled.
+	// Otherwise, each of the subscriptions receives with its own handle of the Pub/Sub subscription,
+	// so they compete for messages, and each message is delivered to only one of them.
+	AllowDuplicateSubscribe bool
+
+	// If true, when the handler nacks a message with `NackDelayMetadataKey` in its metadata,
+	// the nack is delayed by the duration in the metadata value (for example "30s"), so the message
+	// is redelivered no sooner than that. Messages without the key are nacked immediately.
+	//
+	// The client library doesn't allow a custom ack deadline for a single message, so the message stays
+	// outstanding until the nack: it counts against ReceiveSettings.MaxOutstandingMessages and, with message
+	// ordering enabled, holds the messages with the same ordering key back. When the subscriber is closing,
+	// the message is nacked at once.
+	NackDelayFromMetadata bool
+
+	// OutputChannelBuffer is the capacity of the channels returned by Subscribe. Defaults to 0 (unbuffered).
+	//
+	// A buffer smooths latency of bursty topics, as messages are received while the handler is busy.
+	// Buffered messages are already leased from Pub/Sub, so they count against ReceiveSettings.MaxOutstandingMessages
+	// and their ack deadline is extended while they wait. On Close, buffered messages which were not consumed
+	// are nacked and removed from the channel.
+	OutputChannelBuffer int
+
+	// OnUnmarshalError decides what happens with messages which can't be unmarshaled.
+	// Defaults to `UnmarshalErrorNack`, so they are redelivered.
+	OnUnmarshalError UnmarshalErrorAction
+
+	// UnmarshalErrorHandler, when set, is called with the messages which can't be unmarshaled instead of
+	// applying OnUnmarshalError, for example to repair messages produced with an older schema.
+	// A returned message is delivered like any other, otherwise the returned action is applied.
+	UnmarshalErrorHandler UnmarshalErrorHandler
+
+	// MetricsHook is notified about messages received by `Subscriber`, for example to count them per topic.
+	// Defaults to `NopMetricsHook`.
+	MetricsHook MetricsHook
+
+	// OnTopicCreated and OnSubscriptionCreated, when set, are called with the name of each topic
+	// and subscription created by `Subscriber`, including dead letter topics, for example to audit provisioning.
+	// They are not called for resources which already exist.
+	OnTopicCreated        func(topic string)
+	OnSubscriptionCreated func(subscription string)
+
+	// ReceiveSettings are applied to every subscription before receiving messages from it.
+	// Use them to tune MaxOutstandingMessages, MaxOutstandingBytes or NumGoroutines,
+	// for example when processing a single message is expensive and the client library defaults use too much memory.
+	// Zero value means the defaults of cloud.google.com/go/pubsub client library.
+	//
+	// Until a message is acked or nacked, the client library keeps extending its ack deadline
+	// by up to MaxExtensionPeriod at a time, in total for up to MaxExtension (60 minutes by default).
+	// Handlers taking longer don't need to extend the deadline themselves, but MaxExtension has to be increased.
+	// The ack ID of a message isn't exposed by the client library, so the deadline can't be extended on demand.
+	ReceiveSettings pubsub.ReceiveSettings
+
 	// Settings for cloud.google.com/go/pubsub client library.
-	ReceiveSettings    pubsub.ReceiveSettings
 	SubscriptionConfig pubsub.SubscriptionConfig
-	ClientOptions      []option.ClientOption
+
+	// SubscriptionConfigFn, when set, returns the settings of the subscription created for the topic,
+	// taking precedence over SubscriptionConfig, for example to use different ack deadlines for different topics.
+	// The fields of `SubscriberConfig` overriding SubscriptionConfig, like AckDeadline, override it as well.
+	//
+	// Messages with the same ordering key are delivered one by one only from subscriptions with
+	// EnableMessageOrdering, so it can be enabled for the topics which need it without slowing down the others.
+	SubscriptionConfigFn SubscriptionConfigFn
+
+	// If false (default) and the PUBSUB_EMULATOR_HOST environment variable is set, the client connects
+	// to the emulator at that address without authentication, unless ClientOptions contain an endpoint.
+	// Otherwise, PUBSUB_EMULATOR_HOST is ignored.
+	DisableEmulatorAutodetect bool
+
+	// If false (default), the subscription and the topic of received messages are set in their metadata
+	// under `SubscriptionMetadataKey` and `TopicMetadataKey`, so handlers of messages from multiple subscriptions
+	// can tell where they came from. They are not published by the default Marshaler.
+	DisableOriginMetadata bool
+
+	// RoutingKeyAttribute, when set, is the Pub/Sub attribute copied to the metadata of received messages
+	// under `RoutingKeyMetadataKey`, for example an attribute with the event type, so handlers can be chosen
+	// by the metadata without knowing the attribute. Messages without the attribute have no routing key.
+	RoutingKeyAttribute string
+
+	// GRPCConnectionPoolSize is the number of gRPC connections to Pub/Sub, for example to avoid saturating
+	// a single connection under high throughput.
+	// If 0 (default), the client library opens as many connections as there are CPUs, up to 4.
+	// A single connection is used with the emulator.
+	GRPCConnectionPoolSize int
+
+	// GRPCKeepalive, when set, makes the client ping idle gRPC connections, so connections dropped silently,
+	// for example by NAT after a timeout, are detected and reestablished.
+	// Time below 10 seconds is raised to 10 seconds by gRPC.
+	// If nil (default), the client library pings connections idle for 5 minutes.
+	GRPCKeepalive *keepalive.ClientParameters
+
+	// GRPCDialOptions are used when connecting to Pub/Sub, for example to add interceptors.
+	GRPCDialOptions []grpc.DialOption
+
+	// ClientOptions are passed to the cloud.google.com/go/pubsub client.
+	// They are applied after GRPCConnectionPoolSize, GRPCKeepalive and GRPCDialOptions, so they take precedence.
+	ClientOptions []option.ClientOption
 
 	// Unmarshaler transforms the client library format into watermill/message.Message.
 	// Use a custom unmarshaler if needed, otherwise the default Unmarshaler should cover most use cases.
 	Unmarshaler Unmarshaler
+
+	// LogFieldTransforms transform the values of log fields by their keys in all the logs of `Subscriber`,
+	// for example `HashLogField` for "subscription_name" or `OmitLogField` for "topic" to reduce log cardinality.
+	LogFieldTransforms map[string]LogFieldFn
+
+	// clock is replaced in tests to drive timeouts deterministically, realClock by default.
+	clock clock
+}
+
+// DeadLetterPolicy specifies where and after how many delivery attempts undeliverable messages are forwarded.
+type DeadLetterPolicy struct {
+	// DeadLetterTopic is the name of the topic to which dead letter messages are published.
+	DeadLetterTopic string
+
+	// MaxDeliveryAttempts is the maximum number of delivery attempts for any message.
+	// Pub/Sub accepts values between 5 and 100; 0 means the server default (5).
+	MaxDeliveryAttempts int
+}
+
+// RetryPolicy specifies the backoff between redeliveries of nacked messages.
+type RetryPolicy struct {
+	// MinimumBackoff is the minimum delay between consecutive deliveries of a message.
+	// Pub/Sub accepts values between 0 and 600 seconds; 0 means the server default (10 seconds).
+	MinimumBackoff time.Duration
+
+	// MaximumBackoff is the maximum delay between consecutive deliveries of a message.
+	// Pub/Sub accepts values between 0 and 600 seconds; 0 means the server default (600 seconds).
+	MaximumBackoff time.Duration
+}
+
+// UnmarshalErrorAction is what `Subscriber` does with messages which can't be unmarshaled.
+type UnmarshalErrorAction int
+
+const (
+	// UnmarshalErrorNack nacks the message, so it is redelivered.
+	// A message which can never be unmarshaled is redelivered forever, unless the subscription has a dead letter policy.
+	UnmarshalErrorNack UnmarshalErrorAction = iota
+	// UnmarshalErrorAck acks the message, so it is discarded.
+	UnmarshalErrorAck
+	// UnmarshalErrorDeadLetter nacks the message, so Pub/Sub forwards it to the dead letter topic
+	// after the maximum number of delivery attempts. It requires a dead letter policy.
+	UnmarshalErrorDeadLetter
+)
+
+// RateLimit is the maximum rate of messages delivered by `Subscriber`, see SubscriberConfig.RateLimit.
+type RateLimit struct {
+	// MessagesPerSecond is how many messages are delivered per second on average.
+	MessagesPerSecond float64
+
+	// Burst is how many messages may be delivered at once, above MessagesPerSecond. Defaults to 1.
+	Burst int
+}
+
+// UnmarshalErrorHandler handles a message which can't be unmarshaled because of err.
+// It returns either the salvaged message to deliver, or nil and the action to apply.
+type UnmarshalErrorHandler func(pubsubMsg *pubsub.Message, err error) (*message.Message, UnmarshalErrorAction)
+
+// ReconcileField is a property of existing subscriptions updated when SubscriberConfig.UpdateSubscriptionIfExists
+// is set. See SubscriberConfig.ReconcileFields.
+type ReconcileField uint
+
+const (
+	ReconcileAckDeadline ReconcileField = 1 << iota
+	ReconcileRetainAckedMessages
+	ReconcileRetentionDuration
+	ReconcileDeadLetterPolicy
+	ReconcileRetryPolicy
+	ReconcileLabels
+	ReconcilePushConfig
+	ReconcileBigQueryConfig
+
+	// ReconcileAll updates all the properties, same as 0.
+	ReconcileAll = ReconcileAckDeadline | ReconcileRetainAckedMessages | ReconcileRetentionDuration |
+		ReconcileDeadLetterPolicy | ReconcileRetryPolicy | ReconcileLabels | ReconcilePushConfig |
+		ReconcileBigQueryConfig
+)
+
+// has is true if the field is reconciled.
+func (f ReconcileField) has(field ReconcileField) bool {
+	return f == 0 || f&field != 0
+}
+
+// SubscriptionConfigFn returns the settings of the subscription created for a topic.
+type SubscriptionConfigFn func(ctx context.Context, topic string) pubsub.SubscriptionConfig
+
+// CreateRetryPolicy specifies how calls checking if topics and subscriptions exist and creating them are retried.
+type CreateRetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a call; 0 or 1 means no retries.
+	MaxAttempts int
+
+	// Interval is how long `Subscriber` waits before the first retry. It doubles with every retry.
+	// Defaults to 100 milliseconds.
+	Interval time.Duration
+}
+
+// NackDelayMetadataKey is the key of the Watermill message metadata with the duration the nack of the message
+// is delayed by, when NackDelayFromMetadata is enabled.
+const NackDelayMetadataKey = "gcp_min_backoff"
+
+// SubscriptionMetadataKey is the key of the Watermill message metadata with the name of the subscription
+// the message was received from, unless DisableOriginMetadata is set.
+const SubscriptionMetadataKey = "gcp_subscription"
+
+// TopicMetadataKey is the key of the Watermill message metadata with the topic the message was received from,
+// unless DisableOriginMetadata is set.
+const TopicMetadataKey = "gcp_topic"
+
+// RoutingKeyMetadataKey is the key of the Watermill message metadata with the value of the Pub/Sub attribute
+// configured with RoutingKeyAttribute.
+const RoutingKeyMetadataKey = "gcp_routing_key"
+
+// errorsChannelBuffer is how many errors are buffered in the channel returned by Errors.
+const errorsChannelBuffer = 16
+
+// defaultAckDeadline is the ack deadline of subscriptions created without SubscriberConfig.AckDeadline.
+const defaultAckDeadline = time.Second * 10
+
+// MetricsHook is notified about messages received by `Subscriber`.
+// Its methods are called concurrently from the goroutines receiving messages, so they should return quickly.
+type MetricsHook interface {
+	// OnReceive is called when a message is received from the subscription of the topic.
+	OnReceive(topic string)
+	// OnAck is called when a message is acked, with the time elapsed since it was received.
+	OnAck(topic string, elapsed time.Duration)
+	// OnNack is called when a message is nacked, with the time elapsed since it was received.
+	OnNack(topic string, elapsed time.Duration)
+	// OnUnmarshalError is called when a message could not be unmarshaled,
+	// before SubscriberConfig.OnUnmarshalError or UnmarshalErrorHandler is applied.
+	OnUnmarshalError(topic string, err error)
 }
 
+// NopMetricsHook is a MetricsHook that does nothing.
+type NopMetricsHook struct{}
+
+func (NopMetricsHook) OnReceive(topic string)                     {}
+func (NopMetricsHook) OnAck(topic string, elapsed time.Duration)  {}
+func (NopMetricsHook) OnNack(topic string, elapsed time.Duration) {}
+func (NopMetricsHook) OnUnmarshalError(topic string, err error)   {}
+
 type SubscriptionNameFn func(topic string) string
 
 // TopicSubscriptionName uses the topic name as the subscription name.
@@ -83,6 +540,8 @@ func TopicSubscriptionName(topic string) string {
 }
 
 // TopicSubscriptionNameWithSuffix uses the topic name with a chosen suffix as the subscription name.
+// The suffix works like a consumer group: subscribers with different suffixes get independent subscriptions
+// to the same topic and each of them receives every message.
 func TopicSubscriptionNameWithSuffix(suffix string) SubscriptionNameFn {
 	return func(topic string) string {
 		return topic + suffix
@@ -90,12 +549,165 @@ func TopicSubscriptionNameWithSuffix(suffix string) SubscriptionNameFn {
 }
 
 func (c *SubscriberConfig) setDefaults() {
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+	if c.ProjectID == "" && emulatorConfigured(c.DisableEmulatorAutodetect) {
+		c.ProjectID = emulatorProjectID
+	}
 	if c.GenerateSubscriptionName == nil {
 		c.GenerateSubscriptionName = TopicSubscriptionName
 	}
 	if c.Unmarshaler == nil {
 		c.Unmarshaler = DefaultMarshalerUnmarshaler{}
 	}
+	if c.RateLimit != nil && c.RateLimit.Burst == 0 {
+		rateLimit := *c.RateLimit
+		rateLimit.Burst = 1
+		c.RateLimit = &rateLimit
+	}
+	if c.CreateRetryPolicy.Interval == 0 {
+		c.CreateRetryPolicy.Interval = time.Millisecond * 100
+	}
+	if c.ReconnectRetryInterval == 0 {
+		c.ReconnectRetryInterval = time.Second * 5
+	}
+	if c.MetricsHook == nil {
+		c.MetricsHook = NopMetricsHook{}
+	}
+}
+
+func (c SubscriberConfig) Validate() error {
+	if c.ProjectID == "" {
+		return errors.New("missing ProjectID")
+	}
+	if c.CreateTopicIfMissing && c.DoNotCreateTopicIfMissing {
+		return errors.New("CreateTopicIfMissing and DoNotCreateTopicIfMissing can't be set together")
+	}
+	if c.GenerateSubscriptionName == nil {
+		return errors.New("missing GenerateSubscriptionName")
+	}
+	if c.Unmarshaler == nil {
+		return errors.New("missing Unmarshaler")
+	}
+	if c.MetricsHook == nil {
+		return errors.New("missing MetricsHook")
+	}
+	if c.AckDeadline != 0 && (c.AckDeadline < 10*time.Second || c.AckDeadline > 10*time.Minute) {
+		return errors.Errorf("AckDeadline must be between 10s and 10m, got %s", c.AckDeadline)
+	}
+	if c.DeadLetterPolicy != nil && c.DeadLetterPolicy.DeadLetterTopic == "" {
+		return errors.New("missing DeadLetterPolicy.DeadLetterTopic")
+	}
+	if c.RetryPolicy != nil {
+		if err := c.RetryPolicy.validate(); err != nil {
+			return errors.Wrap(err, "invalid RetryPolicy")
+		}
+	}
+	if c.MaxDeliveryAttempts < 0 {
+		return errors.Errorf("MaxDeliveryAttempts must not be negative, got %d", c.MaxDeliveryAttempts)
+	}
+	if c.MaxDeliveryAttempts > 0 && c.DeadLetterPolicy != nil {
+		return errors.New("MaxDeliveryAttempts can't be set together with DeadLetterPolicy")
+	}
+	switch c.OnMaxDeliveryAttempts {
+	case MaxDeliveryAttemptsDrop, MaxDeliveryAttemptsLog:
+	default:
+		return errors.Errorf("unknown OnMaxDeliveryAttempts %d", c.OnMaxDeliveryAttempts)
+	}
+	switch c.OnUnmarshalError {
+	case UnmarshalErrorNack, UnmarshalErrorAck:
+	case UnmarshalErrorDeadLetter:
+		if c.DeadLetterPolicy == nil && c.SubscriptionConfig.DeadLetterPolicy == nil {
+			return errors.New("OnUnmarshalError UnmarshalErrorDeadLetter requires DeadLetterPolicy")
+		}
+	default:
+		return errors.Errorf("unknown OnUnmarshalError %d", c.OnUnmarshalError)
+	}
+	if c.ReconcileFields != 0 && !c.UpdateSubscriptionIfExists {
+		return errors.New("ReconcileFields is set, but UpdateSubscriptionIfExists is not")
+	}
+	if c.ReconcileFields&^ReconcileAll != 0 {
+		return errors.Errorf("unknown ReconcileFields %b", c.ReconcileFields&^ReconcileAll)
+	}
+	if c.CreateRetryPolicy.MaxAttempts < 0 {
+		return errors.Errorf("CreateRetryPolicy.MaxAttempts must not be negative, got %d", c.CreateRetryPolicy.MaxAttempts)
+	}
+	if c.GRPCConnectionPoolSize < 0 {
+		return errors.Errorf("GRPCConnectionPoolSize must not be negative, got %d", c.GRPCConnectionPoolSize)
+	}
+	if c.RateLimit != nil && (c.RateLimit.MessagesPerSecond <= 0 || c.RateLimit.Burst < 0) {
+		return errors.Errorf(
+			"RateLimit must have positive MessagesPerSecond and Burst, got %v and %d",
+			c.RateLimit.MessagesPerSecond,
+			c.RateLimit.Burst,
+		)
+	}
+	if c.OutputChannelBuffer < 0 {
+		return errors.Errorf("OutputChannelBuffer must not be negative, got %d", c.OutputChannelBuffer)
+	}
+	if c.DeliveryTimeout < 0 {
+		return errors.Errorf("DeliveryTimeout must not be negative, got %s", c.DeliveryTimeout)
+	}
+	if c.MessageProcessingTimeout < 0 {
+		return errors.Errorf("MessageProcessingTimeout must not be negative, got %s", c.MessageProcessingTimeout)
+	}
+	if c.MaxConcurrentDelivery < 0 {
+		return errors.Errorf("MaxConcurrentDelivery must not be negative, got %d", c.MaxConcurrentDelivery)
+	}
+	if p := c.ReceiveSettings.MaxExtensionPeriod; p > 0 && (p < 10*time.Second || p > 10*time.Minute) {
+		return errors.Errorf("ReceiveSettings.MaxExtensionPeriod must be between 10s and 10m, got %s", p)
+	}
+	if c.ReceiveSettings.MaxOutstandingMessages < 0 {
+		return errors.Errorf(
+			"ReceiveSettings.MaxOutstandingMessages must not be negative, got %d",
+			c.ReceiveSettings.MaxOutstandingMessages,
+		)
+	}
+	for key, transform := range c.LogFieldTransforms {
+		if transform == nil {
+			return errors.Errorf("LogFieldTransforms has nil transform for %s", key)
+		}
+	}
+
+	return nil
+}
+
+// pushConfig returns the push config of subscriptions created by `Subscriber`.
+func (c SubscriberConfig) pushConfig() pubsub.PushConfig {
+	if c.PushConfig != nil {
+		return *c.PushConfig
+	}
+	return c.SubscriptionConfig.PushConfig
+}
+
+// bigQueryConfig returns the BigQuery config of subscriptions created by `Subscriber`.
+func (c SubscriberConfig) bigQueryConfig() pubsub.BigQueryConfig {
+	if c.BigQueryConfig != nil {
+		return *c.BigQueryConfig
+	}
+	return c.SubscriptionConfig.BigQueryConfig
+}
+
+// checkPullDelivery returns an error if messages of subscriptions created by `Subscriber` can't be pulled.
+func (c SubscriberConfig) checkPullDelivery() error {
+	if c.pushConfig().Endpoint != "" {
+		return ErrPushSubscription
+	}
+	if c.bigQueryConfig().Table != "" {
+		return ErrBigQuerySubscription
+	}
+
+	return nil
+}
+
+// filter returns the filter of subscriptions created by `Subscriber`.
+// Filter takes precedence over SubscriptionConfig.Filter.
+func (c SubscriberConfig) filter() string {
+	if c.Filter != "" {
+		return c.Filter
+	}
+	return c.SubscriptionConfig.Filter
 }
 
 func NewSubscriber(
@@ -105,24 +717,106 @@ func NewSubscriber(
 ) (*Subscriber, error) {
 	config.setDefaults()
 
-	client, err := pubsub.NewClient(ctx, config.ProjectID, config.ClientOptions...)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	clientOpts := append(
+		grpcClientOptions(config.GRPCConnectionPoolSize, config.GRPCKeepalive, config.GRPCDialOptions),
+		config.ClientOptions...,
+	)
+	clientOpts, err := clientOptions(ctx, clientOpts, config.DisableEmulatorAutodetect)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := pubsub.NewClient(ctx, config.ProjectID, clientOpts...)
 	if err != nil {
 		return nil, err
 	}
 
+	s := newSubscriber(pubsubClient{client}, config, logger)
+	s.ownsClient = true
+
+	return s, nil
+}
+
+// NewSubscriberWithClient creates a Subscriber using a client created by the caller, for example shared with
+// other components or connected to an in-memory fake server (see cloud.google.com/go/pubsub/pstest) in tests.
+// ProjectID defaults to the project of the client, and ClientOptions and DisableEmulatorAutodetect are ignored.
+//
+// The client is not closed by Close, it's the responsibility of the caller.
+func NewSubscriberWithClient(
+	ctx context.Context,
+	client *pubsub.Client,
+	config SubscriberConfig,
+	logger watermill.LoggerAdapter,
+) (*Subscriber, error) {
+	if client == nil {
+		return nil, errors.New("missing client")
+	}
+	if config.ProjectID == "" {
+		config.ProjectID = client.Project()
+	}
+
+	return newSubscriberWithClient(pubsubClient{client}, config, logger)
+}
+
+// newSubscriberWithClient creates a Subscriber using the client, for example a fake one in tests.
+func newSubscriberWithClient(
+	client subscriberClient,
+	config SubscriberConfig,
+	logger watermill.LoggerAdapter,
+) (*Subscriber, error) {
+	config.setDefaults()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return newSubscriber(client, config, logger), nil
+}
+
+func newSubscriber(client subscriberClient, config SubscriberConfig, logger watermill.LoggerAdapter) *Subscriber {
+	var rateLimiter *rate.Limiter
+	if config.RateLimit != nil {
+		rateLimiter = rate.NewLimiter(rate.Limit(config.RateLimit.MessagesPerSecond), config.RateLimit.Burst)
+	}
+
+	var attempts *deliveryAttempts
+	if config.MaxDeliveryAttempts > 0 {
+		attempts = newDeliveryAttempts(deliveryAttemptsCacheSize)
+	}
+
 	return &Subscriber{
-		closing: make(chan struct{}, 1),
+		closing: make(chan struct{}),
 		closed:  false,
 
+		closeFinished: make(chan struct{}),
+
+		closeTimeoutExceeded: make(chan struct{}),
+
 		allSubscriptionsWaitGroup: sync.WaitGroup{},
+		drain:                     newDrainGroup(),
 		activeSubscriptions:       map[string]*pubsub.Subscription{},
 		activeSubscriptionsLock:   sync.RWMutex{},
+		createdSubscriptions:      map[string]*pubsub.Subscription{},
+		receivingSubscriptions:    map[string]struct{}{},
+		pausedSubscriptions:       map[string]chan struct{}{},
+		pausedSubscriptionsLock:   sync.RWMutex{},
+
+		errs: make(chan error, errorsChannelBuffer),
+
+		stats: subscriberStats{inFlight: map[string]map[*pubsub.Message]time.Time{}},
 
 		client: client,
 		config: config,
 
-		logger: logger,
-	}, nil
+		rateLimiter:      rateLimiter,
+		deliveryAttempts: attempts,
+
+		logger: newLogFieldsTransformingLogger(logger, config.LogFieldTransforms),
+	}
 }
 
 // Subscribe consumes Google Cloud Pub/Sub and outputs them as Waterfall Message objects on the returned channel.
@@ -131,15 +825,57 @@ func NewSubscriber(
 // Each subscription has one topic, but there may be multiple subscriptions to one topic (with different names).
 //
 // The `topic` argument is transformed into subscription name with the configured `GenerateSubscriptionName` function.
-// By default, if the subscription or topic don't exist, the are created. This behavior may be changed in the config.
+// By default, if the subscription doesn't exist, it is created, unless DoNotCreateSubscriptionIfMissing is set.
+// The topic of the created subscription is created only if CreateTopicIfMissing is set.
 //
 // Be aware that in Google Cloud Pub/Sub, only messages sent after the subscription was created can be consumed.
 //
+// The subscription is checked first. If it exists, the topic is not accessed, so only permissions
+// to the subscription are needed, for example to consume from a subscription of a topic of another team.
+//
+// If the subscription doesn't exist and DoNotCreateSubscriptionIfMissing is set, the returned error wraps
+// `ErrSubscriptionDoesNotExist`, without checking the topic. Otherwise, if the topic doesn't exist
+// and CreateTopicIfMissing is not set, it wraps `ErrTopicDoesNotExist`. Use errors.Is to check for them.
+//
+// Canceling ctx stops receiving from this subscription only and closes its output channel,
+// other subscriptions of the Subscriber keep receiving until Close is called.
+//
+// The output channel is closed only after receiving stopped and every message sent to it was acked or nacked,
+// including the ones nacked because they were buffered and not consumed, so nothing is sent to it once it's closed.
+//
+// Contexts of the delivered messages are derived from ctx, so they carry its values, for example a tenant ID.
+// They are canceled when the message is acked or nacked, when ctx is canceled, when the Subscriber is closed
+// or when MessageProcessingTimeout passes.
+//
 // See https://cloud.google.com/pubsub/docs/subscriber to find out more about how Google Cloud Pub/Sub Subscriptions work.
 func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	handle, err := s.SubscribeWithHandle(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return handle.messages, nil
+}
+
+// SubscribeWithHandle subscribes like Subscribe and returns a handle of the subscription, so it can be stopped
+// independently of the other subscriptions, waiting until it's fully stopped.
+func (s *Subscriber) SubscribeWithHandle(ctx context.Context, topic string) (*SubscriptionHandle, error) {
+	// the wait group is incremented under the same lock as closed is checked,
+	// so Close either rejects the subscription or waits for it to finish
+	s.closedLock.Lock()
 	if s.closed {
+		s.closedLock.Unlock()
 		return nil, ErrSubscriberClosed
 	}
+	s.allSubscriptionsWaitGroup.Add(1)
+	drain := s.drain
+	drain.wg.Add(1)
+	s.closedLock.Unlock()
+
+	subscriptionDone := func() {
+		drain.wg.Done()
+		s.allSubscriptionsWaitGroup.Done()
+	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	subscriptionName := s.config.GenerateSubscriptionName(topic)
@@ -151,17 +887,41 @@ func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *messa
 	}
 	s.logger.Info("Subscribing to Google Cloud PubSub topic", logFields)
 
-	output := make(chan *message.Message, 0)
+	output := make(chan *message.Message, s.config.OutputChannelBuffer)
+	handle := &SubscriptionHandle{
+		messages: output,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	if err := s.startReceiving(subscriptionName); err != nil {
+		cancel()
+		subscriptionDone()
+		return nil, err
+	}
 
 	sub, err := s.subscription(ctx, subscriptionName, topic)
 	if err != nil {
-		return nil, err
+		cancel()
+		s.stopReceiving(subscriptionName)
+		subscriptionDone()
+		return nil, errors.Wrapf(err, "cannot obtain subscription %s", subscriptionName)
 	}
+	if err := s.config.checkPullDelivery(); err != nil {
+		cancel()
+		s.stopReceiving(subscriptionName)
+		subscriptionDone()
+		return nil, errors.Wrapf(err, "cannot receive from subscription %s", subscriptionName)
+	}
+	// each subscription receives with its own handle, as the client library allows a single
+	// Receive per handle, and ReceiveSettings are set on the handle
+	sub = s.client.Subscription(sub.ID())
+
+	s.updateStats(func(stats *subscriberStats) { stats.activeSubscriptions++ })
 
 	receiveFinished := make(chan struct{})
-	s.allSubscriptionsWaitGroup.Add(1)
 	go func() {
-		err := s.receive(ctx, sub, logFields, output)
+		err := s.receive(ctx, topic, sub, drain.draining, logFields, output)
 		if err != nil {
 			s.logger.Error("Receiving messages failed", err, logFields)
 		}
@@ -169,18 +929,64 @@ func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *messa
 	}()
 
 	go func() {
-		<-s.closing
-		s.logger.Debug("Closing message consumer", logFields)
+		select {
+		case <-s.closing:
+			s.logger.Debug("Closing message consumer", logFields)
+			if s.config.CloseTimeout > 0 {
+				// in-flight messages may still need their context until they are acked or nacked
+				<-s.closeTimeoutExceeded
+			}
+		case <-drain.timeoutExceeded:
+			s.logger.Debug("Drain timed out, nacking in-flight messages", logFields)
+		case <-receiveFinished:
+		}
 		cancel()
 	}()
 
 	go func() {
 		<-receiveFinished
+		// buffered messages which were not consumed are already nacked
+		for len(output) > 0 {
+			<-output
+		}
 		close(output)
-		s.allSubscriptionsWaitGroup.Done()
+		s.stopReceiving(subscriptionName)
+		s.updateStats(func(stats *subscriberStats) { stats.activeSubscriptions-- })
+		subscriptionDone()
+		close(handle.done)
 	}()
 
-	return output, nil
+	return handle, nil
+}
+
+// startReceiving registers that the subscription is being received from.
+// It returns `ErrAlreadySubscribed` if it already is, unless AllowDuplicateSubscribe is set.
+func (s *Subscriber) startReceiving(subscriptionName string) error {
+	if s.config.AllowDuplicateSubscribe {
+		return nil
+	}
+
+	s.activeSubscriptionsLock.Lock()
+	defer s.activeSubscriptionsLock.Unlock()
+
+	if _, ok := s.receivingSubscriptions[subscriptionName]; ok {
+		return errors.Wrapf(ErrAlreadySubscribed, "subscription %s", subscriptionName)
+	}
+	s.receivingSubscriptions[subscriptionName] = struct{}{}
+
+	return nil
+}
+
+// stopReceiving unregisters the subscription registered with startReceiving.
+func (s *Subscriber) stopReceiving(subscriptionName string) {
+	if s.config.AllowDuplicateSubscribe {
+		return
+	}
+
+	s.activeSubscriptionsLock.Lock()
+	defer s.activeSubscriptionsLock.Unlock()
+
+	delete(s.receivingSubscriptions, subscriptionName)
 }
 
 func (s *Subscriber) SubscribeInitialize(topic string) (err error) {
@@ -196,103 +1002,771 @@ func (s *Subscriber) SubscribeInitialize(topic string) (err error) {
 	s.logger.Info("Initializing subscription to Google Cloud PubSub topic", logFields)
 
 	if _, err := s.subscription(ctx, subscriptionName, topic); err != nil {
-		return err
+		return errors.Wrapf(err, "cannot obtain subscription %s", subscriptionName)
 	}
 
 	return nil
 }
 
-// Close notifies the Subscriber to stop processing messages on all subscriptions, close all the output channels
-// and terminate the connection.
-func (s *Subscriber) Close() error {
-	if s.closed {
-		return nil
+// Subscription returns the Google Cloud client library subscription of the topic, for calling methods
+// not wrapped by Subscriber, like managing its IAM policy. The subscription is obtained like with Subscribe,
+// so it's created if missing unless DoNotCreateSubscriptionIfMissing is set.
+//
+// Subscribe receives with its own handle of the subscription, so the ReceiveSettings of the returned one
+// have no effect on it.
+func (s *Subscriber) Subscription(ctx context.Context, topic string) (*pubsub.Subscription, error) {
+	if s.isClosed() {
+		return nil, ErrSubscriberClosed
 	}
 
-	s.closed = true
-	close(s.closing)
-	s.allSubscriptionsWaitGroup.Wait()
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+
+	sub, err := s.subscription(ctx, subscriptionName, topic)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot obtain subscription %s", subscriptionName)
+	}
+
+	return sub, nil
+}
+
+// SubscriptionExists checks if the subscription for the topic exists, without creating anything,
+// regardless of DoNotCreateSubscriptionIfMissing and CreateTopicIfMissing.
+// The subscription name is resolved with the configured `GenerateSubscriptionName` function.
+func (s *Subscriber) SubscriptionExists(ctx context.Context, topic string) (bool, error) {
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+
+	exists, err := s.client.SubscriptionExists(ctx, subscriptionName)
+	if err != nil {
+		return false, existsError(err, "subscription", subscriptionName)
+	}
+
+	return exists, nil
+}
 
-	err := s.client.Close()
+// Seek marks all messages published to the topic since the given time as unacknowledged,
+// so they are delivered again to the subscription of the topic.
+// Acknowledged messages are available only if the subscription retains them (see RetainAckedMessages).
+func (s *Subscriber) Seek(ctx context.Context, topic string, t time.Time) error {
+	sub, err := s.existingSubscriptionForTopic(ctx, topic)
 	if err != nil {
 		return err
 	}
 
-	s.logger.Debug("Google Cloud PubSub subscriber closed", nil)
+	if err := sub.SeekToTime(ctx, t); err != nil {
+		return errors.Wrapf(err, "could not seek subscription %s to %s", sub.ID(), t)
+	}
+
 	return nil
 }
 
-func (s *Subscriber) receive(
-	ctx context.Context,
-	sub *pubsub.Subscription,
-	logFields watermill.LogFields,
-	output chan *message.Message,
-) error {
-	err := sub.Receive(ctx, func(ctx context.Context, pubsubMsg *pubsub.Message) {
-		msg, err := s.config.Unmarshaler.Unmarshal(pubsubMsg)
-		if err != nil {
-			s.logger.Error("Could not unmarshal Google Cloud PubSub message", err, logFields)
-			pubsubMsg.Nack()
-			return
-		}
+// SeekToSnapshot restores the subscription of the topic to the state captured by the snapshot.
+func (s *Subscriber) SeekToSnapshot(ctx context.Context, topic string, snapshotName string) error {
+	sub, err := s.existingSubscriptionForTopic(ctx, topic)
+	if err != nil {
+		return err
+	}
 
-		ctx, cancelCtx := context.WithCancel(ctx)
-		msg.SetContext(ctx)
-		defer cancelCtx()
+	if err := sub.SeekToSnapshot(ctx, s.client.Snapshot(snapshotName)); err != nil {
+		return errors.Wrapf(err, "could not seek subscription %s to snapshot %s", sub.ID(), snapshotName)
+	}
 
-		select {
-		case <-s.closing:
-			s.logger.Info(
-				"Message not consumed, subscriber is closing",
-				logFields,
-			)
-			pubsubMsg.Nack()
-			return
-		case <-ctx.Done():
-			s.logger.Info(
-				"Message not consumed, ctx canceled",
-				logFields,
-			)
-			pubsubMsg.Nack()
-			return
-		case output <- msg:
-			// message consumed, wait for ack (or nack)
+	return nil
+}
+
+// CreateSnapshot creates a snapshot of the subscription of the topic, which can be used with SeekToSnapshot.
+// It returns the time after which the snapshot expires.
+func (s *Subscriber) CreateSnapshot(ctx context.Context, topic string, snapshotName string) (time.Time, error) {
+	sub, err := s.existingSubscriptionForTopic(ctx, topic)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	snapshot, err := sub.CreateSnapshot(ctx, snapshotName)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "could not create snapshot %s of subscription %s", snapshotName, sub.ID())
+	}
+
+	return snapshot.Expiration, nil
+}
+
+// DeleteSnapshot deletes the snapshot.
+func (s *Subscriber) DeleteSnapshot(ctx context.Context, snapshotName string) error {
+	if err := s.client.Snapshot(snapshotName).Delete(ctx); err != nil {
+		return errors.Wrapf(err, "could not delete snapshot %s", snapshotName)
+	}
+
+	return nil
+}
+
+func (s *Subscriber) existingSubscriptionForTopic(ctx context.Context, topic string) (*pubsub.Subscription, error) {
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+	exists, err := s.client.SubscriptionExists(ctx, subscriptionName)
+	if err != nil {
+		return nil, existsError(err, "subscription", subscriptionName)
+	}
+	if !exists {
+		return nil, errors.Wrap(ErrSubscriptionDoesNotExist, subscriptionName)
+	}
+
+	return s.client.Subscription(subscriptionName), nil
+}
+
+// Close notifies the Subscriber to stop processing messages on all subscriptions, close all the output channels
+// and terminate the connection.
+//
+// When SubscriberConfig.CloseTimeout is set, in-flight messages have until the timeout to be acked or nacked.
+// The connection is terminated even if the timeout is exceeded.
+//
+// Close is safe to call multiple times and concurrently, the subsequent calls wait for the first one to finish
+// and return the same error.
+func (s *Subscriber) Close() error {
+	s.closedLock.Lock()
+	if s.closed {
+		s.closedLock.Unlock()
+		<-s.closeFinished
+		return s.closeErr
+	}
+	s.closed = true
+	close(s.closing)
+	s.closedLock.Unlock()
+
+	s.closeErr = s.close()
+	close(s.closeFinished)
+
+	return s.closeErr
+}
+
+func (s *Subscriber) close() (err error) {
+	if s.config.CloseTimeout > 0 {
+		allSubscriptionsDone := make(chan struct{})
+		go func() {
+			s.allSubscriptionsWaitGroup.Wait()
+			close(allSubscriptionsDone)
+		}()
+
+		select {
+		case <-allSubscriptionsDone:
+		case <-s.config.clock.After(s.config.CloseTimeout):
+			s.logger.Info("Close timeout exceeded, nacking in-flight messages", watermill.LogFields{
+				"close_timeout": s.config.CloseTimeout,
+			})
+			err = errors.Wrapf(ErrCloseTimeout, "in-flight messages were not processed within %s", s.config.CloseTimeout)
+		}
+		close(s.closeTimeoutExceeded)
+	}
+
+	s.allSubscriptionsWaitGroup.Wait()
+	close(s.errs)
+
+	if s.config.DeleteSubscriptionOnClose {
+		if deleteErr := s.deleteCreatedSubscriptions(); deleteErr != nil {
+			if err != nil {
+				err = multierror.Append(err, deleteErr)
+			} else {
+				err = deleteErr
+			}
 		}
+	}
+
+	if s.ownsClient {
+		if closeErr := s.client.Close(); closeErr != nil {
+			if err != nil {
+				return multierror.Append(err, closeErr)
+			}
+			return closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.logger.Debug("Google Cloud PubSub subscriber closed", nil)
+	return nil
+}
+
+// deleteCreatedSubscriptions deletes the subscriptions created by `Subscriber`.
+func (s *Subscriber) deleteCreatedSubscriptions() error {
+	s.activeSubscriptionsLock.Lock()
+	defer s.activeSubscriptionsLock.Unlock()
+
+	var err error
+	for name, sub := range s.createdSubscriptions {
+		if deleteErr := sub.Delete(context.Background()); deleteErr != nil {
+			err = multierror.Append(err, errors.Wrapf(deleteErr, "cannot delete subscription %s", name))
+			continue
+		}
+
+		delete(s.createdSubscriptions, name)
+		delete(s.activeSubscriptions, name)
+		s.logger.Debug("Subscription deleted", watermill.LogFields{"subscription_name": name})
+	}
+
+	return err
+}
+
+func (s *Subscriber) isClosed() bool {
+	s.closedLock.Lock()
+	defer s.closedLock.Unlock()
+
+	return s.closed
+}
+
+func (s *Subscriber) receive(
+	ctx context.Context,
+	topic string,
+	sub *pubsub.Subscription,
+	draining <-chan struct{},
+	logFields watermill.LogFields,
+	output chan *message.Message,
+) error {
+	sub.ReceiveSettings = s.config.ReceiveSettings
+
+	var deliverySemaphore chan struct{}
+	if s.config.MaxConcurrentDelivery > 0 {
+		deliverySemaphore = make(chan struct{}, s.config.MaxConcurrentDelivery)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.receiveAttempt(ctx, topic, sub, deliverySemaphore, draining, logFields, output)
+		if err == nil || s.isClosed() || ctx.Err() != nil || isDraining(draining) {
+			s.setReceiveStopped(ctx, sub)
+			return nil
+		}
+		err = errors.Wrapf(err, "receiving from subscription %s failed", sub.ID())
+		s.setLastError(err, sub)
+		s.sendError(err)
+
+		if s.config.ReconnectMaxAttempts > 0 && attempt >= s.config.ReconnectMaxAttempts {
+			return errors.Wrapf(err, "receive failed after %d attempts", attempt)
+		}
+
+		s.logger.Error("Receive failed, retrying", err, logFields.Add(watermill.LogFields{
+			"attempt":        attempt,
+			"retry_interval": s.config.ReconnectRetryInterval,
+		}))
 
 		select {
 		case <-s.closing:
-			pubsubMsg.Nack()
-			s.logger.Trace(
-				"Closing, nacking message",
-				logFields,
-			)
+			s.setReceiveStopped(ctx, sub)
+			return nil
 		case <-ctx.Done():
-			pubsubMsg.Nack()
-			s.logger.Trace(
-				"Ctx done, nacking message",
-				logFields,
-			)
+			s.setReceiveStopped(ctx, sub)
+			return nil
+		case <-draining:
+			s.setReceiveStopped(ctx, sub)
+			return nil
+		case <-s.config.clock.After(s.config.ReconnectRetryInterval):
+			// retry
+		}
+	}
+}
+
+// Pause stops delivering messages of the subscription for the topic until Resume is called,
+// for example during a maintenance window of a downstream service. The subscription keeps receiving.
+//
+// Messages received while paused wait, leased from Pub/Sub, and are delivered after Resume.
+// The client library stops pulling more messages once ReceiveSettings.MaxOutstandingMessages are waiting,
+// and extends their ack deadline up to ReceiveSettings.MaxExtension, after which they are redelivered.
+// When the subscriber is closed, the waiting messages are nacked.
+//
+// A topic may be paused before subscribing to it.
+func (s *Subscriber) Pause(topic string) {
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+
+	s.pausedSubscriptionsLock.Lock()
+	defer s.pausedSubscriptionsLock.Unlock()
+
+	if _, ok := s.pausedSubscriptions[subscriptionName]; !ok {
+		s.pausedSubscriptions[subscriptionName] = make(chan struct{})
+		s.logger.Info("Subscription paused", watermill.LogFields{"subscription_name": subscriptionName})
+	}
+}
+
+// Resume resumes delivering messages of the subscription for the topic stopped with Pause.
+// Resuming a subscription which is not paused does nothing.
+func (s *Subscriber) Resume(topic string) {
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+
+	s.pausedSubscriptionsLock.Lock()
+	defer s.pausedSubscriptionsLock.Unlock()
+
+	if resumed, ok := s.pausedSubscriptions[subscriptionName]; ok {
+		close(resumed)
+		delete(s.pausedSubscriptions, subscriptionName)
+		s.logger.Info("Subscription resumed", watermill.LogFields{"subscription_name": subscriptionName})
+	}
+}
+
+// resumed returns a channel closed when the subscription is resumed, or nil if it's not paused.
+func (s *Subscriber) resumed(subscriptionName string) chan struct{} {
+	s.pausedSubscriptionsLock.RLock()
+	defer s.pausedSubscriptionsLock.RUnlock()
+
+	return s.pausedSubscriptions[subscriptionName]
+}
+
+// LastError returns the last error of receiving messages from any of the subscriptions, or nil if there was none.
+// When receiving is stopped by Close, Drain or canceling the context of Subscribe, the error is the error
+// of the context, like context.Canceled, so a clean shutdown can be told apart from a failure, which is
+// also sent to the Errors channel.
+//
+// A failure of one subscription is not replaced by another subscription stopping cleanly.
+func (s *Subscriber) LastError() error {
+	s.lastErrLock.Lock()
+	defer s.lastErrLock.Unlock()
+
+	return s.lastErr
+}
+
+func (s *Subscriber) setLastError(err error, sub *pubsub.Subscription) {
+	s.lastErrLock.Lock()
+	defer s.lastErrLock.Unlock()
+
+	s.lastErr = err
+	s.lastErrStopped = false
+	s.lastErrSubscription = sub.String()
+}
+
+// setReceiveStopped sets the last error to the error of receiving from sub stopped cleanly,
+// unless the last error is a failure of another subscription.
+func (s *Subscriber) setReceiveStopped(ctx context.Context, sub *pubsub.Subscription) {
+	s.lastErrLock.Lock()
+	defer s.lastErrLock.Unlock()
+
+	if s.lastErr != nil && !s.lastErrStopped && s.lastErrSubscription != sub.String() {
+		return
+	}
+
+	s.lastErr = receiveStoppedError(ctx)
+	s.lastErrStopped = true
+	s.lastErrSubscription = sub.String()
+}
+
+// receiveStoppedError returns the error of receiving stopped because of Close, Drain or canceled ctx.
+func receiveStoppedError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return context.Canceled
+}
+
+// Errors returns a channel with the errors of receiving messages, including the failed attempts which are retried,
+// so they can be acted upon, for example by restarting the subscription or alerting.
+// The errors are logged as well. When the channel is full, the next errors are only logged.
+// The channel is closed on Close.
+func (s *Subscriber) Errors() <-chan error {
+	return s.errs
+}
+
+// sendError sends err to the channel returned by Errors without blocking.
+func (s *Subscriber) sendError(err error) {
+	select {
+	case s.errs <- err:
+	default:
+	}
+}
+
+// receiveAttempt receives on a fresh context, so nothing started by a failed attempt outlives it.
+// Receiving stops as soon as the subscriber is closing, but message contexts are derived from ctx,
+// so in-flight messages keep their context until ctx is canceled.
+//
+// When deliverySemaphore is not nil, a message is delivered only once a slot is acquired,
+// and the slot is released after the message is acked or nacked.
+func (s *Subscriber) receiveAttempt(
+	ctx context.Context,
+	topic string,
+	sub *pubsub.Subscription,
+	deliverySemaphore chan struct{},
+	draining <-chan struct{},
+	logFields watermill.LogFields,
+	output chan *message.Message,
+) error {
+	receiveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-draining:
+			// in-flight messages are processed, as their context isn't derived from receiveCtx
+			cancel()
+		case <-receiveCtx.Done():
+		}
+	}()
+
+	return sub.Receive(receiveCtx, func(_ context.Context, pubsubMsg *pubsub.Message) {
+		delivery := &messageDelivery{received: s.config.clock.Now()}
+		s.config.MetricsHook.OnReceive(topic)
+
+		logFields := logFields.Add(watermill.LogFields{"message_id": pubsubMsg.ID})
+		if pubsubMsg.OrderingKey != "" {
+			logFields["ordering_key"] = pubsubMsg.OrderingKey
+		}
+
+		if s.exceededMaxDeliveryAttempts(pubsubMsg, logFields) {
+			s.ack(topic, pubsubMsg, delivery, logFields)
+			return
+		}
+
+		if resumed := s.resumed(sub.ID()); resumed != nil {
+			select {
+			case <-resumed:
+			case <-receiveCtx.Done():
+				s.nack(topic, pubsubMsg, delivery, logFields)
+				return
+			}
+		}
+
+		if deliverySemaphore != nil {
+			select {
+			case deliverySemaphore <- struct{}{}:
+				defer func() { <-deliverySemaphore }()
+			case <-receiveCtx.Done():
+				s.nack(topic, pubsubMsg, delivery, logFields)
+				return
+			}
+		}
+
+		if s.rateLimiter != nil {
+			if err := s.rateLimiter.Wait(receiveCtx); err != nil {
+				// receiving stopped while waiting
+				s.nack(topic, pubsubMsg, delivery, logFields)
+				return
+			}
+		}
+
+		s.handleMessage(ctx, topic, sub.ID(), pubsubMsg, delivery, draining, logFields, output)
+	})
+}
+
+func (s *Subscriber) handleMessage(
+	ctx context.Context,
+	topic string,
+	subscriptionName string,
+	pubsubMsg *pubsub.Message,
+	delivery *messageDelivery,
+	draining <-chan struct{},
+	logFields watermill.LogFields,
+	output chan *message.Message,
+) {
+	msg, err := s.config.Unmarshaler.Unmarshal(pubsubMsg)
+	if err != nil {
+		s.logger.Error("Could not unmarshal Google Cloud PubSub message", err, logFields)
+		s.config.MetricsHook.OnUnmarshalError(topic, err)
+
+		action := s.config.OnUnmarshalError
+		if s.config.UnmarshalErrorHandler != nil {
+			msg, action = s.config.UnmarshalErrorHandler(pubsubMsg, err)
+		}
+		if msg == nil {
+			if action == UnmarshalErrorAck {
+				s.ack(topic, pubsubMsg, delivery, logFields)
+				return
+			}
+			s.nack(topic, pubsubMsg, delivery, logFields)
+			return
+		}
+
+		s.logger.Debug("Delivering message salvaged by UnmarshalErrorHandler", logFields)
+	}
+
+	if !s.config.DisableOriginMetadata {
+		if msg.Metadata == nil {
+			msg.Metadata = make(message.Metadata)
+		}
+		msg.Metadata.Set(SubscriptionMetadataKey, subscriptionName)
+		msg.Metadata.Set(TopicMetadataKey, topic)
+	}
+
+	if routingKey, ok := pubsubMsg.Attributes[s.config.RoutingKeyAttribute]; ok && s.config.RoutingKeyAttribute != "" {
+		if msg.Metadata == nil {
+			msg.Metadata = make(message.Metadata)
+		}
+		msg.Metadata.Set(RoutingKeyMetadataKey, routingKey)
+	}
+
+	subscriptionCtx := ctx
+	var cancelCtx context.CancelFunc
+	if s.config.MessageProcessingTimeout > 0 {
+		ctx, cancelCtx = context.WithTimeout(ctx, s.config.MessageProcessingTimeout)
+	} else {
+		ctx, cancelCtx = context.WithCancel(ctx)
+	}
+	msg.SetContext(ctx)
+	defer cancelCtx()
+
+	var deliveryTimeout <-chan time.Time
+	if s.config.DeliveryTimeout > 0 {
+		deliveryTimer := s.config.clock.NewTimer(s.config.DeliveryTimeout)
+		defer deliveryTimer.Stop()
+		deliveryTimeout = deliveryTimer.C()
+	}
+
+	select {
+	case <-s.closing:
+		s.logger.Info(
+			"Message not consumed, subscriber is closing",
+			logFields,
+		)
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		return
+	case <-ctx.Done():
+		s.logger.Info(
+			"Message not consumed, ctx canceled",
+			logFields,
+		)
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		return
+	case <-draining:
+		s.logger.Info(
+			"Message not consumed, subscriber is draining",
+			logFields,
+		)
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		return
+	case <-deliveryTimeout:
+		s.logger.Info(
+			"Message not consumed within DeliveryTimeout, nacking",
+			logFields,
+		)
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		return
+	case output <- msg:
+		// message consumed, wait for ack (or nack)
+	}
+
+	removeInFlight := s.addInFlight(topic, pubsubMsg)
+	defer removeInFlight()
+
+	// the callback blocks until the message is acked or nacked, so when message ordering is enabled
+	// the client library doesn't deliver the next message with the same ordering key before this one is processed
+	select {
+	case <-s.closing:
+		if s.config.CloseTimeout > 0 {
+			s.waitForAckUntilCloseTimeout(topic, msg, pubsubMsg, delivery, logFields)
+			return
+		}
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		s.logger.Trace(
+			"Closing, nacking message",
+			logFields,
+		)
+	case <-ctx.Done():
+		// ctx is canceled also when the subscriber is closing, after CloseTimeout if it is set
+		if s.config.CloseTimeout > 0 && s.isClosed() {
+			s.waitForAckUntilCloseTimeout(topic, msg, pubsubMsg, delivery, logFields)
+			return
+		}
+		select {
 		case <-msg.Acked():
-			s.logger.Trace(
-				"Msg acked",
-				logFields,
-			)
-			pubsubMsg.Ack()
-		case <-msg.Nacked():
-			pubsubMsg.Nack()
-			s.logger.Trace(
-				"Msg nacked",
+			// acked right before ctx was canceled, for example by SubscribeN
+			s.ack(topic, pubsubMsg, delivery, logFields)
+			return
+		default:
+		}
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		if subscriptionCtx.Err() == nil {
+			s.logger.Info(
+				"Message not processed within MessageProcessingTimeout, nacked",
 				logFields,
 			)
+			return
 		}
+		s.logger.Trace(
+			"Ctx done, nacking message",
+			logFields,
+		)
+	case <-msg.Acked():
+		s.logger.Trace(
+			"Msg acked",
+			logFields,
+		)
+		s.ack(topic, pubsubMsg, delivery, logFields)
+	case <-msg.Nacked():
+		if s.config.NackDelayFromMetadata {
+			s.delayNack(msg, logFields)
+		}
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		s.logger.Trace(
+			"Msg nacked",
+			logFields,
+		)
+	}
+}
+
+func (s *Subscriber) waitForAckUntilCloseTimeout(
+	topic string,
+	msg *message.Message,
+	pubsubMsg *pubsub.Message,
+	delivery *messageDelivery,
+	logFields watermill.LogFields,
+) {
+	select {
+	case <-s.closeTimeoutExceeded:
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		s.logger.Trace(
+			"Close timeout exceeded, nacking message",
+			logFields,
+		)
+	case <-msg.Acked():
+		s.logger.Trace(
+			"Msg acked",
+			logFields,
+		)
+		s.ack(topic, pubsubMsg, delivery, logFields)
+	case <-msg.Nacked():
+		s.nack(topic, pubsubMsg, delivery, logFields)
+		s.logger.Trace(
+			"Msg nacked",
+			logFields,
+		)
+	}
+}
+
+func (s *Subscriber) ack(topic string, pubsubMsg *pubsub.Message, delivery *messageDelivery, logFields watermill.LogFields) {
+	if !s.acknowledge(delivery, "ack", logFields) {
+		return
+	}
+	defer func() { s.config.MetricsHook.OnAck(topic, s.config.clock.Now().Sub(delivery.received)) }()
+
+	if s.deliveryAttempts != nil {
+		s.deliveryAttempts.forget(pubsubMsg)
+	}
+
+	if !s.config.EnableExactlyOnceDelivery {
+		pubsubMsg.Ack()
+		return
+	}
+
+	s.waitForAckResult("ack", pubsubMsg.AckWithResult(), logFields)
+}
+
+// exceededMaxDeliveryAttempts counts the delivery of the message and tells if it should be dropped,
+// as it was delivered more than MaxDeliveryAttempts times.
+func (s *Subscriber) exceededMaxDeliveryAttempts(pubsubMsg *pubsub.Message, logFields watermill.LogFields) bool {
+	if s.deliveryAttempts == nil {
+		return false
+	}
+
+	attempts := s.deliveryAttempts.add(pubsubMsg)
+	if attempts <= s.config.MaxDeliveryAttempts {
+		return false
+	}
+
+	logFields = logFields.Add(watermill.LogFields{
+		"delivery_attempt":      attempts,
+		"max_delivery_attempts": s.config.MaxDeliveryAttempts,
 	})
+	if s.config.OnMaxDeliveryAttempts == MaxDeliveryAttemptsLog {
+		s.logger.Info("Message exceeded MaxDeliveryAttempts, delivering anyway", logFields)
+		return false
+	}
 
-	if err != nil && !s.closed {
-		s.logger.Error("Receive failed", err, logFields)
-		return err
+	s.logger.Error("Message exceeded MaxDeliveryAttempts, dropping", ErrMaxDeliveryAttemptsExceeded, logFields)
+	return true
+}
+
+// delayNack waits for the duration in the `NackDelayMetadataKey` metadata of the message,
+// or until the subscriber is closing.
+func (s *Subscriber) delayNack(msg *message.Message, logFields watermill.LogFields) {
+	value := msg.Metadata.Get(NackDelayMetadataKey)
+	if value == "" {
+		return
 	}
 
-	return nil
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		s.logger.Error("Invalid nack delay in message metadata, nacking at once", err, logFields.Add(watermill.LogFields{
+			"nack_delay": value,
+		}))
+		return
+	}
+
+	s.logger.Trace("Delaying nack", logFields.Add(watermill.LogFields{
+		"nack_delay": delay,
+	}))
+
+	select {
+	case <-s.closing:
+	case <-s.config.clock.After(delay):
+	}
+}
+
+func (s *Subscriber) nack(topic string, pubsubMsg *pubsub.Message, delivery *messageDelivery, logFields watermill.LogFields) {
+	if !s.acknowledge(delivery, "nack", logFields) {
+		return
+	}
+	defer func() { s.config.MetricsHook.OnNack(topic, s.config.clock.Now().Sub(delivery.received)) }()
+
+	if !s.config.EnableExactlyOnceDelivery {
+		pubsubMsg.Nack()
+		return
+	}
+
+	s.waitForAckResult("nack", pubsubMsg.NackWithResult(), logFields)
+}
+
+// messageDelivery is the state of a Pub/Sub message being received, which lives as long as its receive callback.
+type messageDelivery struct {
+	received time.Time
+
+	acknowledged     bool
+	acknowledgedLock sync.Mutex
+}
+
+// acknowledge returns true if the Pub/Sub message wasn't acked or nacked yet, so it's acked or nacked exactly once,
+// even under exactly-once delivery, where a second ack or nack fails.
+func (s *Subscriber) acknowledge(delivery *messageDelivery, action string, logFields watermill.LogFields) bool {
+	delivery.acknowledgedLock.Lock()
+	defer delivery.acknowledgedLock.Unlock()
+
+	if delivery.acknowledged {
+		s.logger.Info("Message already acked or nacked, ignoring "+action, logFields)
+		return false
+	}
+	delivery.acknowledged = true
+
+	return true
+}
+
+// waitForAckResult blocks until Pub/Sub confirms the ack or nack of a message with exactly-once delivery.
+//
+// The client library retries confirmations for minutes, so waiting is bounded by the ack deadline
+// (after which the message is redelivered anyway) and by CloseTimeout when closing.
+func (s *Subscriber) waitForAckResult(action string, result *pubsub.AckResult, logFields watermill.LogFields) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.ackResultTimeout())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.closeTimeoutExceeded:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	status, err := result.Get(ctx)
+	if err != nil {
+		s.logger.Error("Message "+action+" failed", err, logFields.Add(watermill.LogFields{
+			"ack_status": status,
+		}))
+		return
+	}
+
+	s.logger.Trace("Message "+action+" confirmed", logFields)
+}
+
+func (s *Subscriber) ackResultTimeout() time.Duration {
+	if s.config.AckDeadline != 0 {
+		return s.config.AckDeadline
+	}
+	if s.config.SubscriptionConfig.AckDeadline != 0 {
+		return s.config.SubscriptionConfig.AckDeadline
+	}
+
+	return defaultAckDeadline
 }
 
 // subscription obtains a subscription object.
@@ -314,70 +1788,354 @@ func (s *Subscriber) subscription(ctx context.Context, subscriptionName, topicNa
 	}()
 
 	sub = s.client.Subscription(subscriptionName)
-	exists, err := sub.Exists(ctx)
+	var exists bool
+	err = s.retryTransient(ctx, "check if subscription exists", func() (err error) {
+		exists, err = s.client.SubscriptionExists(ctx, subscriptionName)
+		return err
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not check if subscription %s exists", subscriptionName)
+		return nil, existsError(err, "subscription", subscriptionName)
 	}
 
 	if exists {
 		return s.existingSubscription(ctx, sub, topicName)
 	}
 
+	// the topic is needed only to create the subscription, so it's not checked when creating is forbidden
 	if s.config.DoNotCreateSubscriptionIfMissing {
 		return nil, errors.Wrap(ErrSubscriptionDoesNotExist, subscriptionName)
 	}
 
-	t := s.client.Topic(topicName)
-	exists, err = t.Exists(ctx)
+	t, err := s.topic(ctx, topicName)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not check if topic %s exists", topicName)
+		return nil, err
 	}
 
-	if !exists && s.config.DoNotCreateTopicIfMissing {
-		return nil, errors.Wrap(ErrTopicDoesNotExist, topicName)
+	config, err := s.subscriptionConfig(ctx, t)
+	if err != nil {
+		return nil, err
 	}
 
-	if !exists {
-		t, err = s.client.CreateTopic(ctx, topicName)
+	err = s.retryTransient(ctx, "create subscription", func() (err error) {
+		sub, err = s.client.CreateSubscription(ctx, subscriptionName, config)
+		return err
+	})
+	if grpc.Code(err) == codes.AlreadyExists {
+		s.logger.Debug("Subscription already exists", watermill.LogFields{"subscription_name": subscriptionName})
+		sub = s.client.Subscription(subscriptionName)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "cannot create subscription")
+	} else {
+		s.createdSubscriptions[subscriptionName] = sub
+		if s.config.OnSubscriptionCreated != nil {
+			s.config.OnSubscriptionCreated(subscriptionName)
+		}
+	}
+
+	return sub, nil
+}
 
-		if grpc.Code(err) == codes.AlreadyExists {
-			s.logger.Debug("Topic already exists", watermill.LogFields{"topic": topicName})
-			t = s.client.Topic(topicName)
-		} else if err != nil {
-			return nil, errors.Wrap(err, "could not create topic for subscription")
+// subscriptionConfig returns the config of subscriptions to the topic created by `Subscriber`.
+func (s *Subscriber) subscriptionConfig(ctx context.Context, t *pubsub.Topic) (pubsub.SubscriptionConfig, error) {
+	var deadLetterTopic *pubsub.Topic
+	if s.config.DeadLetterPolicy != nil {
+		var err error
+		deadLetterTopic, err = s.topic(ctx, s.config.DeadLetterPolicy.DeadLetterTopic)
+		if err != nil {
+			return pubsub.SubscriptionConfig{}, errors.Wrap(err, "could not obtain dead letter topic")
 		}
 	}
 
+	return s.subscriptionConfigWithDeadLetterTopic(ctx, t, deadLetterTopic), nil
+}
+
+// subscriptionConfigWithDeadLetterTopic returns the settings of the subscription created for the topic,
+// with deadLetterTopic as the topic of the dead letter policy.
+func (s *Subscriber) subscriptionConfigWithDeadLetterTopic(
+	ctx context.Context,
+	t *pubsub.Topic,
+	deadLetterTopic *pubsub.Topic,
+) pubsub.SubscriptionConfig {
 	config := s.config.SubscriptionConfig
+	if s.config.SubscriptionConfigFn != nil {
+		config = s.config.SubscriptionConfigFn(ctx, t.ID())
+	}
 	config.Topic = t
+	if s.config.EnableMessageOrdering {
+		config.EnableMessageOrdering = true
+	}
 
-	sub, err = s.client.CreateSubscription(ctx, subscriptionName, config)
+	if s.config.EnableExactlyOnceDelivery {
+		config.EnableExactlyOnceDelivery = true
+	}
+	if s.config.AckDeadline != 0 {
+		config.AckDeadline = s.config.AckDeadline
+	}
+	if s.config.Labels != nil {
+		config.Labels = s.config.Labels
+	}
+	if s.config.RetainAckedMessages {
+		config.RetainAckedMessages = true
+	}
+	if s.config.RetentionDuration != 0 {
+		config.RetentionDuration = s.config.RetentionDuration
+	}
+	if s.config.Filter != "" {
+		config.Filter = s.config.Filter
+	}
+	if s.config.PushConfig != nil {
+		config.PushConfig = *s.config.PushConfig
+	}
+	if s.config.BigQueryConfig != nil {
+		config.BigQueryConfig = *s.config.BigQueryConfig
+	}
+
+	if s.config.DeadLetterPolicy != nil {
+		config.DeadLetterPolicy = &pubsub.DeadLetterPolicy{
+			DeadLetterTopic:     deadLetterTopic.String(),
+			MaxDeliveryAttempts: s.config.DeadLetterPolicy.MaxDeliveryAttempts,
+		}
+	}
+
+	if s.config.RetryPolicy != nil {
+		config.RetryPolicy = s.config.RetryPolicy.pubsubRetryPolicy()
+	}
+
+	return config
+}
+
+func (p RetryPolicy) validate() error {
+	const maxBackoff = 600 * time.Second
+
+	if p.MinimumBackoff < 0 || p.MinimumBackoff > maxBackoff {
+		return errors.Errorf("MinimumBackoff must be between 0 and %s, got %s", maxBackoff, p.MinimumBackoff)
+	}
+	if p.MaximumBackoff < 0 || p.MaximumBackoff > maxBackoff {
+		return errors.Errorf("MaximumBackoff must be between 0 and %s, got %s", maxBackoff, p.MaximumBackoff)
+	}
+	if p.MinimumBackoff != 0 && p.MaximumBackoff != 0 && p.MinimumBackoff > p.MaximumBackoff {
+		return errors.Errorf(
+			"MinimumBackoff (%s) must not be greater than MaximumBackoff (%s)",
+			p.MinimumBackoff,
+			p.MaximumBackoff,
+		)
+	}
+
+	return nil
+}
+
+func (p RetryPolicy) pubsubRetryPolicy() *pubsub.RetryPolicy {
+	retryPolicy := &pubsub.RetryPolicy{}
+	if p.MinimumBackoff != 0 {
+		retryPolicy.MinimumBackoff = p.MinimumBackoff
+	}
+	if p.MaximumBackoff != 0 {
+		retryPolicy.MaximumBackoff = p.MaximumBackoff
+	}
+
+	return retryPolicy
+}
+
+// topic obtains a topic object.
+// If topic doesn't exist on PubSub, create it if config variable CreateTopicIfMissing is set.
+func (s *Subscriber) topic(ctx context.Context, topicName string) (*pubsub.Topic, error) {
+	t := s.client.Topic(topicName)
+	var exists bool
+	err := s.retryTransient(ctx, "check if topic exists", func() (err error) {
+		exists, err = s.client.TopicExists(ctx, topicName)
+		return err
+	})
+	if err != nil {
+		return nil, existsError(err, "topic", topicName)
+	}
+
+	if exists {
+		if err := checkTopicKMSKeyName(ctx, t, s.config.KMSKeyName, s.logger); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	if !s.config.CreateTopicIfMissing {
+		return nil, errors.Wrap(ErrTopicDoesNotExist, topicName)
+	}
+
+	err = s.retryTransient(ctx, "create topic", func() (err error) {
+		t, err = s.client.CreateTopicWithConfig(ctx, topicName, &pubsub.TopicConfig{KMSKeyName: s.config.KMSKeyName})
+		return err
+	})
 	if grpc.Code(err) == codes.AlreadyExists {
-		s.logger.Debug("Subscription already exists", watermill.LogFields{"subscription": subscriptionName})
-		sub = s.client.Subscription(subscriptionName)
+		s.logger.Debug("Topic already exists", watermill.LogFields{"topic": topicName})
+		t = s.client.Topic(topicName)
 	} else if err != nil {
-		return nil, errors.Wrap(err, "cannot create subscription")
+		return nil, errors.Wrapf(err, "could not create topic %s", topicName)
+	} else if s.config.OnTopicCreated != nil {
+		s.config.OnTopicCreated(topicName)
 	}
 
-	sub.ReceiveSettings = s.config.ReceiveSettings
+	return t, nil
+}
 
-	return sub, nil
+// retryTransient calls fn until it succeeds or fails with an error which is not transient,
+// at most CreateRetryPolicy.MaxAttempts times, waiting between attempts with an exponential backoff.
+func (s *Subscriber) retryTransient(ctx context.Context, action string, fn func() error) error {
+	interval := s.config.CreateRetryPolicy.Interval
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransient(err) || attempt >= s.config.CreateRetryPolicy.MaxAttempts {
+			return err
+		}
+
+		s.logger.Info("Transient error, retrying", watermill.LogFields{
+			"action":         action,
+			"attempt":        attempt,
+			"retry_interval": interval,
+			"err":            err,
+		})
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-s.config.clock.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// isTransient is true for errors of calls to Pub/Sub which may succeed when retried.
+func isTransient(err error) bool {
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.Internal, codes.Aborted, codes.ResourceExhausted, codes.Unknown:
+		return true
+	default:
+		return false
+	}
 }
 
-func (s Subscriber) existingSubscription(ctx context.Context, sub *pubsub.Subscription, topic string) (*pubsub.Subscription, error) {
+func (s *Subscriber) existingSubscription(ctx context.Context, sub *pubsub.Subscription, topic string) (*pubsub.Subscription, error) {
 	config, err := sub.Config(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not fetch config for existing subscription")
 	}
 
+	if err := s.checkExistingSubscription(config, topic); err != nil {
+		return nil, err
+	}
+
+	if s.config.UpdateSubscriptionIfExists {
+		if err := s.updateSubscription(ctx, sub, config); err != nil {
+			return nil, err
+		}
+	}
+
+	return sub, nil
+}
+
+// checkExistingSubscription checks if the existing subscription can be used for the topic.
+func (s *Subscriber) checkExistingSubscription(config pubsub.SubscriptionConfig, topic string) error {
 	fullyQualifiedTopicName := fmt.Sprintf("projects/%s/topics/%s", s.config.ProjectID, topic)
 
 	if config.Topic.String() != fullyQualifiedTopicName {
-		return nil, errors.Wrap(
-			ErrUnexpectedTopic,
-			fmt.Sprintf("topic of existing sub: %s; expecting: %s", config.Topic.String(), fullyQualifiedTopicName),
+		if s.config.IgnoreTopicMismatch {
+			s.logger.Info("Existing subscription is attached to another topic, ignoring", watermill.LogFields{
+				"subscription_topic": config.Topic.String(),
+				"expected_topic":     fullyQualifiedTopicName,
+			})
+		} else {
+			return errors.Wrap(
+				ErrSubscriptionTopicMismatch,
+				fmt.Sprintf("topic of existing sub: %s; expecting: %s", config.Topic.String(), fullyQualifiedTopicName),
+			)
+		}
+	}
+
+	if expectedFilter := s.config.filter(); config.Filter != expectedFilter {
+		return errors.Wrap(
+			ErrUnexpectedFilter,
+			fmt.Sprintf("filter of existing sub: %q; expecting: %q", config.Filter, expectedFilter),
 		)
 	}
 
-	return sub, nil
+	return nil
+}
+
+// updateSubscription updates the mutable properties of the existing subscription which differ from the configured ones.
+// Properties which are not configured are left unchanged.
+func (s *Subscriber) updateSubscription(
+	ctx context.Context,
+	sub *pubsub.Subscription,
+	existing pubsub.SubscriptionConfig,
+) error {
+	logFields := watermill.LogFields{"subscription_name": sub.ID()}
+
+	expected, err := s.subscriptionConfig(ctx, existing.Topic)
+	if err != nil {
+		return err
+	}
+
+	if expected.EnableMessageOrdering != existing.EnableMessageOrdering {
+		s.logger.Info("Message ordering of existing subscription differs, but it can't be updated", logFields.Add(
+			watermill.LogFields{"enable_message_ordering": existing.EnableMessageOrdering},
+		))
+	}
+
+	update := s.subscriptionUpdate(existing, expected)
+	if reflect.DeepEqual(update, pubsub.SubscriptionConfigToUpdate{}) {
+		return nil
+	}
+
+	if _, err := sub.Update(ctx, update); err != nil {
+		return errors.Wrapf(err, "could not update subscription %s", sub.ID())
+	}
+	s.logger.Info("Existing subscription updated", logFields)
+
+	return nil
+}
+
+// subscriptionUpdate returns the update of the reconciled properties of the existing subscription
+// which differ from the expected ones. The update is empty if nothing differs.
+func (s *Subscriber) subscriptionUpdate(
+	existing pubsub.SubscriptionConfig,
+	expected pubsub.SubscriptionConfig,
+) pubsub.SubscriptionConfigToUpdate {
+	fields := s.config.ReconcileFields
+
+	update := pubsub.SubscriptionConfigToUpdate{}
+	if fields.has(ReconcileAckDeadline) && expected.AckDeadline != 0 && expected.AckDeadline != existing.AckDeadline {
+		update.AckDeadline = expected.AckDeadline
+	}
+	if fields.has(ReconcileRetainAckedMessages) && expected.RetainAckedMessages && !existing.RetainAckedMessages {
+		update.RetainAckedMessages = true
+	}
+	if fields.has(ReconcileRetentionDuration) && expected.RetentionDuration != 0 &&
+		expected.RetentionDuration != existing.RetentionDuration {
+		update.RetentionDuration = expected.RetentionDuration
+	}
+	if fields.has(ReconcileDeadLetterPolicy) && expected.DeadLetterPolicy != nil &&
+		!reflect.DeepEqual(expected.DeadLetterPolicy, existing.DeadLetterPolicy) {
+		update.DeadLetterPolicy = expected.DeadLetterPolicy
+	}
+	if fields.has(ReconcileRetryPolicy) && expected.RetryPolicy != nil &&
+		!reflect.DeepEqual(expected.RetryPolicy, existing.RetryPolicy) {
+		update.RetryPolicy = expected.RetryPolicy
+	}
+	if fields.has(ReconcileLabels) && expected.Labels != nil && !reflect.DeepEqual(expected.Labels, existing.Labels) {
+		update.Labels = expected.Labels
+	}
+	if fields.has(ReconcilePushConfig) && expected.PushConfig.Endpoint != "" &&
+		!reflect.DeepEqual(expected.PushConfig, existing.PushConfig) {
+		update.PushConfig = &expected.PushConfig
+	}
+	if fields.has(ReconcileBigQueryConfig) && expected.BigQueryConfig.Table != "" {
+		// the state is reported by the server
+		existingBigQueryConfig := existing.BigQueryConfig
+		existingBigQueryConfig.State = expected.BigQueryConfig.State
+
+		if !reflect.DeepEqual(expected.BigQueryConfig, existingBigQueryConfig) {
+			update.BigQueryConfig = &expected.BigQueryConfig
+		}
+	}
+
+	return update
 }
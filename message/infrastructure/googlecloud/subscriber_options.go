@@ -0,0 +1,131 @@
+package googlecloud
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// SubscriberOption configures the Subscriber created by NewSubscriberWithOptions.
+type SubscriberOption func(config *SubscriberConfig)
+
+// NewSubscriberWithOptions creates a Subscriber like NewSubscriber, with the SubscriberConfig built from opts.
+// Options are applied in order, so a later option overrides an earlier one setting the same field.
+// Fields without a dedicated option can be set with WithConfig.
+func NewSubscriberWithOptions(
+	ctx context.Context,
+	logger watermill.LoggerAdapter,
+	opts ...SubscriberOption,
+) (*Subscriber, error) {
+	return NewSubscriber(ctx, subscriberConfigFromOptions(opts...), logger)
+}
+
+func subscriberConfigFromOptions(opts ...SubscriberOption) SubscriberConfig {
+	var config SubscriberConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	return config
+}
+
+// WithProjectID sets SubscriberConfig.ProjectID.
+func WithProjectID(projectID string) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.ProjectID = projectID
+	}
+}
+
+// WithSubscriptionName sets SubscriberConfig.GenerateSubscriptionName.
+func WithSubscriptionName(generateSubscriptionName SubscriptionNameFn) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.GenerateSubscriptionName = generateSubscriptionName
+	}
+}
+
+// WithReceiveSettings sets SubscriberConfig.ReceiveSettings.
+func WithReceiveSettings(receiveSettings pubsub.ReceiveSettings) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.ReceiveSettings = receiveSettings
+	}
+}
+
+// WithSubscriptionConfig sets SubscriberConfig.SubscriptionConfig.
+func WithSubscriptionConfig(subscriptionConfig pubsub.SubscriptionConfig) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.SubscriptionConfig = subscriptionConfig
+	}
+}
+
+// WithCreateTopicIfMissing sets SubscriberConfig.CreateTopicIfMissing.
+func WithCreateTopicIfMissing() SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.CreateTopicIfMissing = true
+	}
+}
+
+// WithDoNotCreateSubscriptionIfMissing sets SubscriberConfig.DoNotCreateSubscriptionIfMissing.
+func WithDoNotCreateSubscriptionIfMissing() SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.DoNotCreateSubscriptionIfMissing = true
+	}
+}
+
+// WithMessageOrdering sets SubscriberConfig.EnableMessageOrdering.
+func WithMessageOrdering() SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.EnableMessageOrdering = true
+	}
+}
+
+// WithAckDeadline sets SubscriberConfig.AckDeadline.
+func WithAckDeadline(ackDeadline time.Duration) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.AckDeadline = ackDeadline
+	}
+}
+
+// WithDeadLetterPolicy sets SubscriberConfig.DeadLetterPolicy.
+func WithDeadLetterPolicy(deadLetterTopic string, maxDeliveryAttempts int) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.DeadLetterPolicy = &DeadLetterPolicy{
+			DeadLetterTopic:     deadLetterTopic,
+			MaxDeliveryAttempts: maxDeliveryAttempts,
+		}
+	}
+}
+
+// WithRetryPolicy sets SubscriberConfig.RetryPolicy.
+func WithRetryPolicy(minimumBackoff, maximumBackoff time.Duration) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.RetryPolicy = &RetryPolicy{
+			MinimumBackoff: minimumBackoff,
+			MaximumBackoff: maximumBackoff,
+		}
+	}
+}
+
+// WithUnmarshaler sets SubscriberConfig.Unmarshaler.
+func WithUnmarshaler(unmarshaler Unmarshaler) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.Unmarshaler = unmarshaler
+	}
+}
+
+// WithClientOptions appends to SubscriberConfig.ClientOptions.
+func WithClientOptions(clientOptions ...option.ClientOption) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		config.ClientOptions = append(config.ClientOptions, clientOptions...)
+	}
+}
+
+// WithConfig modifies SubscriberConfig directly, for the fields without a dedicated option.
+func WithConfig(modify func(config *SubscriberConfig)) SubscriberOption {
+	return func(config *SubscriberConfig) {
+		modify(config)
+	}
+}
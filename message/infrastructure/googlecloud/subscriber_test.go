@@ -0,0 +1,935 @@
+package googlecloud
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Run `docker-compose up` and set PUBSUB_EMULATOR_HOST=googlecloud:8085 for this to work
+
+const testProjectID = "tests"
+
+func TestSubscriber_receive_applies_receive_settings(t *testing.T) {
+	receiveSettings := pubsub.ReceiveSettings{
+		MaxOutstandingMessages: 1,
+		MaxOutstandingBytes:    1024,
+		NumGoroutines:          2,
+	}
+
+	s, err := NewSubscriber(
+		context.Background(),
+		SubscriberConfig{
+			ProjectID:            testProjectID,
+			CreateTopicIfMissing: true,
+			ReceiveSettings:      receiveSettings,
+		},
+		watermill.NopLogger{},
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	topic := "receive_settings_" + watermill.NewShortUUID()
+	sub, err := s.subscription(context.Background(), s.config.GenerateSubscriptionName(topic), topic)
+	require.NoError(t, err)
+	require.NotEqual(t, receiveSettings, sub.ReceiveSettings)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.NoError(t, s.receive(ctx, topic, sub, make(chan struct{}), watermill.LogFields{}, make(chan *message.Message)))
+	assert.Equal(t, receiveSettings, sub.ReceiveSettings)
+}
+
+func TestNewSubscriber_missing_project_id(t *testing.T) {
+	defer setEmulatorHost(t, "")()
+
+	_, err := NewSubscriber(context.Background(), SubscriberConfig{}, watermill.NopLogger{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing ProjectID")
+}
+
+func TestNewSubscriber_missing_project_id_with_emulator(t *testing.T) {
+	defer setEmulatorHost(t, "localhost:8085")()
+
+	s, err := NewSubscriber(context.Background(), SubscriberConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = NewSubscriber(context.Background(), SubscriberConfig{DisableEmulatorAutodetect: true}, watermill.NopLogger{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing ProjectID")
+}
+
+func TestSubscriberConfig_Validate_retry_policy(t *testing.T) {
+	config := SubscriberConfig{
+		ProjectID:   "project",
+		RetryPolicy: &RetryPolicy{MinimumBackoff: time.Minute, MaximumBackoff: time.Second * 10},
+	}
+	config.setDefaults()
+	assert.Error(t, config.Validate())
+
+	config.RetryPolicy = &RetryPolicy{MaximumBackoff: time.Minute * 11}
+	assert.Error(t, config.Validate())
+
+	config.RetryPolicy = &RetryPolicy{MinimumBackoff: time.Second * 10, MaximumBackoff: time.Minute}
+	assert.NoError(t, config.Validate())
+}
+
+func TestSubscriberConfig_Validate_max_delivery_attempts(t *testing.T) {
+	config := SubscriberConfig{
+		ProjectID:           "project",
+		MaxDeliveryAttempts: 5,
+	}
+	config.setDefaults()
+	assert.NoError(t, config.Validate())
+
+	config.DeadLetterPolicy = &DeadLetterPolicy{DeadLetterTopic: "dead_letter"}
+	assert.Error(t, config.Validate(), "MaxDeliveryAttempts with DeadLetterPolicy")
+
+	config.DeadLetterPolicy = nil
+	config.OnMaxDeliveryAttempts = MaxDeliveryAttemptsLog + 1
+	assert.Error(t, config.Validate(), "unknown OnMaxDeliveryAttempts")
+
+	config.OnMaxDeliveryAttempts = MaxDeliveryAttemptsDrop
+	config.MaxDeliveryAttempts = -1
+	assert.Error(t, config.Validate())
+}
+
+func TestDeliveryAttempts(t *testing.T) {
+	attempts := newDeliveryAttempts(2)
+
+	first := &pubsub.Message{ID: "first"}
+	assert.Equal(t, 1, attempts.add(first))
+	assert.Equal(t, 2, attempts.add(first))
+
+	assert.Equal(t, 1, attempts.add(&pubsub.Message{ID: "second"}))
+	assert.Equal(t, 3, attempts.add(first))
+
+	// the least recently delivered message is forgotten
+	assert.Equal(t, 1, attempts.add(&pubsub.Message{ID: "third"}))
+	assert.Equal(t, 1, attempts.add(&pubsub.Message{ID: "second"}))
+
+	attempts.forget(first)
+	assert.Equal(t, 1, attempts.add(first))
+
+	deliveryAttempt := 7
+	assert.Equal(t, 7, attempts.add(&pubsub.Message{ID: "first", DeliveryAttempt: &deliveryAttempt}))
+}
+
+func TestSubscriberConfig_Validate_reconcile_fields(t *testing.T) {
+	config := SubscriberConfig{
+		ProjectID:       "project",
+		ReconcileFields: ReconcileLabels,
+	}
+	config.setDefaults()
+	assert.Error(t, config.Validate(), "ReconcileFields without UpdateSubscriptionIfExists")
+
+	config.UpdateSubscriptionIfExists = true
+	assert.NoError(t, config.Validate())
+
+	config.ReconcileFields = ReconcileAll << 1
+	assert.Error(t, config.Validate(), "unknown ReconcileFields")
+}
+
+func TestSubscriberConfig_rate_limit(t *testing.T) {
+	rateLimit := &RateLimit{MessagesPerSecond: 10}
+	config := SubscriberConfig{
+		ProjectID: "project",
+		RateLimit: rateLimit,
+	}
+	config.setDefaults()
+	require.NoError(t, config.Validate())
+	assert.Equal(t, 1, config.RateLimit.Burst)
+	assert.Equal(t, 0, rateLimit.Burst, "configured RateLimit should not be modified")
+
+	config.RateLimit = &RateLimit{MessagesPerSecond: 0, Burst: 1}
+	assert.Error(t, config.Validate())
+}
+
+func TestNewSubscriberWithClient(t *testing.T) {
+	// no emulator is needed, the client is connected to an in-memory fake server
+	defer setEmulatorHost(t, "")()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := pstest.NewServer()
+	defer srv.Close()
+
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client, err := pubsub.NewClient(ctx, testProjectID, option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	defer client.Close()
+
+	sub, err := NewSubscriberWithClient(ctx, client, SubscriberConfig{CreateTopicIfMissing: true}, watermill.NopLogger{})
+	require.NoError(t, err)
+	assert.Same(t, client, sub.client.(pubsubClient).Client)
+	assert.Equal(t, testProjectID, sub.config.ProjectID)
+
+	pub, err := NewPublisherWithClient(ctx, client, PublisherConfig{})
+	require.NoError(t, err)
+	assert.Same(t, client, pub.client)
+
+	topic := "with_client_" + watermill.NewShortUUID()
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, pub.Publish(topic, msg))
+
+	select {
+	case received := <-messages:
+		assert.Equal(t, msg.UUID, received.UUID)
+		received.Ack()
+	case <-ctx.Done():
+		t.Fatal("message not received")
+	}
+
+	require.NoError(t, pub.Close())
+	require.NoError(t, sub.Close())
+
+	// the client is not closed, as it's owned by the caller
+	_, err = client.Topic(topic).Exists(ctx)
+	assert.NoError(t, err)
+
+	_, err = NewSubscriberWithClient(ctx, nil, SubscriberConfig{}, watermill.NopLogger{})
+	assert.Error(t, err)
+}
+
+func TestSubscriber_LastError_not_replaced_by_other_subscription_stop(t *testing.T) {
+	// no emulator is needed, the client is connected to an in-memory fake server
+	defer setEmulatorHost(t, "")()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := pstest.NewServer()
+	defer srv.Close()
+
+	// only the first streaming pull fails
+	var streamingPulls int32
+	conn, err := grpc.Dial(
+		srv.Addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStreamInterceptor(func(
+			ctx context.Context,
+			desc *grpc.StreamDesc,
+			cc *grpc.ClientConn,
+			method string,
+			streamer grpc.Streamer,
+			opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			if method == "/google.pubsub.v1.Subscriber/StreamingPull" && atomic.AddInt32(&streamingPulls, 1) == 1 {
+				return nil, status.Error(codes.PermissionDenied, "injected error")
+			}
+			return streamer(ctx, desc, cc, method, opts...)
+		}),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client, err := pubsub.NewClient(ctx, testProjectID, option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	defer client.Close()
+
+	s, err := NewSubscriberWithClient(ctx, client, SubscriberConfig{
+		CreateTopicIfMissing: true,
+		ReconnectMaxAttempts: 1,
+		ReceiveSettings:      pubsub.ReceiveSettings{NumGoroutines: 1},
+	}, watermill.NopLogger{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	failed, err := s.Subscribe(ctx, "last_error_failed_"+watermill.NewShortUUID())
+	require.NoError(t, err)
+
+	select {
+	case _, ok := <-failed:
+		require.False(t, ok, "output channel of the failed subscription should be closed")
+	case <-ctx.Done():
+		t.Fatal("subscription not failed")
+	}
+	require.Equal(t, codes.PermissionDenied, status.Code(errors.Cause(s.LastError())))
+
+	stoppedCtx, stop := context.WithCancel(ctx)
+	stopped, err := s.Subscribe(stoppedCtx, "last_error_stopped_"+watermill.NewShortUUID())
+	require.NoError(t, err)
+	stop()
+
+	select {
+	case _, ok := <-stopped:
+		require.False(t, ok, "output channel of the stopped subscription should be closed")
+	case <-ctx.Done():
+		t.Fatal("subscription not stopped")
+	}
+	assert.Equal(
+		t,
+		codes.PermissionDenied,
+		status.Code(errors.Cause(s.LastError())),
+		"failure should not be replaced by another subscription stopping cleanly, got %v", s.LastError(),
+	)
+}
+
+func TestSubscriber_acknowledge_once(t *testing.T) {
+	logger := watermill.NewCaptureLogger()
+	s := newSubscriber(nil, SubscriberConfig{}, logger)
+
+	delivery := &messageDelivery{received: time.Now()}
+	logFields := watermill.LogFields{"message_id": "id"}
+
+	assert.True(t, s.acknowledge(delivery, "ack", logFields))
+	assert.False(t, s.acknowledge(delivery, "nack", logFields), "message should be acked or nacked only once")
+	assert.True(t, logger.Has(watermill.CapturedMessage{
+		Level:  watermill.InfoLogLevel,
+		Fields: logFields,
+		Msg:    "Message already acked or nacked, ignoring nack",
+	}))
+
+	assert.True(t, s.acknowledge(&messageDelivery{received: time.Now()}, "nack", logFields))
+}
+
+func TestSubscriber_handleMessage_acks_once(t *testing.T) {
+	metricsHook := &ackCountingMetricsHook{}
+	config := SubscriberConfig{MetricsHook: metricsHook}
+	config.setDefaults()
+	s := newSubscriber(nil, config, watermill.NopLogger{})
+
+	pubsubMsg := &pubsub.Message{ID: "id", Attributes: map[string]string{UUIDHeaderKey: watermill.NewUUID()}}
+	delivery := &messageDelivery{received: time.Now()}
+	logFields := watermill.LogFields{"message_id": pubsubMsg.ID}
+	output := make(chan *message.Message)
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		s.handleMessage(context.Background(), "topic", "subscription", pubsubMsg, delivery, make(chan struct{}), logFields, output)
+	}()
+
+	msg := <-output
+	assert.True(t, msg.Ack())
+	assert.False(t, msg.Nack())
+	assert.True(t, msg.Ack())
+	<-handled
+
+	// the message is already acked
+	s.nack("topic", pubsubMsg, delivery, logFields)
+	s.ack("topic", pubsubMsg, delivery, logFields)
+
+	acks, nacks := metricsHook.counts()
+	assert.Equal(t, 1, acks)
+	assert.Equal(t, 0, nacks)
+}
+
+type ackCountingMetricsHook struct {
+	NopMetricsHook
+
+	lock  sync.Mutex
+	acks  int
+	nacks int
+}
+
+func (h *ackCountingMetricsHook) OnAck(topic string, elapsed time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.acks++
+}
+
+func (h *ackCountingMetricsHook) OnNack(topic string, elapsed time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.nacks++
+}
+
+func (h *ackCountingMetricsHook) counts() (acks, nacks int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.acks, h.nacks
+}
+
+func TestSubscriberConfigFromOptions(t *testing.T) {
+	receiveSettings := pubsub.ReceiveSettings{MaxOutstandingMessages: 10}
+	subscriptionConfig := pubsub.SubscriptionConfig{Labels: map[string]string{"team": "payments"}}
+	unmarshaler := DefaultMarshalerUnmarshaler{UUIDAttributeKey: "id"}
+	clientOption := option.WithUserAgent("test")
+
+	fromOptions := subscriberConfigFromOptions(
+		WithProjectID("project"),
+		WithSubscriptionName(TopicSubscriptionNameWithSuffix("_suffix")),
+		WithReceiveSettings(receiveSettings),
+		WithSubscriptionConfig(subscriptionConfig),
+		WithCreateTopicIfMissing(),
+		WithDoNotCreateSubscriptionIfMissing(),
+		WithMessageOrdering(),
+		WithAckDeadline(time.Second*30),
+		WithDeadLetterPolicy("dead_letter", 5),
+		WithRetryPolicy(time.Second, time.Minute),
+		WithUnmarshaler(unmarshaler),
+		WithClientOptions(clientOption),
+		WithConfig(func(config *SubscriberConfig) {
+			config.MaxConcurrentDelivery = 3
+		}),
+	)
+
+	fromStruct := SubscriberConfig{
+		ProjectID:                        "project",
+		GenerateSubscriptionName:         TopicSubscriptionNameWithSuffix("_suffix"),
+		ReceiveSettings:                  receiveSettings,
+		SubscriptionConfig:               subscriptionConfig,
+		CreateTopicIfMissing:             true,
+		DoNotCreateSubscriptionIfMissing: true,
+		EnableMessageOrdering:            true,
+		AckDeadline:                      time.Second * 30,
+		DeadLetterPolicy:                 &DeadLetterPolicy{DeadLetterTopic: "dead_letter", MaxDeliveryAttempts: 5},
+		RetryPolicy:                      &RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute},
+		Unmarshaler:                      unmarshaler,
+		ClientOptions:                    []option.ClientOption{clientOption},
+		MaxConcurrentDelivery:            3,
+	}
+
+	// functions can't be compared
+	assert.Equal(t, fromStruct.GenerateSubscriptionName("topic"), fromOptions.GenerateSubscriptionName("topic"))
+	fromStruct.GenerateSubscriptionName = nil
+	fromOptions.GenerateSubscriptionName = nil
+
+	assert.Equal(t, fromStruct, fromOptions)
+}
+
+func TestNewSubscriberWithOptions(t *testing.T) {
+	defer setEmulatorHost(t, "")()
+
+	_, err := NewSubscriberWithOptions(context.Background(), watermill.NopLogger{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing ProjectID", "options should be validated like the struct")
+}
+
+// fakeIAMPolicyServer keeps IAM policies of the subscriptions of the fake Pub/Sub server, which doesn't support IAM.
+type fakeIAMPolicyServer struct {
+	iampb.UnimplementedIAMPolicyServer
+
+	pubsub *pstest.GServer
+
+	lock          sync.Mutex
+	policies      map[string]*iampb.Policy
+	setPolicyCall int
+}
+
+func (f *fakeIAMPolicyServer) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	if _, err := f.pubsub.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{Subscription: req.Resource}); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if policy, ok := f.policies[req.Resource]; ok {
+		return policy, nil
+	}
+	return &iampb.Policy{}, nil
+}
+
+func (f *fakeIAMPolicyServer) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	if _, err := f.pubsub.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{Subscription: req.Resource}); err != nil {
+		return nil, err
+	}
+	if req.Policy == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing policy")
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.policies[req.Resource] = req.Policy
+	f.setPolicyCall++
+	return req.Policy, nil
+}
+
+func TestSubscriber_subscription_iam(t *testing.T) {
+	// no emulator is needed, the client is connected to an in-memory fake server
+	defer setEmulatorHost(t, "")()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pubsubServer := pstest.NewServer()
+	defer pubsubServer.Close()
+
+	iamServer := &fakeIAMPolicyServer{pubsub: &pubsubServer.GServer, policies: map[string]*iampb.Policy{}}
+
+	srv := grpc.NewServer()
+	pubsubpb.RegisterPublisherServer(srv, &pubsubServer.GServer)
+	pubsubpb.RegisterSubscriberServer(srv, &pubsubServer.GServer)
+	iampb.RegisterIAMPolicyServer(srv, iamServer)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client, err := pubsub.NewClient(ctx, testProjectID, option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	defer client.Close()
+
+	s, err := NewSubscriberWithClient(ctx, client, SubscriberConfig{
+		GenerateSubscriptionName: TopicSubscriptionNameWithSuffix("_iam"),
+		CreateTopicIfMissing:     true,
+	}, watermill.NopLogger{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	topic := "iam_" + watermill.NewShortUUID()
+	const member = "serviceAccount:consumer@tests.iam.gserviceaccount.com"
+
+	_, err = s.GetSubscriptionIAMPolicy(ctx, topic)
+	assert.True(t, errors.Is(err, ErrSubscriptionDoesNotExist), "unexpected error: %v", err)
+
+	err = s.AddSubscriptionIAMMember(ctx, topic, iam.Viewer, member)
+	assert.True(t, errors.Is(err, ErrSubscriptionDoesNotExist), "unexpected error: %v", err)
+
+	_, err = s.Subscription(ctx, topic)
+	require.NoError(t, err)
+
+	require.NoError(t, s.AddSubscriptionIAMMember(ctx, topic, iam.Viewer, member))
+
+	policy, err := s.GetSubscriptionIAMPolicy(ctx, topic)
+	require.NoError(t, err)
+	assert.True(t, policy.HasRole(member, iam.Viewer))
+
+	iamServer.lock.Lock()
+	assert.Contains(t, iamServer.policies, "projects/"+testProjectID+"/subscriptions/"+topic+"_iam")
+	iamServer.lock.Unlock()
+
+	require.NoError(t, s.AddSubscriptionIAMMember(ctx, topic, iam.Viewer, member))
+
+	iamServer.lock.Lock()
+	assert.Equal(t, 1, iamServer.setPolicyCall, "policy should not be updated if the member already has the role")
+	iamServer.lock.Unlock()
+}
+
+// fakeSubscriberClient is a subscriberClient keeping topics and subscriptions in memory.
+// The returned handles can't be used to call Pub/Sub.
+type fakeSubscriberClient struct {
+	handles *pubsub.Client
+
+	topics        map[string]struct{}
+	subscriptions map[string]pubsub.SubscriptionConfig
+
+	subscriptionExistsErr error
+	createSubscriptionErr error
+
+	calls []string
+}
+
+func newFakeSubscriberClient(t *testing.T) *fakeSubscriberClient {
+	// the connection is established lazily, when a handle is used
+	conn, err := grpc.Dial("localhost:1", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	handles, err := pubsub.NewClient(context.Background(), testProjectID, option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = handles.Close() })
+
+	return &fakeSubscriberClient{
+		handles:       handles,
+		topics:        map[string]struct{}{},
+		subscriptions: map[string]pubsub.SubscriptionConfig{},
+	}
+}
+
+func (c *fakeSubscriberClient) Subscription(id string) *pubsub.Subscription {
+	return c.handles.Subscription(id)
+}
+
+func (c *fakeSubscriberClient) Topic(id string) *pubsub.Topic {
+	return c.handles.Topic(id)
+}
+
+func (c *fakeSubscriberClient) Topics(ctx context.Context) *pubsub.TopicIterator {
+	panic("not implemented")
+}
+
+func (c *fakeSubscriberClient) Snapshot(id string) *pubsub.Snapshot {
+	return c.handles.Snapshot(id)
+}
+
+func (c *fakeSubscriberClient) SubscriptionExists(ctx context.Context, id string) (bool, error) {
+	c.calls = append(c.calls, "SubscriptionExists "+id)
+	if c.subscriptionExistsErr != nil {
+		return false, c.subscriptionExistsErr
+	}
+
+	_, ok := c.subscriptions[id]
+	return ok, nil
+}
+
+func (c *fakeSubscriberClient) TopicExists(ctx context.Context, id string) (bool, error) {
+	c.calls = append(c.calls, "TopicExists "+id)
+
+	_, ok := c.topics[id]
+	return ok, nil
+}
+
+func (c *fakeSubscriberClient) CreateTopicWithConfig(
+	ctx context.Context,
+	topicID string,
+	tc *pubsub.TopicConfig,
+) (*pubsub.Topic, error) {
+	c.calls = append(c.calls, "CreateTopic "+topicID)
+
+	c.topics[topicID] = struct{}{}
+	return c.Topic(topicID), nil
+}
+
+func (c *fakeSubscriberClient) CreateSubscription(
+	ctx context.Context,
+	id string,
+	cfg pubsub.SubscriptionConfig,
+) (*pubsub.Subscription, error) {
+	c.calls = append(c.calls, "CreateSubscription "+id+" for "+cfg.Topic.ID())
+	if c.createSubscriptionErr != nil {
+		return nil, c.createSubscriptionErr
+	}
+
+	c.subscriptions[id] = cfg
+	return c.Subscription(id), nil
+}
+
+func (c *fakeSubscriberClient) Close() error {
+	return nil
+}
+
+func TestSubscriber_subscription_with_fake_client(t *testing.T) {
+	testCases := []struct {
+		Name                  string
+		Config                SubscriberConfig
+		TopicExists           bool
+		SubscriptionExistsErr error
+		CreateSubscriptionErr error
+
+		ExpectedErr   error
+		ExpectedCode  codes.Code
+		ExpectedCalls []string
+		ExpectCreated bool
+	}{
+		{
+			Name:        "create_subscription",
+			TopicExists: true,
+			ExpectedCalls: []string{
+				"SubscriptionExists topic",
+				"TopicExists topic",
+				"CreateSubscription topic for topic",
+			},
+			ExpectCreated: true,
+		},
+		{
+			Name:   "create_topic_and_subscription",
+			Config: SubscriberConfig{CreateTopicIfMissing: true},
+			ExpectedCalls: []string{
+				"SubscriptionExists topic",
+				"TopicExists topic",
+				"CreateTopic topic",
+				"CreateSubscription topic for topic",
+			},
+			ExpectCreated: true,
+		},
+		{
+			Name:          "missing_topic",
+			ExpectedErr:   ErrTopicDoesNotExist,
+			ExpectedCalls: []string{"SubscriptionExists topic", "TopicExists topic"},
+		},
+		{
+			Name:          "do_not_create_subscription",
+			Config:        SubscriberConfig{DoNotCreateSubscriptionIfMissing: true},
+			TopicExists:   true,
+			ExpectedErr:   ErrSubscriptionDoesNotExist,
+			ExpectedCalls: []string{"SubscriptionExists topic"},
+		},
+		{
+			Name:                  "subscription_exists_error",
+			SubscriptionExistsErr: status.Error(codes.PermissionDenied, "denied"),
+			ExpectedErr:           ErrPermissionDenied,
+			ExpectedCalls:         []string{"SubscriptionExists topic"},
+		},
+		{
+			Name:                  "create_subscription_error",
+			TopicExists:           true,
+			CreateSubscriptionErr: status.Error(codes.InvalidArgument, "invalid"),
+			ExpectedCode:          codes.InvalidArgument,
+			ExpectedCalls: []string{
+				"SubscriptionExists topic",
+				"TopicExists topic",
+				"CreateSubscription topic for topic",
+			},
+		},
+		{
+			Name:                  "created_concurrently",
+			TopicExists:           true,
+			CreateSubscriptionErr: status.Error(codes.AlreadyExists, "exists"),
+			ExpectedCalls: []string{
+				"SubscriptionExists topic",
+				"TopicExists topic",
+				"CreateSubscription topic for topic",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			client := newFakeSubscriberClient(t)
+			if tc.TopicExists {
+				client.topics["topic"] = struct{}{}
+			}
+			client.subscriptionExistsErr = tc.SubscriptionExistsErr
+			client.createSubscriptionErr = tc.CreateSubscriptionErr
+
+			config := tc.Config
+			config.ProjectID = testProjectID
+			config.GenerateSubscriptionName = func(topic string) string { return topic }
+
+			s, err := newSubscriberWithClient(client, config, watermill.NopLogger{})
+			require.NoError(t, err)
+			defer s.Close()
+
+			sub, err := s.subscription(context.Background(), "topic", "topic")
+			switch {
+			case tc.ExpectedErr != nil:
+				assert.True(t, errors.Is(err, tc.ExpectedErr), "unexpected error: %v", err)
+			case tc.ExpectedCode != codes.OK:
+				assert.Equal(t, tc.ExpectedCode, status.Code(errors.Cause(err)), "unexpected error: %v", err)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, "topic", sub.ID())
+			}
+
+			assert.Equal(t, tc.ExpectedCalls, client.calls)
+
+			_, created := s.createdSubscriptions["topic"]
+			assert.Equal(t, tc.ExpectCreated, created)
+		})
+	}
+}
+
+// fakeClock is a clock which moves only when advanced.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		timers: map[*fakeTimer]struct{}{},
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers[t] = struct{}{}
+
+	return t
+}
+
+// Advance moves the clock, firing the timers whose deadline passed.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			t.c <- c.now
+			delete(c.timers, t)
+		}
+	}
+}
+
+// waiting returns how many timers didn't fire yet.
+func (c *fakeClock) waiting() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	if _, ok := t.clock.timers[t]; !ok {
+		return false
+	}
+	delete(t.clock.timers, t)
+
+	return true
+}
+
+type nackCountingMetricsHook struct {
+	NopMetricsHook
+
+	lock    sync.Mutex
+	elapsed []time.Duration
+}
+
+func (h *nackCountingMetricsHook) OnNack(topic string, elapsed time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.elapsed = append(h.elapsed, elapsed)
+}
+
+func (h *nackCountingMetricsHook) nacks() []time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return append([]time.Duration{}, h.elapsed...)
+}
+
+func publishTestMessage(t *testing.T, ctx context.Context, topic string) {
+	client, err := pubsub.NewClient(ctx, testProjectID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Topic(topic).Publish(ctx, &pubsub.Message{
+		Attributes: map[string]string{UUIDHeaderKey: watermill.NewUUID()},
+	}).Get(ctx)
+	require.NoError(t, err)
+}
+
+func TestSubscriber_close_timeout_with_fake_clock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clock := newFakeClock()
+	s, err := NewSubscriber(ctx, SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		CloseTimeout:         time.Hour,
+		clock:                clock,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	topic := "close_timeout_fake_clock_" + watermill.NewShortUUID()
+	messages, err := s.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	publishTestMessage(t, ctx, topic)
+
+	select {
+	case <-messages:
+		// not acked
+	case <-ctx.Done():
+		t.Fatal("Test timed out")
+	}
+
+	closeErr := make(chan error, 1)
+	go func() {
+		closeErr <- s.Close()
+	}()
+
+	require.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second*5, time.Millisecond*10)
+	select {
+	case <-closeErr:
+		t.Fatal("Close should wait for CloseTimeout")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	clock.Advance(time.Hour)
+
+	select {
+	case err := <-closeErr:
+		assert.True(t, errors.Is(err, ErrCloseTimeout), "unexpected error: %v", err)
+	case <-ctx.Done():
+		t.Fatal("Close should return once CloseTimeout passes")
+	}
+}
+
+func TestSubscriber_delivery_timeout_with_fake_clock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clock := newFakeClock()
+	metricsHook := &nackCountingMetricsHook{}
+	s, err := NewSubscriber(ctx, SubscriberConfig{
+		ProjectID:            testProjectID,
+		CreateTopicIfMissing: true,
+		DeliveryTimeout:      time.Hour,
+		MetricsHook:          metricsHook,
+		clock:                clock,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer s.Close()
+
+	topic := "delivery_timeout_fake_clock_" + watermill.NewShortUUID()
+	_, err = s.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	publishTestMessage(t, ctx, topic)
+
+	// the message is not read from the output channel
+	require.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second*5, time.Millisecond*10)
+	assert.Empty(t, metricsHook.nacks())
+
+	clock.Advance(time.Hour)
+
+	require.Eventually(t, func() bool { return len(metricsHook.nacks()) > 0 }, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, time.Hour, metricsHook.nacks()[0])
+}
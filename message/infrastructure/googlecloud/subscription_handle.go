@@ -0,0 +1,35 @@
+package googlecloud
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// SubscriptionHandle controls a subscription started with SubscribeWithHandle.
+type SubscriptionHandle struct {
+	messages <-chan *message.Message
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Messages returns the output channel of the subscription, the one Subscribe returns.
+func (h *SubscriptionHandle) Messages() <-chan *message.Message {
+	return h.messages
+}
+
+// Done returns a channel closed once the subscription is fully stopped: receiving has finished,
+// all its messages were acked or nacked and the output channel is closed.
+func (h *SubscriptionHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Unsubscribe stops receiving from the subscription, like canceling the context passed to SubscribeWithHandle,
+// and waits until it's fully stopped. Messages not acked yet are nacked, so they are redelivered.
+// The other subscriptions of the Subscriber keep receiving.
+//
+// Unsubscribe is safe to call multiple times and concurrently.
+func (h *SubscriptionHandle) Unsubscribe() {
+	h.cancel()
+	<-h.done
+}
@@ -0,0 +1,70 @@
+package googlecloud
+
+import (
+	"context"
+
+	"cloud.google.com/go/iam"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// GetSubscriptionIAMPolicy returns the IAM policy of the subscription of the topic.
+// The subscription name is resolved with the configured `GenerateSubscriptionName` function,
+// and the subscription is not created if it's missing; the returned error wraps `ErrSubscriptionDoesNotExist` then.
+func (s *Subscriber) GetSubscriptionIAMPolicy(ctx context.Context, topic string) (*iam.Policy, error) {
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+
+	policy, err := s.client.Subscription(subscriptionName).IAM().Policy(ctx)
+	if err != nil {
+		return nil, iamError(err, "could not get IAM policy of subscription", subscriptionName)
+	}
+
+	return policy, nil
+}
+
+// AddSubscriptionIAMMember grants the role to the member on the subscription of the topic,
+// for example roles/pubsub.subscriber to serviceAccount:consumer@project.iam.gserviceaccount.com.
+// The policy is not updated if the member already has the role.
+//
+// The subscription is resolved like with GetSubscriptionIAMPolicy. The policy is read and written back,
+// so when it's modified concurrently, the returned error has the Aborted gRPC code and the call may be retried.
+func (s *Subscriber) AddSubscriptionIAMMember(ctx context.Context, topic string, role iam.RoleName, member string) error {
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+	handle := s.client.Subscription(subscriptionName).IAM()
+
+	policy, err := handle.Policy(ctx)
+	if err != nil {
+		return iamError(err, "could not get IAM policy of subscription", subscriptionName)
+	}
+
+	logFields := watermill.LogFields{
+		"subscription_name": subscriptionName,
+		"role":              role,
+		"member":            member,
+	}
+
+	if policy.HasRole(member, role) {
+		s.logger.Debug("Member already has the role on the subscription", logFields)
+		return nil
+	}
+
+	policy.Add(member, role)
+	if err := handle.SetPolicy(ctx, policy); err != nil {
+		return iamError(err, "could not set IAM policy of subscription", subscriptionName)
+	}
+
+	s.logger.Info("Member added to the subscription IAM policy", logFields)
+
+	return nil
+}
+
+func iamError(err error, msg string, subscriptionName string) error {
+	if grpc.Code(err) == codes.NotFound {
+		return errors.Wrapf(ErrSubscriptionDoesNotExist, "%s %s", msg, subscriptionName)
+	}
+
+	return errors.Wrapf(err, "%s %s", msg, subscriptionName)
+}
@@ -0,0 +1,74 @@
+package googlecloud
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	// TraceParentKey is the key of the Pub/Sub attribute and Watermill message metadata
+	// that carries the W3C Trace Context traceparent.
+	TraceParentKey = "traceparent"
+	// TraceStateKey is the key of the Pub/Sub attribute and Watermill message metadata
+	// that carries the W3C Trace Context tracestate.
+	TraceStateKey = "tracestate"
+)
+
+// TracePropagator carries the trace context of a message across the publish/subscribe boundary.
+type TracePropagator interface {
+	// Inject adds the trace context of the message to the attributes of the published Pub/Sub message.
+	Inject(msg *message.Message, attributes map[string]string)
+	// Extract sets the trace context from the attributes of the received Pub/Sub message on the message.
+	Extract(attributes map[string]string, msg *message.Message)
+}
+
+type ctxKey string
+
+const traceParentKey ctxKey = "traceparent"
+
+// ContextWithTraceParent returns a copy of ctx carrying the W3C traceparent,
+// for example set by a tracing middleware from the current span.
+func ContextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	return context.WithValue(ctx, traceParentKey, traceParent)
+}
+
+// TraceParentFromCtx returns the W3C traceparent carried by ctx, or an empty string.
+func TraceParentFromCtx(ctx context.Context) string {
+	val, ok := ctx.Value(traceParentKey).(string)
+	if !ok {
+		return ""
+	}
+	return val
+}
+
+// W3CTracePropagator propagates the W3C Trace Context in the traceparent and tracestate attributes.
+//
+// The traceparent is taken from the message context (see ContextWithTraceParent) or, if it is not set there,
+// from the message metadata. Received messages have the trace context in the metadata
+// under TraceParentKey and TraceStateKey.
+type W3CTracePropagator struct{}
+
+func (W3CTracePropagator) Inject(msg *message.Message, attributes map[string]string) {
+	traceParent := TraceParentFromCtx(msg.Context())
+	if traceParent == "" {
+		traceParent = msg.Metadata.Get(TraceParentKey)
+	}
+	if traceParent == "" {
+		return
+	}
+
+	attributes[TraceParentKey] = traceParent
+	if traceState := msg.Metadata.Get(TraceStateKey); traceState != "" {
+		attributes[TraceStateKey] = traceState
+	}
+}
+
+func (W3CTracePropagator) Extract(attributes map[string]string, msg *message.Message) {
+	if traceParent, ok := attributes[TraceParentKey]; ok {
+		msg.Metadata.Set(TraceParentKey, traceParent)
+	}
+	if traceState, ok := attributes[TraceStateKey]; ok {
+		msg.Metadata.Set(TraceStateKey, traceState)
+	}
+}